@@ -0,0 +1,267 @@
+package happening
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+	"sort"
+)
+
+// Aggregation errors
+var (
+	ErrInvalidBucket  = errors.New("invalid aggregation bucket")
+	ErrInvalidGroupBy = errors.New("invalid aggregation group by field")
+	ErrTooManyGroups  = errors.New("too many aggregation groups")
+)
+
+// AggregateQuery describes an aggregation of the events matching
+// Filter, grouped by time buckets of Bucket seconds, zero for a
+// single bucket, and by the GroupBy events fields, AGGREGATE_GROUP_FROM
+// and AGGREGATE_GROUP_TYPE.
+type AggregateQuery struct {
+	Filter  *EventFilter
+	Bucket  int64
+	GroupBy []string
+
+	byFrom bool
+	byType bool
+}
+
+// NewAggregateQuery validates and returns a new AggregateQuery.
+func NewAggregateQuery(filter *EventFilter, bucket int64, groupBy []string) (*AggregateQuery, error) {
+	if bucket < 0 {
+		return nil, fmt.Errorf("%s: %d", ErrInvalidBucket, bucket)
+	}
+
+	query := &AggregateQuery{
+		Filter:  filter,
+		Bucket:  bucket,
+		GroupBy: groupBy,
+	}
+
+	for _, field := range groupBy {
+		switch field {
+		case AGGREGATE_GROUP_FROM:
+			query.byFrom = true
+		case AGGREGATE_GROUP_TYPE:
+			query.byType = true
+		default:
+			return nil, fmt.Errorf("%s: %q", ErrInvalidGroupBy, field)
+		}
+	}
+
+	return query, nil
+}
+
+// group returns the aggregate group an event belongs to.
+func (q *AggregateQuery) group(event *Event) aggregateGroup {
+	var group aggregateGroup
+
+	if q.Bucket > 0 {
+		group.bucket = bucketStart(event.SentOn, q.Bucket)
+	}
+	if q.byFrom {
+		group.from = event.From
+	}
+	if q.byType {
+		group.eventType = event.Type
+	}
+
+	return group
+}
+
+type aggregateGroup struct {
+	bucket    int64
+	from      string
+	eventType string
+}
+
+// Aggregate extends a Rollup of the events of a group, whose From,
+// Type and Bucket are only set when grouping by them, with their
+// transport latencies distribution.
+type Aggregate struct {
+	Rollup
+	Duration int64
+	Latency  *LatencyHistogram
+}
+
+func newAggregate(group aggregateGroup, duration int64) *Aggregate {
+	return &Aggregate{
+		Rollup:   *NewRollup(group.from, group.eventType, "", group.bucket),
+		Duration: duration,
+		Latency:  NewLatencyHistogram(),
+	}
+}
+
+// Add accounts for an event in the aggregate.
+func (a *Aggregate) Add(event *Event) {
+	a.Rollup.Add(event)
+	a.Latency.Record(event.ReceivedOn - event.SentOn)
+}
+
+// Rate returns the aggregate events per second, over it's bucket
+// Duration, or over the time span of it's events when not bucketed.
+func (a *Aggregate) Rate() float64 {
+	duration := a.Duration
+	if duration == 0 {
+		duration = a.LastSentOn - a.FirstSentOn + 1
+	}
+	return float64(a.Count) / float64(duration)
+}
+
+// Aggregate computes the aggregates of the events matching query,
+// ordered by bucket, source and type. Events are streamed from the
+// storage backend, only the aggregates are held in memory, up to
+// AGGREGATE_MAX_GROUPS of them.
+func (s *EventStore) Aggregate(ctx context.Context, query *AggregateQuery) ([]*Aggregate, error) {
+	var aggregates []*Aggregate
+	var err error
+
+	groups := make(map[aggregateGroup]*Aggregate)
+	scanErr := s.scan(ctx, query.Filter, nil, func(position []byte, key []byte, event *Event) bool {
+		group := query.group(event)
+
+		aggregate, ok := groups[group]
+		if !ok {
+			if len(groups) >= AGGREGATE_MAX_GROUPS {
+				err = ErrTooManyGroups
+				return false
+			}
+
+			aggregate = newAggregate(group, query.Bucket)
+			groups[group] = aggregate
+			aggregates = append(aggregates, aggregate)
+		}
+
+		aggregate.Add(event)
+		return true
+	})
+	if scanErr != nil {
+		return nil, scanErr
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(aggregates, func(i, j int) bool {
+		a, b := aggregates[i], aggregates[j]
+		if a.Bucket != b.Bucket {
+			return a.Bucket < b.Bucket
+		}
+		if a.From != b.From {
+			return a.From < b.From
+		}
+		return a.Type < b.Type
+	})
+
+	return aggregates, nil
+}
+
+// LatencyHistogram records a distribution of latencies, in seconds,
+// using log-linear buckets: latencies below 2^(precision+1) are
+// recorded exactly, and greater ones within 1/2^precision of their
+// value, precision being LATENCY_HISTOGRAM_PRECISION. Negative
+// latencies, which clocks skew may cause, are recorded as zero, but
+// still account for Min and Sum.
+type LatencyHistogram struct {
+	Count uint64
+	Min   int64
+	Max   int64
+	Sum   int64
+
+	buckets map[int]uint64
+}
+
+// NewLatencyHistogram returns a new empty LatencyHistogram.
+func NewLatencyHistogram() *LatencyHistogram {
+	return &LatencyHistogram{
+		buckets: make(map[int]uint64),
+	}
+}
+
+// Record accounts for a latency in the histogram.
+func (h *LatencyHistogram) Record(latency int64) {
+	if h.Count == 0 || latency < h.Min {
+		h.Min = latency
+	}
+	if h.Count == 0 || latency > h.Max {
+		h.Max = latency
+	}
+	h.Count++
+	h.Sum += latency
+	h.buckets[latencyBucket(latency)]++
+}
+
+// Mean returns the mean recorded latency.
+func (h *LatencyHistogram) Mean() float64 {
+	if h.Count == 0 {
+		return 0
+	}
+	return float64(h.Sum) / float64(h.Count)
+}
+
+// Percentile returns an approximation of the latency below which
+// percentile percent of the recorded latencies fall.
+func (h *LatencyHistogram) Percentile(percentile float64) int64 {
+	if h.Count == 0 {
+		return 0
+	}
+
+	rank := uint64(math.Ceil(percentile / 100 * float64(h.Count)))
+	if rank == 0 {
+		rank = 1
+	}
+
+	indexes := make([]int, 0, len(h.buckets))
+	for index := range h.buckets {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+
+	var seen uint64
+	for _, index := range indexes {
+		seen += h.buckets[index]
+		if seen >= rank {
+			latency := latencyBucketValue(index)
+			if latency < h.Min {
+				latency = h.Min
+			}
+			if latency > h.Max {
+				latency = h.Max
+			}
+			return latency
+		}
+	}
+
+	return h.Max
+}
+
+// latencyBucket returns the index of the histogram bucket
+// a latency is recorded into.
+func latencyBucket(latency int64) int {
+	if latency <= 0 {
+		return 0
+	}
+
+	shift := bits.Len64(uint64(latency)) - LATENCY_HISTOGRAM_PRECISION - 1
+	if shift <= 0 {
+		return int(latency)
+	}
+
+	return shift<<LATENCY_HISTOGRAM_PRECISION + int(latency>>uint(shift))
+}
+
+// latencyBucketValue returns the latency in the middle
+// of the histogram bucket at index.
+func latencyBucketValue(index int) int64 {
+	if index < 2<<LATENCY_HISTOGRAM_PRECISION {
+		return int64(index)
+	}
+
+	shift := index>>LATENCY_HISTOGRAM_PRECISION - 1
+	subBucket := int64(index - shift<<LATENCY_HISTOGRAM_PRECISION)
+
+	return subBucket<<uint(shift) + (int64(1)<<uint(shift))/2
+}
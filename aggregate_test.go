@@ -0,0 +1,178 @@
+package happening
+
+import (
+	"math"
+	"testing"
+)
+
+func TestLatencyBucket(t *testing.T) {
+	tests := []struct {
+		latency int64
+		index   int
+		value   int64
+	}{
+		{math.MinInt64, 0, 0},
+		{-1, 0, 0},
+		{0, 0, 0},
+		{1, 1, 1},
+		{16, 16, 16},
+		{31, 31, 31},
+		// From 32 on, each power of two is split into 16 buckets
+		{32, 32, 33},
+		{33, 32, 33},
+		{34, 33, 35},
+		{63, 47, 63},
+		{64, 48, 66},
+		{67, 48, 66},
+		{68, 49, 70},
+		{1000, 111, 1008},
+		{math.MaxInt64, 959, 31<<58 + 1<<57},
+	}
+
+	for _, test := range tests {
+		index := latencyBucket(test.latency)
+		if index != test.index {
+			t.Errorf("latencyBucket(%d) = %d, want %d", test.latency, index, test.index)
+		}
+		if value := latencyBucketValue(index); value != test.value {
+			t.Errorf("latencyBucketValue(%d) = %d, want %d", index, value, test.value)
+		}
+	}
+}
+
+func TestLatencyBucketBounds(t *testing.T) {
+	// Buckets are contiguous, and hold latencies within
+	// 1/2^LATENCY_HISTOGRAM_PRECISION of their value.
+	previous := 0
+	for latency := int64(1); latency < 1<<20; latency++ {
+		index := latencyBucket(latency)
+		if index != previous && index != previous+1 {
+			t.Fatalf("latencyBucket(%d) = %d, following bucket %d", latency, index, previous)
+		}
+		previous = index
+
+		value := latencyBucketValue(index)
+		if math.Abs(float64(value-latency)) > float64(latency)/(1<<LATENCY_HISTOGRAM_PRECISION) {
+			t.Fatalf("latency %d recorded as %d", latency, value)
+		}
+	}
+}
+
+func TestLatencyHistogramRecord(t *testing.T) {
+	histogram := NewLatencyHistogram()
+	if histogram.Mean() != 0 || histogram.Percentile(50) != 0 {
+		t.Errorf("empty histogram mean = %v, p50 = %d, want 0, 0", histogram.Mean(), histogram.Percentile(50))
+	}
+
+	for _, latency := range []int64{-4, 0, 0, 10} {
+		histogram.Record(latency)
+	}
+
+	if histogram.Count != 4 || histogram.Min != -4 || histogram.Max != 10 || histogram.Sum != 6 {
+		t.Errorf("histogram = count %d, min %d, max %d, sum %d, want 4, -4, 10, 6",
+			histogram.Count, histogram.Min, histogram.Max, histogram.Sum)
+	}
+	if histogram.Mean() != 1.5 {
+		t.Errorf("Mean = %v, want 1.5", histogram.Mean())
+	}
+
+	// Negative latencies are recorded as zero
+	for percentile, want := range map[float64]int64{0: 0, 25: 0, 75: 0, 76: 10, 100: 10} {
+		if got := histogram.Percentile(percentile); got != want {
+			t.Errorf("p%v = %d, want %d", percentile, got, want)
+		}
+	}
+
+	// Percentiles stay within the recorded latencies
+	histogram = NewLatencyHistogram()
+	histogram.Record(-7)
+	histogram.Record(-2)
+	if got := histogram.Percentile(50); got != -2 {
+		t.Errorf("p50 of negative latencies = %d, want -2", got)
+	}
+}
+
+func TestLatencyHistogramPercentiles(t *testing.T) {
+	tests := []struct {
+		name      string
+		latencies func(record func(latency int64))
+		want      map[float64]int64
+	}{
+		{
+			"exact",
+			func(record func(int64)) {
+				for latency := int64(1); latency <= 20; latency++ {
+					record(latency)
+				}
+			},
+			map[float64]int64{5: 1, 50: 10, 90: 18, 99: 20, 100: 20},
+		},
+		{
+			"uniform",
+			func(record func(int64)) {
+				for latency := int64(1); latency <= 1000; latency++ {
+					record(latency)
+				}
+			},
+			map[float64]int64{50: 500, 90: 900, 99: 990, 100: 1000},
+		},
+		{
+			"constant",
+			func(record func(int64)) {
+				for count := 0; count < 100; count++ {
+					record(3600)
+				}
+			},
+			map[float64]int64{1: 3600, 50: 3600, 99: 3600},
+		},
+		{
+			"long tail",
+			func(record func(int64)) {
+				for count := 0; count < 990; count++ {
+					record(2)
+				}
+				for count := 0; count < 10; count++ {
+					record(86400)
+				}
+			},
+			map[float64]int64{50: 2, 99: 2, 99.1: 86400, 100: 86400},
+		},
+	}
+
+	for _, test := range tests {
+		histogram := NewLatencyHistogram()
+		test.latencies(histogram.Record)
+
+		for percentile, want := range test.want {
+			got := histogram.Percentile(percentile)
+			if math.Abs(float64(got-want)) > float64(want)/(1<<LATENCY_HISTOGRAM_PRECISION) {
+				t.Errorf("%s: p%v = %d, want %d", test.name, percentile, got, want)
+			}
+		}
+	}
+}
+
+func TestAggregateRate(t *testing.T) {
+	tests := []struct {
+		duration int64
+		sentOn   []int64
+		want     float64
+	}{
+		{0, nil, 0},
+		{60, nil, 0},
+		{0, []int64{100}, 1},
+		{0, []int64{100, 101, 109}, 0.3},
+		{60, []int64{100, 101, 109}, 0.05},
+	}
+
+	for _, test := range tests {
+		aggregate := newAggregate(aggregateGroup{}, test.duration)
+		for _, sentOn := range test.sentOn {
+			aggregate.Add(NewEvent("kitchen", sentOn, sentOn+1, "temperature"))
+		}
+
+		if rate := aggregate.Rate(); math.Abs(rate-test.want) > 1e-9 {
+			t.Errorf("rate of %v over %ds = %v, want %v", test.sentOn, test.duration, rate, test.want)
+		}
+	}
+}
@@ -0,0 +1,441 @@
+package happening
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	l4g "github.com/alecthomas/log4go"
+)
+
+// Alerting errors
+var (
+	ErrInvalidAlertRule = errors.New("invalid alert rule")
+)
+
+// AlertRule describes a condition on the live events stream, which
+// is evaluated separately for each events stream, the events of a
+// given type sent by a source, optionally restricted to the From
+// source and Type events:
+//
+//   - ALERT_RATE_ABOVE fires while more than Count events were
+//     received within the last Window seconds
+//   - ALERT_RATE_BELOW fires while less than Count events were
+//     received within the last Window seconds
+//   - ALERT_DELAY fires once an event is received more than
+//     MaxDelay seconds after it was sent, until one is received
+//     in time
+//   - ALERT_SEQUENCE, evaluated for each source, fires once a Then
+//     event is received within Within seconds after a First event,
+//     until Within seconds have passed without it happening again
+type AlertRule struct {
+	Name string
+	Kind string
+	From string
+	Type string
+
+	Count    int
+	Window   int64
+	MaxDelay int64
+	First    string
+	Then     string
+	Within   int64
+}
+
+// ParseAlertRules builds AlertRules from a semicolon
+// separated list of name:kind:parameters rules, such as:
+//
+//	hot:rate_above:type=temperature,count=10,window=60;slow:delay:max_delay=30
+//
+// See AlertRule for the kinds of rules, and their parameters.
+func ParseAlertRules(rules string) ([]*AlertRule, error) {
+	var alertRules []*AlertRule
+	names := make(map[string]bool)
+
+	for _, rule := range strings.Split(rules, ";") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+
+		parts := strings.SplitN(rule, ":", 3)
+		if len(parts) != 3 || parts[0] == "" {
+			return nil, fmt.Errorf("%s: %q", ErrInvalidAlertRule, rule)
+		}
+
+		if names[parts[0]] {
+			return nil, fmt.Errorf("%s: %q, duplicate name %q", ErrInvalidAlertRule, rule, parts[0])
+		}
+		names[parts[0]] = true
+
+		alertRule := &AlertRule{Name: parts[0], Kind: parts[1]}
+		if err := alertRule.parseParameters(parts[2]); err != nil {
+			return nil, fmt.Errorf("%s: %q, %s", ErrInvalidAlertRule, rule, err)
+		}
+		alertRules = append(alertRules, alertRule)
+	}
+
+	return alertRules, nil
+}
+
+// parseParameters parses and validates a comma separated
+// list of parameter=value alert rule parameters.
+func (r *AlertRule) parseParameters(parameters string) error {
+	for _, parameter := range strings.Split(parameters, ",") {
+		parts := strings.SplitN(strings.TrimSpace(parameter), "=", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return fmt.Errorf("malformed parameter %q", parameter)
+		}
+
+		var err error
+		switch parts[0] {
+		case ALERT_PARAM_FROM:
+			r.From = parts[1]
+		case ALERT_PARAM_TYPE:
+			r.Type = parts[1]
+		case ALERT_PARAM_FIRST:
+			r.First = parts[1]
+		case ALERT_PARAM_THEN:
+			r.Then = parts[1]
+		case ALERT_PARAM_COUNT:
+			r.Count, err = strconv.Atoi(parts[1])
+		case ALERT_PARAM_WINDOW:
+			r.Window, err = strconv.ParseInt(parts[1], 10, 64)
+		case ALERT_PARAM_MAX_DELAY:
+			r.MaxDelay, err = strconv.ParseInt(parts[1], 10, 64)
+		case ALERT_PARAM_WITHIN:
+			r.Within, err = strconv.ParseInt(parts[1], 10, 64)
+		default:
+			return fmt.Errorf("unknown parameter %q", parts[0])
+		}
+		if err != nil {
+			return fmt.Errorf("invalid %s value %q", parts[0], parts[1])
+		}
+	}
+
+	switch r.Kind {
+	case ALERT_RATE_ABOVE, ALERT_RATE_BELOW:
+		if r.Count <= 0 || r.Window <= 0 {
+			return fmt.Errorf("%s and %s should be positive", ALERT_PARAM_COUNT, ALERT_PARAM_WINDOW)
+		}
+	case ALERT_DELAY:
+		if r.MaxDelay < 0 {
+			return fmt.Errorf("%s should not be negative", ALERT_PARAM_MAX_DELAY)
+		}
+	case ALERT_SEQUENCE:
+		if r.First == "" || r.Then == "" || r.Within <= 0 {
+			return fmt.Errorf("%s and %s are required, and %s should be positive",
+				ALERT_PARAM_FIRST, ALERT_PARAM_THEN, ALERT_PARAM_WITHIN)
+		}
+	default:
+		return fmt.Errorf("unknown kind %q", r.Kind)
+	}
+
+	return nil
+}
+
+// match returns whether an event is relevant to the rule.
+func (r *AlertRule) match(event *Event) bool {
+	if r.From != "" && r.From != event.From {
+		return false
+	}
+
+	if r.Kind == ALERT_SEQUENCE {
+		return event.Type == r.First || event.Type == r.Then
+	}
+
+	return r.Type == "" || r.Type == event.Type
+}
+
+// Alert is a change of state of an AlertRule, for the
+// events of Type sent by From, which happened On.
+type Alert struct {
+	Rule   *AlertRule
+	From   string
+	Type   string
+	Firing bool
+	Reason string
+	On     int64
+}
+
+// State returns the alert state, ALERT_FIRING or ALERT_RESOLVED.
+func (a *Alert) State() string {
+	if a.Firing {
+		return ALERT_FIRING
+	}
+	return ALERT_RESOLVED
+}
+
+// Event returns the alert as an event sent by ALERT_EVENT_SOURCE,
+// of type ALERT_EVENT_TYPE, whose value is the alert state, and
+// whose attributes describe the alert.
+func (a *Alert) Event() *Event {
+	event := NewEvent(ALERT_EVENT_SOURCE, a.On, a.On, ALERT_EVENT_TYPE)
+	event.Value = NewTextValue(a.State())
+	event.Attributes = map[string]string{
+		"rule":   a.Rule.Name,
+		"kind":   a.Rule.Kind,
+		"from":   a.From,
+		"reason": a.Reason,
+	}
+	if a.Type != "" {
+		event.Attributes["type"] = a.Type
+	}
+
+	return event
+}
+
+// alertGroupKey identifies the events stream, or
+// source for sequences, a rule is evaluated for.
+type alertGroupKey struct {
+	rule      *AlertRule
+	from      string
+	eventType string
+}
+
+// alertGroup holds the evaluation state of a rule for an events
+// stream: when it was first seen, the reception times of it's most
+// recent events for rate rules, and the last First and Then events
+// reception times for sequence rules.
+type alertGroup struct {
+	firing    bool
+	firstSeen int64
+	times     []int64
+	first     int64
+	matched   int64
+}
+
+// AlertService is a Service evaluating it's Rules against every
+// event the Handler queues, and injecting an alert event into the
+// Handler events pipeline whenever an alert fires or resolves.
+// Events are recorded by the Handler itself rather than received
+// from the subscriptions hub, which drops events for slow listeners,
+// so that rate and delay rules never miss one. Alert events
+// themselves are never evaluated.
+type AlertService struct {
+	Service
+	Handler *EventsHandler
+	Rules   []*AlertRule
+
+	mu     sync.Mutex
+	groups map[alertGroupKey]*alertGroup
+}
+
+// NewAlertService builds an AlertService evaluating rules over the
+// handler events, and injecting the alerts into it's pipeline.
+func NewAlertService(handler *EventsHandler, rules []*AlertRule) *AlertService {
+	return &AlertService{
+		Service: *NewService("AlertService"),
+		Handler: handler,
+		Rules:   rules,
+		groups:  make(map[alertGroupKey]*alertGroup),
+	}
+}
+
+// Start runs the AlertService evaluation routine in background.
+func (a *AlertService) Start() {
+	go a.Run()
+}
+
+// Run should be run as a long-running goroutine. It evaluates the
+// rules depending on time passing every ALERT_CHECK_INTERVAL, until
+// the service is stopped.
+func (a *AlertService) Run() {
+	defer a.waitGroup.Done()
+	l4g.Info(fmt.Sprintf("[%s.Run] Alert service watching %d rules", a.name, len(a.Rules)))
+
+	ticker := time.NewTicker(time.Duration(ALERT_CHECK_INTERVAL) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.ch:
+			return
+		case <-ticker.C:
+			a.mu.Lock()
+			alerts := a.Check(time.Now().Unix())
+			a.mu.Unlock()
+
+			a.raise(alerts)
+		}
+	}
+}
+
+// Record evaluates the rules against an event queued by the
+// Handler, and raises the resulting alerts. It is safe for
+// concurrent use.
+func (a *AlertService) Record(event *Event) {
+	a.mu.Lock()
+	alerts := a.Observe(event, time.Now().Unix())
+	a.mu.Unlock()
+
+	a.raise(alerts)
+}
+
+// raise logs and injects alerts into the events pipeline.
+func (a *AlertService) raise(alerts []*Alert) {
+	for _, alert := range alerts {
+		message := fmt.Sprintf("[%s.raise] Alert %s %s for %s %s: %s",
+			a.name, alert.Rule.Name, alert.State(), alert.From, alert.Type, alert.Reason)
+		if alert.Firing {
+			l4g.Warn(message)
+		} else {
+			l4g.Info(message)
+		}
+
+		if err := a.Handler.Inject(alert.Event()); err != nil {
+			l4g.Error(fmt.Sprintf("[%s.raise] Unable to inject alert %s: %s", a.name, alert.Rule.Name, err))
+		}
+	}
+}
+
+// Observe evaluates the rules against an event received
+// on now, and returns the resulting alerts. Unlike Record,
+// it is not safe for concurrent use.
+func (a *AlertService) Observe(event *Event, now int64) []*Alert {
+	var alerts []*Alert
+
+	if event.From == ALERT_EVENT_SOURCE && event.Type == ALERT_EVENT_TYPE {
+		return nil
+	}
+
+	for _, rule := range a.Rules {
+		if !rule.match(event) {
+			continue
+		}
+
+		key := alertGroupKey{rule: rule, from: event.From, eventType: event.Type}
+		if rule.Kind == ALERT_SEQUENCE {
+			key.eventType = ""
+		}
+
+		group, ok := a.groups[key]
+		if !ok {
+			// Delays only need to be remembered while firing
+			if rule.Kind == ALERT_DELAY && event.ReceivedOn-event.SentOn <= rule.MaxDelay {
+				continue
+			}
+
+			if len(a.groups) >= ALERT_MAX_GROUPS {
+				l4g.Warn(fmt.Sprintf("[%s.Observe] Too many alert groups, ignoring %s for %s", a.name, event, rule.Name))
+				continue
+			}
+
+			group = &alertGroup{firstSeen: now}
+			a.groups[key] = group
+		}
+
+		if alert := a.observe(key, group, event, now); alert != nil {
+			alerts = append(alerts, alert)
+		}
+	}
+
+	return alerts
+}
+
+func (a *AlertService) observe(key alertGroupKey, group *alertGroup, event *Event, now int64) *Alert {
+	rule := key.rule
+
+	switch rule.Kind {
+	case ALERT_RATE_ABOVE:
+		group.record(now, rule.Count+1)
+		if !group.firing && len(group.times) > rule.Count && group.times[0] > now-rule.Window {
+			return group.transition(key, true, now,
+				fmt.Sprintf("more than %d events within %ds", rule.Count, rule.Window))
+		}
+	case ALERT_RATE_BELOW:
+		group.record(now, rule.Count)
+		if group.firing && len(group.times) == rule.Count && group.times[0] > now-rule.Window {
+			return group.transition(key, false, now,
+				fmt.Sprintf("%d events within %ds", rule.Count, rule.Window))
+		}
+	case ALERT_DELAY:
+		delay := event.ReceivedOn - event.SentOn
+		if !group.firing && delay > rule.MaxDelay {
+			return group.transition(key, true, now,
+				fmt.Sprintf("event received %ds after it was sent", delay))
+		}
+		if group.firing && delay <= rule.MaxDelay {
+			delete(a.groups, key)
+			return group.transition(key, false, now,
+				fmt.Sprintf("event received %ds after it was sent", delay))
+		}
+	case ALERT_SEQUENCE:
+		if event.Type == rule.Then && group.first > 0 && now-group.first <= rule.Within {
+			group.first = 0
+			group.matched = now
+			if !group.firing {
+				return group.transition(key, true, now,
+					fmt.Sprintf("%s followed by %s within %ds", rule.First, rule.Then, rule.Within))
+			}
+		}
+		if event.Type == rule.First {
+			group.first = now
+		}
+	}
+
+	return nil
+}
+
+// Check evaluates the rules depending on time passing
+// on now, and returns the resulting alerts.
+func (a *AlertService) Check(now int64) []*Alert {
+	var alerts []*Alert
+
+	for key, group := range a.groups {
+		rule := key.rule
+
+		switch rule.Kind {
+		case ALERT_RATE_ABOVE:
+			if group.firing && group.times[0] <= now-rule.Window {
+				alerts = append(alerts, group.transition(key, false, now,
+					fmt.Sprintf("at most %d events within %ds", rule.Count, rule.Window)))
+			}
+			if !group.firing && group.times[len(group.times)-1] <= now-rule.Window {
+				delete(a.groups, key)
+			}
+		case ALERT_RATE_BELOW:
+			if !group.firing && now-group.firstSeen >= rule.Window &&
+				(len(group.times) < rule.Count || group.times[0] <= now-rule.Window) {
+				alerts = append(alerts, group.transition(key, true, now,
+					fmt.Sprintf("less than %d events within %ds", rule.Count, rule.Window)))
+			}
+		case ALERT_SEQUENCE:
+			if group.firing && now-group.matched >= rule.Within {
+				alerts = append(alerts, group.transition(key, false, now,
+					fmt.Sprintf("no %s followed by %s within %ds", rule.First, rule.Then, rule.Within)))
+			}
+			if !group.firing && now-group.first > rule.Within {
+				delete(a.groups, key)
+			}
+		}
+	}
+
+	return alerts
+}
+
+// record appends an event reception time to the group
+// times, keeping at most size of the most recent ones.
+func (g *alertGroup) record(receivedOn int64, size int) {
+	g.times = append(g.times, receivedOn)
+	if len(g.times) > size {
+		g.times = append(g.times[:0], g.times[len(g.times)-size:]...)
+	}
+}
+
+// transition changes the group state, and returns the resulting alert.
+func (g *alertGroup) transition(key alertGroupKey, firing bool, now int64, reason string) *Alert {
+	g.firing = firing
+
+	return &Alert{
+		Rule:   key.rule,
+		From:   key.from,
+		Type:   key.eventType,
+		Firing: firing,
+		Reason: reason,
+		On:     now,
+	}
+}
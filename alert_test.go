@@ -0,0 +1,35 @@
+package happening
+
+import (
+	"testing"
+)
+
+func TestAlertServiceRecordsDroppedLiveEvents(t *testing.T) {
+	rules, err := ParseAlertRules("hot:rate_above:type=temperature,count=2,window=60")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := NewEventsHandler()
+	// No live listener keeps up, every published event is dropped
+	handler.EventsChannel = make(chan *Event)
+	handler.Alerts = NewAlertService(handler, rules)
+
+	frames, err := ExtractFrames(PipeCodec{}, []byte(
+		"kitchen|1392821124|temperature\r\nkitchen|1392821125|temperature\r\nkitchen|1392821126|temperature\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.PushEventsToQueue(PipeCodec{}, frames, &EventsSource{})
+
+	var alerts []*Event
+	for _, node := range handler.Queue.PopN(handler.Queue.Len()) {
+		if event := node.(*Event); event.Type == ALERT_EVENT_TYPE {
+			alerts = append(alerts, event)
+		}
+	}
+
+	if len(alerts) != 1 || alerts[0].Value == nil || alerts[0].Value.Text != ALERT_FIRING {
+		t.Errorf("alert events = %v, want the hot alert firing", alerts)
+	}
+}
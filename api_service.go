@@ -0,0 +1,534 @@
+package happening
+
+import (
+	"encoding/json"
+	"fmt"
+	l4g "github.com/alecthomas/log4go"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ApiService is built on the Service structure and exposes
+// the stored events through a RESTful http API:
+//
+//	GET    /events        lists events, filtered by the from, type,
+//	                      since, until, value_min, value_max and
+//	                      attr.<key> query parameters, and by the q
+//	                      query expression, paginated using the limit
+//	                      and cursor parameters.
+//	DELETE /events        deletes the events matching the same filters.
+//	GET    /events/{id}   fetches a single event.
+//	DELETE /events/{id}   deletes a single event.
+//	GET    /rollups       lists the rollups of the events of a type
+//	                      sent by a source, selected by the resolution,
+//	                      from and type parameters, between the since
+//	                      and until parameters, up to limit.
+//	GET    /aggregate     aggregates the events matching the events
+//	                      filters by time buckets of bucket seconds,
+//	                      or minute, hour or day, and by the comma
+//	                      separated group_by fields, from and type.
+//	                      The comma separated percentiles parameter
+//	                      selects the reported latency percentiles.
+//	GET    /nodes         lists the nodes events were received from.
+//	GET    /nodes/{name}  fetches a single node.
+//	GET    /stream        tails live events using Server-Sent Events.
+//	GET    /stream/ws     tails live events over a WebSocket.
+//
+// Live streams can be filtered using the same parameters as events.
+type ApiService struct {
+	Service
+	Socket *net.TCPListener
+	Store  *EventStore
+	Hub    *SubscriptionHub
+	Nodes  *NodeRegistry
+	mux    *http.ServeMux
+}
+
+// eventResponse is the json representation of an Event
+// returned by the ApiService.
+type eventResponse struct {
+	Id string `json:"id"`
+	*Event
+}
+
+// eventsPageResponse is the json representation of a
+// page of events returned by the ApiService.
+type eventsPageResponse struct {
+	Events []eventResponse `json:"events"`
+	Cursor string          `json:"cursor,omitempty"`
+}
+
+// rollupResponse is the json representation of a
+// Rollup returned by the ApiService.
+type rollupResponse struct {
+	Bucket      int64    `json:"bucket"`
+	Count       uint64   `json:"count"`
+	FirstSentOn int64    `json:"first_sent_on"`
+	LastSentOn  int64    `json:"last_sent_on"`
+	MeanDelay   float64  `json:"mean_delay"`
+	ValueCount  uint64   `json:"value_count"`
+	ValueMin    *float64 `json:"value_min,omitempty"`
+	ValueMax    *float64 `json:"value_max,omitempty"`
+	ValueMean   *float64 `json:"value_mean,omitempty"`
+}
+
+func newRollupResponse(rollup *Rollup) rollupResponse {
+	response := rollupResponse{
+		Bucket:      rollup.Bucket,
+		Count:       rollup.Count,
+		FirstSentOn: rollup.FirstSentOn,
+		LastSentOn:  rollup.LastSentOn,
+		MeanDelay:   rollup.MeanDelay(),
+		ValueCount:  rollup.ValueCount,
+	}
+
+	if rollup.ValueCount > 0 {
+		mean := rollup.ValueMean()
+		response.ValueMin = &rollup.ValueMin
+		response.ValueMax = &rollup.ValueMax
+		response.ValueMean = &mean
+	}
+
+	return response
+}
+
+// latencyResponse is the json representation of a
+// LatencyHistogram returned by the ApiService.
+type latencyResponse struct {
+	Min         int64            `json:"min"`
+	Max         int64            `json:"max"`
+	Mean        float64          `json:"mean"`
+	Percentiles map[string]int64 `json:"percentiles"`
+}
+
+// aggregateResponse is the json representation of an
+// Aggregate returned by the ApiService.
+type aggregateResponse struct {
+	Bucket  *int64          `json:"bucket,omitempty"`
+	From    string          `json:"from,omitempty"`
+	Type    string          `json:"type,omitempty"`
+	Rate    float64         `json:"rate"`
+	Latency latencyResponse `json:"latency"`
+	rollupResponse
+}
+
+func newAggregateResponse(aggregate *Aggregate, percentiles []float64) aggregateResponse {
+	response := aggregateResponse{
+		From: aggregate.From,
+		Type: aggregate.Type,
+		Rate: aggregate.Rate(),
+		Latency: latencyResponse{
+			Min:         aggregate.Latency.Min,
+			Max:         aggregate.Latency.Max,
+			Mean:        aggregate.Latency.Mean(),
+			Percentiles: make(map[string]int64, len(percentiles)),
+		},
+		rollupResponse: newRollupResponse(&aggregate.Rollup),
+	}
+
+	if aggregate.Duration > 0 {
+		response.Bucket = &aggregate.Bucket
+	}
+
+	for _, percentile := range percentiles {
+		name := "p" + strconv.FormatFloat(percentile, 'f', -1, 64)
+		response.Latency.Percentiles[name] = aggregate.Latency.Percentile(percentile)
+	}
+
+	return response
+}
+
+func newEventResponse(event *Event) eventResponse {
+	id, _ := EventId(event)
+	return eventResponse{Id: id, Event: event}
+}
+
+// NewApiService builds a new ApiService exposing the store events,
+// and the hub live events if not nil. Please use the Start method to
+// bind it's socket and serve requests.
+func NewApiService(store *EventStore, hub *SubscriptionHub) *ApiService {
+	api := &ApiService{
+		Service: *NewService("ApiService"),
+		Store:   store,
+		Hub:     hub,
+		mux:     http.NewServeMux(),
+	}
+
+	api.mux.HandleFunc(API_EVENTS_PATH, api.handleEvents)
+	api.mux.HandleFunc(API_EVENTS_PATH+"/", api.handleEvent)
+	api.mux.HandleFunc(API_ROLLUPS_PATH, api.handleRollups)
+	api.mux.HandleFunc(API_AGGREGATE_PATH, api.handleAggregate)
+	api.mux.HandleFunc(API_NODES_PATH, api.handleNodes)
+	api.mux.HandleFunc(API_NODES_PATH+"/", api.handleNodes)
+	api.mux.HandleFunc(API_STREAM_PATH, api.handleStream)
+	api.mux.HandleFunc(API_WS_STREAM_PATH, api.handleWebsocketStream)
+
+	return api
+}
+
+// Start binds the ApiService socket on host and port, and
+// serves http requests in background.
+func (api *ApiService) Start(host string, port string) error {
+	socket, err := BuildTcpListener("tcp", host, port)
+	if err != nil {
+		return err
+	}
+	api.Socket = socket
+
+	go api.Serve()
+
+	return nil
+}
+
+// Serve should be run as a long-running goroutine. It serves
+// http requests on the ApiService socket until it is stopped.
+func (api *ApiService) Serve() {
+	defer api.waitGroup.Done()
+	l4g.Info(fmt.Sprintf("[%s.Serve] Http API listening on %s", api.name, api.Socket.Addr()))
+
+	err := http.Serve(api.Socket, api.mux)
+	select {
+	case <-api.ch:
+	default:
+		l4g.Error(fmt.Sprintf("[%s.Serve] %s", api.name, err))
+	}
+}
+
+// Stop the ApiService by closing the service's channel and socket.
+// Blocks until the service is really stopped.
+func (api *ApiService) Stop() {
+	close(api.ch)
+	api.Socket.Close()
+	api.waitGroup.Wait()
+}
+
+// handleEvents serves the events collection endpoint.
+func (api *ApiService) handleEvents(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseEventFilter(r)
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		limit, err := parseIntParam(r, "limit", API_DEFAULT_PAGE_SIZE)
+		if err != nil || limit <= 0 || limit > API_MAX_PAGE_SIZE {
+			writeJsonError(w, http.StatusBadRequest,
+				fmt.Errorf("limit should be an integer between 1 and %d", API_MAX_PAGE_SIZE))
+			return
+		}
+
+		events, cursor, err := api.Store.Find(r.Context(), filter, r.FormValue("cursor"), int(limit))
+		if err != nil {
+			api.writeStoreError(w, err)
+			return
+		}
+
+		page := eventsPageResponse{
+			Events: make([]eventResponse, 0, len(events)),
+			Cursor: cursor,
+		}
+		for _, event := range events {
+			page.Events = append(page.Events, newEventResponse(event))
+		}
+
+		writeJson(w, http.StatusOK, page)
+	case "DELETE":
+		if filter.IsEmpty() {
+			writeJsonError(w, http.StatusBadRequest,
+				fmt.Errorf("refusing to delete every event, please provide at least one filter"))
+			return
+		}
+
+		count, err := api.Store.DeleteMatching(r.Context(), filter)
+		if err != nil {
+			api.writeStoreError(w, err)
+			return
+		}
+
+		writeJson(w, http.StatusOK, map[string]int{"deleted": count})
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		writeJsonError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+// handleEvent serves the single event endpoint.
+func (api *ApiService) handleEvent(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, API_EVENTS_PATH+"/")
+	if id == "" || strings.Contains(id, "/") {
+		writeJsonError(w, http.StatusNotFound, ErrInvalidEventId)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		event, err := api.Store.Get(r.Context(), id)
+		if err != nil {
+			api.writeStoreError(w, err)
+			return
+		}
+
+		writeJson(w, http.StatusOK, eventResponse{Id: id, Event: event})
+	case "DELETE":
+		if err := api.Store.Delete(r.Context(), id); err != nil {
+			api.writeStoreError(w, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		writeJsonError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+	}
+}
+
+// handleRollups serves the rollups collection endpoint.
+func (api *ApiService) handleRollups(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		writeJsonError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	resolution, from, eventType := r.FormValue("resolution"), r.FormValue("from"), r.FormValue("type")
+	if resolution == "" || from == "" || eventType == "" {
+		writeJsonError(w, http.StatusBadRequest, fmt.Errorf("resolution, from and type are required"))
+		return
+	}
+
+	since, err := parseIntParam(r, "since", math.MinInt64)
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	until, err := parseIntParam(r, "until", math.MaxInt64)
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	limit, err := parseIntParam(r, "limit", API_DEFAULT_PAGE_SIZE)
+	if err != nil || limit <= 0 || limit > API_MAX_PAGE_SIZE {
+		writeJsonError(w, http.StatusBadRequest,
+			fmt.Errorf("limit should be an integer between 1 and %d", API_MAX_PAGE_SIZE))
+		return
+	}
+
+	rollups, err := api.Store.Rollups(r.Context(), resolution, from, eventType, since, until, int(limit))
+	if err != nil {
+		api.writeStoreError(w, err)
+		return
+	}
+
+	response := make([]rollupResponse, 0, len(rollups))
+	for _, rollup := range rollups {
+		response = append(response, newRollupResponse(rollup))
+	}
+
+	writeJson(w, http.StatusOK, map[string][]rollupResponse{"rollups": response})
+}
+
+// handleAggregate serves the aggregation endpoint.
+func (api *ApiService) handleAggregate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		writeJsonError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	filter, err := parseEventFilter(r)
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	bucket, ok := rollupResolutions[r.FormValue("bucket")]
+	if !ok {
+		if bucket, err = parseIntParam(r, "bucket", 0); err != nil || bucket < 0 {
+			writeJsonError(w, http.StatusBadRequest,
+				fmt.Errorf("bucket should be a positive integer, minute, hour or day"))
+			return
+		}
+	}
+
+	var groupBy []string
+	if param := r.FormValue("group_by"); param != "" {
+		groupBy = strings.Split(param, ",")
+	}
+
+	query, err := NewAggregateQuery(filter, bucket, groupBy)
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	percentiles, err := parsePercentilesParam(r, "percentiles", AGGREGATE_PERCENTILES)
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	aggregates, err := api.Store.Aggregate(r.Context(), query)
+	if err != nil {
+		api.writeStoreError(w, err)
+		return
+	}
+
+	response := make([]aggregateResponse, 0, len(aggregates))
+	for _, aggregate := range aggregates {
+		response = append(response, newAggregateResponse(aggregate, percentiles))
+	}
+
+	writeJson(w, http.StatusOK, map[string][]aggregateResponse{"aggregates": response})
+}
+
+// handleNodes serves the nodes collection and single node endpoints.
+func (api *ApiService) handleNodes(w http.ResponseWriter, r *http.Request) {
+	if api.Nodes == nil {
+		writeJsonError(w, http.StatusServiceUnavailable, fmt.Errorf("nodes registry is disabled"))
+		return
+	}
+
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		writeJsonError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return
+	}
+
+	if r.URL.Path == API_NODES_PATH || r.URL.Path == API_NODES_PATH+"/" {
+		writeJson(w, http.StatusOK, map[string][]*Node{"nodes": api.Nodes.Nodes()})
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, API_NODES_PATH+"/")
+	node, ok := api.Nodes.Node(name)
+	if !ok {
+		writeJsonError(w, http.StatusNotFound, fmt.Errorf("unknown node %q", name))
+		return
+	}
+
+	writeJson(w, http.StatusOK, node)
+}
+
+// writeStoreError maps an EventStore error to an http error response.
+func (api *ApiService) writeStoreError(w http.ResponseWriter, err error) {
+	switch err {
+	case ErrKeyNotFound, ErrInvalidEventId:
+		writeJsonError(w, http.StatusNotFound, err)
+	case ErrInvalidCursor, ErrUnknownResolution, ErrTooManyGroups:
+		writeJsonError(w, http.StatusBadRequest, err)
+	default:
+		l4g.Error(fmt.Sprintf("[%s] %s", api.name, err))
+		writeJsonError(w, http.StatusInternalServerError, err)
+	}
+}
+
+// parseEventFilter builds an EventFilter from the from, type, since,
+// until, value_min, value_max and attr.<key> request parameters, and
+// from the q parameter query expression.
+func parseEventFilter(r *http.Request) (*EventFilter, error) {
+	var err error
+
+	filter := NewEventFilter()
+	filter.From = r.FormValue("from")
+	filter.Type = r.FormValue("type")
+
+	if filter.Since, err = parseIntParam(r, "since", filter.Since); err != nil {
+		return nil, err
+	}
+
+	if filter.Until, err = parseIntParam(r, "until", filter.Until); err != nil {
+		return nil, err
+	}
+
+	if filter.ValueMin, err = parseFloatParam(r, "value_min", filter.ValueMin); err != nil {
+		return nil, err
+	}
+
+	if filter.ValueMax, err = parseFloatParam(r, "value_max", filter.ValueMax); err != nil {
+		return nil, err
+	}
+
+	for param, values := range r.Form {
+		if strings.HasPrefix(param, API_ATTRIBUTE_PARAM_PREFIX) && len(values) > 0 {
+			if filter.Attributes == nil {
+				filter.Attributes = make(map[string]string)
+			}
+			filter.Attributes[strings.TrimPrefix(param, API_ATTRIBUTE_PARAM_PREFIX)] = values[0]
+		}
+	}
+
+	if param := r.FormValue("q"); param != "" {
+		if filter.Query, err = ParseQuery(param, time.Now().Unix()); err != nil {
+			return nil, err
+		}
+		filter.Query.Narrow(filter)
+	}
+
+	return filter, nil
+}
+
+func parseIntParam(r *http.Request, name string, fallback int64) (int64, error) {
+	param := r.FormValue(name)
+	if param == "" {
+		return fallback, nil
+	}
+
+	value, err := strconv.ParseInt(param, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%s should be an integer", name)
+	}
+
+	return value, nil
+}
+
+func parseFloatParam(r *http.Request, name string, fallback float64) (float64, error) {
+	param := r.FormValue(name)
+	if param == "" {
+		return fallback, nil
+	}
+
+	// NaN bounds would make every comparison fail, and
+	// so every value fall within the range they bound.
+	value, err := strconv.ParseFloat(param, 64)
+	if err != nil || math.IsNaN(value) {
+		return 0, fmt.Errorf("%s should be a number", name)
+	}
+
+	return value, nil
+}
+
+func parsePercentilesParam(r *http.Request, name string, fallback string) ([]float64, error) {
+	param := r.FormValue(name)
+	if param == "" {
+		param = fallback
+	}
+
+	var percentiles []float64
+	for _, field := range strings.Split(param, ",") {
+		percentile, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+		if err != nil || percentile <= 0 || percentile > 100 {
+			return nil, fmt.Errorf("%s should be comma separated numbers between 0 and 100", name)
+		}
+		percentiles = append(percentiles, percentile)
+	}
+
+	return percentiles, nil
+}
+
+func writeJson(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeJsonError(w http.ResponseWriter, status int, err error) {
+	writeJson(w, status, map[string]string{"error": err.Error()})
+}
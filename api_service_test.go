@@ -0,0 +1,248 @@
+package happening
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"testing"
+)
+
+// newTestApiService returns an ApiService exposing a memory
+// backend holding the following events:
+//
+//	kitchen|100|temperature|21.5|unit=celsius
+//	kitchen|200|temperature|19|unit=fahrenheit
+//	kitchen|300|humidity|40
+//	cellar|400|temperature|12|unit=celsius
+//	cellar|500|door|open
+func newTestApiService(t *testing.T) *ApiService {
+	t.Helper()
+
+	backend, err := NewMemoryBackend(0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { backend.Close() })
+
+	for _, raw := range []string{
+		"kitchen|100|temperature|21.5|unit=celsius",
+		"kitchen|200|temperature|19|unit=fahrenheit",
+		"kitchen|300|humidity|40",
+		"cellar|400|temperature|12|unit=celsius",
+		"cellar|500|door|open",
+	} {
+		event, err := NewEventFromRaw(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		pairs, err := eventKvPairs(event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := backend.MPut(context.Background(), pairs); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return NewApiService(NewEventStore(backend), nil)
+}
+
+// testEventsPage is the decoded json representation of
+// a page of events returned by the ApiService.
+type testEventsPage struct {
+	Events []struct {
+		Id     string      `json:"id"`
+		SentOn int64       `json:"sent_on"`
+		Value  interface{} `json:"value"`
+	} `json:"events"`
+	Cursor string `json:"cursor"`
+}
+
+// serveApi serves a request to api, and decodes the json
+// response body into body, unless nil.
+func serveApi(t *testing.T, api *ApiService, method string, target string, body interface{}) int {
+	t.Helper()
+
+	recorder := httptest.NewRecorder()
+	api.mux.ServeHTTP(recorder, httptest.NewRequest(method, target, nil))
+
+	if body != nil && recorder.Code < http.StatusBadRequest {
+		if err := json.Unmarshal(recorder.Body.Bytes(), body); err != nil {
+			t.Fatalf("%s %s: %s", method, target, err)
+		}
+	}
+
+	return recorder.Code
+}
+
+// findEvents returns the timestamps of the events listed by a
+// GET /events request with params, in order.
+func findEvents(t *testing.T, api *ApiService, params string) ([]int64, string, int) {
+	t.Helper()
+
+	var page testEventsPage
+	status := serveApi(t, api, "GET", API_EVENTS_PATH+"?"+params, &page)
+
+	var sentOn []int64
+	for _, event := range page.Events {
+		sentOn = append(sentOn, event.SentOn)
+	}
+
+	return sentOn, page.Cursor, status
+}
+
+func TestApiFindEvents(t *testing.T) {
+	api := newTestApiService(t)
+
+	tests := []struct {
+		params string
+		status int
+		want   []int64
+	}{
+		{"", http.StatusOK, []int64{100, 200, 300, 400, 500}},
+		{"from=kitchen", http.StatusOK, []int64{100, 200, 300}},
+		{"type=temperature", http.StatusOK, []int64{100, 200, 400}},
+		{"from=kitchen&type=temperature", http.StatusOK, []int64{100, 200}},
+		{"from=attic", http.StatusOK, nil},
+		{"since=200&until=400", http.StatusOK, []int64{200, 300}},
+		{"from=cellar&since=450", http.StatusOK, []int64{500}},
+		{"value_min=20", http.StatusOK, []int64{100, 300}},
+		{"value_max=20", http.StatusOK, []int64{200, 400}},
+		{"value_min=15&value_max=25", http.StatusOK, []int64{100, 200}},
+		{"value_min=-Inf&value_max=Inf", http.StatusOK, []int64{100, 200, 300, 400, 500}},
+		{"attr.unit=celsius", http.StatusOK, []int64{100, 400}},
+		{"type=temperature&attr.unit=fahrenheit", http.StatusOK, []int64{200}},
+		{"q=" + url.QueryEscape("value > 20 and type = 'temperature'"), http.StatusOK, []int64{100}},
+		{"q=" + url.QueryEscape("from = 'cellar' or type = 'humidity'"), http.StatusOK, []int64{300, 400, 500}},
+		{"value_min=NaN", http.StatusBadRequest, nil},
+		{"value_max=nan", http.StatusBadRequest, nil},
+		{"value_min=warm", http.StatusBadRequest, nil},
+		{"since=yesterday", http.StatusBadRequest, nil},
+		{"q=" + url.QueryEscape("value >"), http.StatusBadRequest, nil},
+		{"limit=0", http.StatusBadRequest, nil},
+		{"limit=1001", http.StatusBadRequest, nil},
+		{"cursor=%21%21", http.StatusBadRequest, nil},
+	}
+
+	for _, test := range tests {
+		sentOn, _, status := findEvents(t, api, test.params)
+		sort.Slice(sentOn, func(i, j int) bool { return sentOn[i] < sentOn[j] })
+
+		if status != test.status || !equalAges(sentOn, test.want) {
+			t.Errorf("GET /events?%s = %d %v, want %d %v", test.params, status, sentOn, test.status, test.want)
+		}
+	}
+}
+
+func TestApiFindEventsPagination(t *testing.T) {
+	api := newTestApiService(t)
+
+	tests := []struct {
+		params string
+		pages  int
+		want   []int64
+	}{
+		{"limit=2", 3, []int64{100, 200, 300, 400, 500}},
+		{"limit=5", 1, []int64{100, 200, 300, 400, 500}},
+		{"limit=1&type=temperature", 3, []int64{100, 200, 400}},
+		{"limit=1&from=kitchen&since=150", 2, []int64{200, 300}},
+		{"limit=2&attr.unit=celsius", 1, []int64{100, 400}},
+	}
+
+	for _, test := range tests {
+		var all []int64
+		var pages int
+
+		cursor := ""
+		for {
+			sentOn, next, status := findEvents(t, api, test.params+"&cursor="+cursor)
+			if status != http.StatusOK {
+				t.Fatalf("GET /events?%s&cursor=%s = %d", test.params, cursor, status)
+			}
+			all = append(all, sentOn...)
+			pages++
+
+			if next == "" {
+				break
+			}
+			if pages > len(test.want) {
+				t.Fatalf("GET /events?%s never ends", test.params)
+			}
+			cursor = next
+		}
+
+		sort.Slice(all, func(i, j int) bool { return all[i] < all[j] })
+		if pages != test.pages || !equalAges(all, test.want) {
+			t.Errorf("GET /events?%s = %v over %d pages, want %v over %d", test.params, all, pages, test.want, test.pages)
+		}
+	}
+}
+
+func TestApiDeleteEvents(t *testing.T) {
+	api := newTestApiService(t)
+
+	// Deleting every event requires an explicit filter
+	for _, params := range []string{"", "?cursor=abc", "?limit=10"} {
+		if status := serveApi(t, api, "DELETE", API_EVENTS_PATH+params, nil); status != http.StatusBadRequest {
+			t.Errorf("DELETE /events%s = %d, want %d", params, status, http.StatusBadRequest)
+		}
+	}
+	if status := serveApi(t, api, "DELETE", API_EVENTS_PATH+"?value_min=NaN", nil); status != http.StatusBadRequest {
+		t.Errorf("DELETE /events?value_min=NaN = %d, want %d", status, http.StatusBadRequest)
+	}
+	if sentOn, _, _ := findEvents(t, api, ""); len(sentOn) != 5 {
+		t.Fatalf("%d events left after refused deletions, want 5", len(sentOn))
+	}
+
+	var deleted map[string]int
+	if status := serveApi(t, api, "DELETE", API_EVENTS_PATH+"?type=temperature&attr.unit=celsius", &deleted); status != http.StatusOK || deleted["deleted"] != 2 {
+		t.Errorf("DELETE /events?type=temperature&attr.unit=celsius = %d %v, want 200, 2 deleted", status, deleted)
+	}
+	sentOn, _, _ := findEvents(t, api, "")
+	sort.Slice(sentOn, func(i, j int) bool { return sentOn[i] < sentOn[j] })
+	if !equalAges(sentOn, []int64{200, 300, 500}) {
+		t.Errorf("events left = %v, want [200 300 500]", sentOn)
+	}
+	if sentOn, _, _ := findEvents(t, api, "type=temperature"); !equalAges(sentOn, []int64{200}) {
+		t.Errorf("temperature events left = %v, want [200]", sentOn)
+	}
+
+	// Single events are deleted by id
+	var page testEventsPage
+	serveApi(t, api, "GET", API_EVENTS_PATH+"?type=door", &page)
+	if len(page.Events) != 1 {
+		t.Fatalf("%d door events, want 1", len(page.Events))
+	}
+	target := API_EVENTS_PATH + "/" + page.Events[0].Id
+
+	var event map[string]interface{}
+	if status := serveApi(t, api, "GET", target, &event); status != http.StatusOK || event["value"] != "open" {
+		t.Errorf("GET %s = %d %v, want the door event", target, status, event)
+	}
+	if status := serveApi(t, api, "DELETE", target, nil); status != http.StatusNoContent {
+		t.Errorf("DELETE %s = %d, want %d", target, status, http.StatusNoContent)
+	}
+	if status := serveApi(t, api, "GET", target, nil); status != http.StatusNotFound {
+		t.Errorf("GET %s once deleted = %d, want %d", target, status, http.StatusNotFound)
+	}
+	if status := serveApi(t, api, "GET", API_EVENTS_PATH+"/unknown", nil); status != http.StatusNotFound {
+		t.Errorf("GET an unknown event = %d, want %d", status, http.StatusNotFound)
+	}
+}
+
+// equalAges returns whether two lists of ages, or timestamps, are equal.
+func equalAges(a []int64, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for index := range a {
+		if a[index] != b[index] {
+			return false
+		}
+	}
+	return true
+}
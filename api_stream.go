@@ -0,0 +1,146 @@
+package happening
+
+import (
+	"encoding/json"
+	"fmt"
+	l4g "github.com/alecthomas/log4go"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"time"
+)
+
+var websocketUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: EVENTS_FLOW_BUF_SIZE,
+}
+
+// subscribe registers a subscription on the ApiService hub matching
+// the request filtering parameters.
+func (api *ApiService) subscribe(w http.ResponseWriter, r *http.Request) *Subscription {
+	if api.Hub == nil {
+		writeJsonError(w, http.StatusServiceUnavailable, fmt.Errorf("live events streaming is disabled"))
+		return nil
+	}
+
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		writeJsonError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+		return nil
+	}
+
+	filter, err := parseEventFilter(r)
+	if err != nil {
+		writeJsonError(w, http.StatusBadRequest, err)
+		return nil
+	}
+
+	return api.Hub.Subscribe(filter, SUBSCRIBER_BUFFER_SIZE)
+}
+
+// handleStream tails the live events stream using Server-Sent Events.
+func (api *ApiService) handleStream(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeJsonError(w, http.StatusInternalServerError, fmt.Errorf("streaming unsupported"))
+		return
+	}
+
+	subscription := api.subscribe(w, r)
+	if subscription == nil {
+		return
+	}
+	defer api.Hub.Unsubscribe(subscription)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	heartbeat := time.NewTicker(time.Duration(STREAM_HEARTBEAT_INTERVAL) * time.Second)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+				return
+			}
+		case event, ok := <-subscription.Events:
+			if !ok {
+				return
+			}
+
+			data, err := json.Marshal(newEventResponse(event))
+			if err != nil {
+				l4g.Error(fmt.Sprintf("[%s.handleStream] %s", api.name, err))
+				continue
+			}
+
+			if _, err := fmt.Fprintf(w, "event: event\ndata: %s\n\n", data); err != nil {
+				return
+			}
+		}
+
+		flusher.Flush()
+	}
+}
+
+// handleWebsocketStream tails the live events stream over a WebSocket,
+// sending each event as a json text message.
+func (api *ApiService) handleWebsocketStream(w http.ResponseWriter, r *http.Request) {
+	subscription := api.subscribe(w, r)
+	if subscription == nil {
+		return
+	}
+	defer api.Hub.Unsubscribe(subscription)
+
+	conn, err := websocketUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		l4g.Error(fmt.Sprintf("[%s.handleWebsocketStream] %s", api.name, err))
+		return
+	}
+	defer conn.Close()
+
+	// Consume incoming messages, so control frames are handled,
+	// until the client goes away.
+	closed := make(chan bool)
+	go func() {
+		defer close(closed)
+		for {
+			if _, _, err := conn.NextReader(); err != nil {
+				return
+			}
+		}
+	}()
+
+	heartbeat := time.NewTicker(time.Duration(STREAM_HEARTBEAT_INTERVAL) * time.Second)
+	defer heartbeat.Stop()
+
+	for {
+		var err error
+
+		select {
+		case <-closed:
+			return
+		case <-heartbeat.C:
+			deadline := time.Now().Add(time.Duration(STREAM_WRITE_TIMEOUT) * time.Second)
+			err = conn.WriteControl(websocket.PingMessage, nil, deadline)
+		case event, ok := <-subscription.Events:
+			if !ok {
+				conn.WriteMessage(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "subscriber too slow"))
+				return
+			}
+
+			conn.SetWriteDeadline(time.Now().Add(time.Duration(STREAM_WRITE_TIMEOUT) * time.Second))
+			err = conn.WriteJSON(newEventResponse(event))
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package happening
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// newTestStreamServer returns an http test server exposing the
+// live events of a started hub, fed through the returned channel.
+func newTestStreamServer(t *testing.T) (*httptest.Server, *SubscriptionHub, chan *Event) {
+	t.Helper()
+
+	source := make(chan *Event)
+	hub := NewSubscriptionHub(source)
+	hub.Start()
+
+	api := NewApiService(nil, hub)
+	server := httptest.NewServer(api.mux)
+	t.Cleanup(server.Close)
+
+	return server, hub, source
+}
+
+// subscriptionsCount returns the number of subscriptions of a hub.
+func subscriptionsCount(hub *SubscriptionHub) int {
+	hub.mu.Lock()
+	defer hub.mu.Unlock()
+
+	return len(hub.subscriptions)
+}
+
+// awaitSubscriptions waits for a hub to hold count subscriptions.
+func awaitSubscriptions(t *testing.T, hub *SubscriptionHub, count int) {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for subscriptionsCount(hub) != count {
+		if time.Now().After(deadline) {
+			t.Fatalf("hub holds %d subscriptions, want %d", subscriptionsCount(hub), count)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestApiStream(t *testing.T) {
+	server, hub, source := newTestStreamServer(t)
+
+	response, err := http.Get(server.URL + API_STREAM_PATH + "?type=temperature&attr.unit=celsius")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK || response.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("stream response = %d %q, want 200 text/event-stream", response.StatusCode, response.Header.Get("Content-Type"))
+	}
+
+	matching := NewEvent("kitchen", 1392821124, 1392821124, "temperature")
+	matching.Attributes = map[string]string{"unit": "celsius"}
+	fahrenheit := NewEvent("kitchen", 1392821124, 1392821124, "temperature")
+	fahrenheit.Attributes = map[string]string{"unit": "fahrenheit"}
+
+	source <- NewEvent("kitchen", 1392821124, 1392821124, "humidity")
+	source <- fahrenheit
+	source <- matching
+
+	reader := bufio.NewReader(response.Body)
+	var lines []string
+	for len(lines) < 3 {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading stream: %s", err)
+		}
+		lines = append(lines, strings.TrimSuffix(line, "\n"))
+	}
+
+	if lines[0] != "event: event" || !strings.HasPrefix(lines[1], "data: ") || lines[2] != "" {
+		t.Fatalf("stream message = %q, want an event", lines)
+	}
+
+	var received eventResponse
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(lines[1], "data: ")), &received); err != nil {
+		t.Fatal(err)
+	}
+	if id, _ := EventId(matching); received.Id != id || received.Attributes["unit"] != "celsius" {
+		t.Errorf("streamed event %s %v, want %s", received.Id, received.Event, id)
+	}
+
+	// Stopping the hub ends the stream
+	hub.Stop()
+	if _, err := reader.ReadString('\n'); err == nil {
+		t.Errorf("stream still open once the hub stopped")
+	}
+}
+
+func TestApiStreamUnsubscribes(t *testing.T) {
+	server, hub, _ := newTestStreamServer(t)
+	defer hub.Stop()
+
+	response, err := http.Get(server.URL + API_STREAM_PATH)
+	if err != nil {
+		t.Fatal(err)
+	}
+	awaitSubscriptions(t, hub, 1)
+
+	// Clients going away are unsubscribed
+	response.Body.Close()
+	awaitSubscriptions(t, hub, 0)
+
+	response, err = http.Get(server.URL + API_STREAM_PATH + "?since=yesterday")
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusBadRequest {
+		t.Errorf("stream with an invalid filter answered %d, want %d", response.StatusCode, http.StatusBadRequest)
+	}
+
+	response, err = http.Post(server.URL+API_STREAM_PATH, "text/plain", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("POST stream answered %d, want %d", response.StatusCode, http.StatusMethodNotAllowed)
+	}
+
+	if count := subscriptionsCount(hub); count != 0 {
+		t.Errorf("refused streams left %d subscriptions", count)
+	}
+}
+
+func TestApiWebsocketStream(t *testing.T) {
+	server, hub, source := newTestStreamServer(t)
+
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + API_WS_STREAM_PATH + "?from=kitchen"
+	conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	awaitSubscriptions(t, hub, 1)
+
+	source <- NewEvent("cellar", 1392821124, 1392821124, "temperature")
+	source <- NewEvent("kitchen", 1392821124, 1392821124, "temperature")
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	var received eventResponse
+	if err := conn.ReadJSON(&received); err != nil {
+		t.Fatal(err)
+	}
+	if received.From != "kitchen" {
+		t.Errorf("streamed event from %q, want kitchen", received.From)
+	}
+
+	// Stopping the hub closes the websocket
+	hub.Stop()
+	if _, _, err := conn.ReadMessage(); !websocket.IsCloseError(err, websocket.CloseTryAgainLater) {
+		t.Errorf("websocket read once the hub stopped = %v, want a close", err)
+	}
+}
@@ -0,0 +1,282 @@
+package happening
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Authentication errors
+var (
+	ErrInvalidAuthMode  = errors.New("invalid auth mode")
+	ErrMalformedKeyring = errors.New("malformed keyring")
+	ErrMalformedAuth    = errors.New("malformed auth handshake")
+	ErrUnknownNode      = errors.New("unknown node")
+	ErrInvalidToken     = errors.New("invalid node token")
+	ErrUnauthenticated  = errors.New("unauthenticated events source")
+	ErrMissingSignature = errors.New("missing event signature")
+	ErrInvalidSignature = errors.New("invalid event signature")
+	ErrReplayedEvent    = errors.New("replayed event")
+	ErrEventOutOfWindow = errors.New("event timestamp outside of the accepted window")
+	ErrIdentityMismatch = errors.New("node does not match the source certificate")
+)
+
+// Keyring holds the shared secret of each known node, by name.
+type Keyring map[string]string
+
+// LoadKeyring reads a keyring file, made of one node:secret
+// line per node. Blank lines and lines starting with # are
+// ignored.
+func LoadKeyring(path string) (Keyring, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	keyring := make(Keyring)
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		entry := strings.TrimSpace(scanner.Text())
+		if entry == "" || strings.HasPrefix(entry, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(entry, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("%s: %s line %d", ErrMalformedKeyring, path, line)
+		}
+		keyring[parts[0]] = parts[1]
+	}
+
+	return keyring, scanner.Err()
+}
+
+// Authenticator verifies events sources are known nodes, according
+// to it's Mode:
+//
+//   - AUTH_MODE_TOKEN: each connexion starts with an
+//     AUTH|<node>|<secret> frame, and the events it carries are
+//     then trusted to be sent by node
+//   - AUTH_MODE_HMAC: each event carries an AUTH_SIGNATURE_ATTRIBUTE
+//     attribute, the hex encoded HMAC-SHA256 of it's canonical
+//     representation, see SignEvent, without the signature, using
+//     the secret of the node it is sent by
+//
+// Either way, events sent more than MaxSkew seconds away from the
+// time they are received on are refused, and so are signed events
+// whose signature was already seen within this window, unless it
+// was forgotten as the event was not accepted after all.
+//
+// This replay protection has two limits. In AUTH_MODE_TOKEN, events
+// are not signed, so nothing tells a replayed event apart from a
+// new one: anyone able to capture and resend the events of an
+// authenticated connexion within MaxSkew has them accepted again,
+// unless the connexion is served over TLS. In AUTH_MODE_HMAC, two
+// legitimate events sharing their from, sent_on, type, value and
+// attributes, sent within the same second for example, have the
+// same signature, and the second one is refused as a replay: nodes
+// sending such events should tell them apart with an attribute, a
+// sequence number for example, which the signature covers.
+type Authenticator struct {
+	Mode    string
+	Keyring Keyring
+	MaxSkew int64
+
+	mu         sync.Mutex
+	signatures map[string]int64
+	pruned     int64
+}
+
+// NewAuthenticator builds an Authenticator verifying
+// events sources in mode, using keyring secrets.
+func NewAuthenticator(mode string, keyring Keyring, maxSkew int64) (*Authenticator, error) {
+	switch mode {
+	case AUTH_MODE_TOKEN, AUTH_MODE_HMAC:
+	default:
+		return nil, fmt.Errorf("%s: %q", ErrInvalidAuthMode, mode)
+	}
+
+	return &Authenticator{
+		Mode:       mode,
+		Keyring:    keyring,
+		MaxSkew:    maxSkew,
+		signatures: make(map[string]int64),
+	}, nil
+}
+
+// RequiresHandshake returns whether connexions should
+// start with an authentication handshake.
+func (a *Authenticator) RequiresHandshake() bool {
+	return a.Mode == AUTH_MODE_TOKEN
+}
+
+// Handshake verifies an AUTH|<node>|<secret> handshake frame, and
+// returns the authenticated node. A non empty identity, the trusted
+// identity of the connexion, must match the node.
+func (a *Authenticator) Handshake(frame []byte, identity string) (string, error) {
+	parts := strings.SplitN(strings.TrimSpace(string(frame)), string(EVENT_PARAMS_SEPARATOR), 3)
+	if len(parts) != 3 || parts[0] != AUTH_MSG {
+		return "", authError(ErrMalformedAuth)
+	}
+
+	node, token := parts[1], parts[2]
+	secret, ok := a.Keyring[node]
+	if !ok {
+		return "", authError(fmt.Errorf("%s: %q", ErrUnknownNode, node))
+	}
+
+	if subtle.ConstantTimeCompare([]byte(secret), []byte(token)) != 1 {
+		return "", authError(fmt.Errorf("%s for %q", ErrInvalidToken, node))
+	}
+
+	if identity != "" && identity != node {
+		return "", authError(fmt.Errorf("%s: %q", ErrIdentityMismatch, node))
+	}
+
+	return node, nil
+}
+
+// Verify checks an event received on now from an events source,
+// authenticated as node if not empty, may be accepted. A verified
+// event signature is removed from it's attributes, and remembered
+// until the event falls outside the accepted time window, or is
+// passed to Forget. See Authenticator for the limits of this
+// replay protection.
+func (a *Authenticator) Verify(event *Event, node string, now int64) error {
+	if event.SentOn < now-a.MaxSkew || event.SentOn > now+a.MaxSkew {
+		return authError(ErrEventOutOfWindow)
+	}
+
+	if a.Mode == AUTH_MODE_TOKEN {
+		if node == "" {
+			return authError(ErrUnauthenticated)
+		}
+		return nil
+	}
+
+	secret, ok := a.Keyring[event.From]
+	if !ok {
+		return authError(fmt.Errorf("%s: %q", ErrUnknownNode, event.From))
+	}
+
+	signature, ok := event.Attributes[AUTH_SIGNATURE_ATTRIBUTE]
+	if !ok {
+		return authError(ErrMissingSignature)
+	}
+	delete(event.Attributes, AUTH_SIGNATURE_ATTRIBUTE)
+
+	expected := SignEvent(event, secret)
+	if !hmac.Equal([]byte(expected), []byte(strings.ToLower(signature))) {
+		return authError(ErrInvalidSignature)
+	}
+
+	signature = event.From + string(EVENT_PARAMS_SEPARATOR) + expected
+	if err := a.remember(signature, event.SentOn, now); err != nil {
+		return err
+	}
+	event.signature = signature
+
+	return nil
+}
+
+// Forget forgets the signature of a verified event which was
+// refused afterwards, so that it's source may send it again.
+func (a *Authenticator) Forget(event *Event) {
+	if event.signature == "" {
+		return
+	}
+
+	a.mu.Lock()
+	delete(a.signatures, event.signature)
+	a.mu.Unlock()
+
+	event.signature = ""
+}
+
+// remember records a signature seen on an event sent on sentOn,
+// and fails if it was already seen. Signatures are forgotten once
+// their events fall outside the accepted time window.
+func (a *Authenticator) remember(signature string, sentOn int64, now int64) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if now-a.pruned > a.MaxSkew {
+		for seen, seenSentOn := range a.signatures {
+			if seenSentOn < now-a.MaxSkew {
+				delete(a.signatures, seen)
+			}
+		}
+		a.pruned = now
+	}
+
+	if _, ok := a.signatures[signature]; ok {
+		return authError(ErrReplayedEvent)
+	}
+	a.signatures[signature] = sentOn
+
+	return nil
+}
+
+// SignEvent returns the hex encoded HMAC-SHA256 signature
+// of an event canonical representation using secret.
+//
+// The canonical representation is made of the event from, sent_on,
+// type, value and attributes sorted by key, each written as it's
+// length in bytes, a colon, and itself, so that no two events share
+// it. The value is prefixed with n when numeric, formatted the
+// shortest way, and with t when textual, and is empty when the event
+// has none. kitchen|1392821124|temperature|21.5|unit=celsius is thus
+// represented as 7:kitchen10:139282112411:temperature5:n21.54:unit7:celsius.
+func SignEvent(event *Event, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(canonicalEvent(event))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// canonicalEvent returns the representation of an
+// event SignEvent computes signatures over.
+func canonicalEvent(event *Event) []byte {
+	var value string
+	if event.Value != nil {
+		if event.Value.Numeric {
+			value = "n" + event.Value.String()
+		} else {
+			value = "t" + event.Value.Text
+		}
+	}
+
+	fields := []string{event.From, strconv.FormatInt(event.SentOn, 10), event.Type, value}
+
+	keys := make([]string, 0, len(event.Attributes))
+	for key := range event.Attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fields = append(fields, key, event.Attributes[key])
+	}
+
+	var buf []byte
+	for _, field := range fields {
+		buf = strconv.AppendInt(buf, int64(len(field)), 10)
+		buf = append(buf, ':')
+		buf = append(buf, field...)
+	}
+
+	return buf
+}
+
+func authError(err error) error {
+	return &EventError{Code: NACK_AUTH_FAILED, Message: err.Error()}
+}
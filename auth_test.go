@@ -0,0 +1,172 @@
+package happening
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signedFrame returns the pipe frame of an event, signed using secret.
+func signedFrame(t *testing.T, event *Event, secret string) []byte {
+	t.Helper()
+
+	frame := fmt.Sprintf("%s|%s=%s\r\n", event, AUTH_SIGNATURE_ATTRIBUTE, SignEvent(event, secret))
+	frames, err := ExtractFrames(PipeCodec{}, []byte(frame))
+	if err != nil || len(frames) != 1 {
+		t.Fatalf("ExtractFrames = %d frames, %v", len(frames), err)
+	}
+
+	return frames[0]
+}
+
+func TestAuthenticatorRetryAfterRefusal(t *testing.T) {
+	auth, err := NewAuthenticator(AUTH_MODE_HMAC, Keyring{"kitchen": "secret"}, DEFAULT_AUTH_MAX_SKEW)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := NewEventsHandler()
+	handler.Auth = auth
+	if handler.Queue, err = NewBoundedQueue(1, 1, QUEUE_POLICY_REJECT); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now().Unix()
+	first := NewEvent("kitchen", now, now, "temperature")
+	first.Value = NewNumericValue(21.5)
+	retried := NewEvent("kitchen", now, now, "temperature")
+	retried.Value = NewNumericValue(22)
+	frames := [][]byte{signedFrame(t, first, "secret"), signedFrame(t, retried, "secret")}
+
+	push := func(frame []byte) error {
+		_, errs := handler.PushEventsToQueue(PipeCodec{}, [][]byte{frame}, &EventsSource{})
+		return errs[0]
+	}
+
+	if err := push(frames[0]); err != nil {
+		t.Fatalf("first event refused: %s", err)
+	}
+	if err, ok := push(frames[1]).(*EventError); !ok || err.Code != NACK_QUEUE_FULL {
+		t.Fatalf("event pushed to a full queue error = %v, want a %d NACK", err, NACK_QUEUE_FULL)
+	}
+
+	handler.Queue.Pop()
+	if err := push(frames[1]); err != nil {
+		t.Errorf("event sent again after a queue full NACK refused: %s", err)
+	}
+	if err, ok := push(frames[1]).(*EventError); !ok || err.Code != NACK_AUTH_FAILED {
+		t.Errorf("replayed accepted event error = %v, want a %d NACK", err, NACK_AUTH_FAILED)
+	}
+}
+
+func TestSignEventCanonicalRepresentation(t *testing.T) {
+	event := NewEvent("kitchen", 1392821124, 1392821124, "temperature")
+	event.Value = NewNumericValue(21.5)
+	event.Attributes = map[string]string{"unit": "celsius"}
+
+	if got, want := string(canonicalEvent(event)), "7:kitchen10:139282112411:temperature5:n21.54:unit7:celsius"; got != want {
+		t.Errorf("canonical representation = %q, want %q", got, want)
+	}
+
+	// Events whose pipe representations are alike
+	tests := []struct {
+		name  string
+		other *Event
+	}{
+		{"merged attributes", &Event{From: "kitchen", SentOn: 1392821124, Type: "temperature",
+			Value: NewNumericValue(21.5), Attributes: map[string]string{"unit": "celsius|a=b"}}},
+		{"split attributes", &Event{From: "kitchen", SentOn: 1392821124, Type: "temperature",
+			Value: NewNumericValue(21.5), Attributes: map[string]string{"unit": "celsius", "a": "b"}}},
+		{"textual value", &Event{From: "kitchen", SentOn: 1392821124, Type: "temperature",
+			Value: &EventValue{Text: "21.5"}, Attributes: map[string]string{"unit": "celsius"}}},
+		{"value in type", &Event{From: "kitchen", SentOn: 1392821124, Type: "temperature|21.5",
+			Attributes: map[string]string{"unit": "celsius"}}},
+	}
+
+	signatures := map[string]string{SignEvent(event, "secret"): "event"}
+	for _, test := range tests {
+		signature := SignEvent(test.other, "secret")
+		if name, ok := signatures[signature]; ok {
+			t.Errorf("%s event shares it's signature with the %s one", test.name, name)
+		}
+		signatures[signature] = test.name
+	}
+}
+
+func TestFromRateLimitAfterAuthentication(t *testing.T) {
+	auth, err := NewAuthenticator(AUTH_MODE_HMAC, Keyring{"kitchen": "secret"}, DEFAULT_AUTH_MAX_SKEW)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := NewEventsHandler()
+	handler.Auth = auth
+	handler.LimitAction = RATE_LIMIT_ACTION_NACK
+	handler.FromLimiter = NewRateLimiter(1, 1)
+
+	now := time.Now().Unix()
+	event := NewEvent("kitchen", now, now, "temperature")
+	event.Value = NewNumericValue(21.5)
+
+	// Spoofed events don't use up the node budget
+	spoofed := signedFrame(t, event, "guessed")
+	for index := 0; index < 3; index++ {
+		_, errs := handler.PushEventsToQueue(PipeCodec{}, [][]byte{spoofed}, &EventsSource{})
+		if err, ok := errs[0].(*EventError); !ok || err.Code != NACK_AUTH_FAILED {
+			t.Fatalf("spoofed event error = %v, want a %d NACK", errs[0], NACK_AUTH_FAILED)
+		}
+	}
+
+	_, errs := handler.PushEventsToQueue(PipeCodec{}, [][]byte{signedFrame(t, event, "secret")}, &EventsSource{})
+	if errs[0] != nil {
+		t.Errorf("authenticated event refused: %s", errs[0])
+	}
+}
+
+func TestAuthenticatorIdenticalEvents(t *testing.T) {
+	now := time.Now().Unix()
+	verify := func(auth *Authenticator, event *Event, node string) error {
+		if auth.Mode == AUTH_MODE_HMAC {
+			event.Attributes[AUTH_SIGNATURE_ATTRIBUTE] = SignEvent(event, "secret")
+		}
+		return auth.Verify(event, node, now)
+	}
+	event := func(attributes map[string]string) *Event {
+		event := NewEvent("kitchen", now, now, "door")
+		event.Value = &EventValue{Text: "open"}
+		event.Attributes = attributes
+		return event
+	}
+
+	hmacAuth, err := NewAuthenticator(AUTH_MODE_HMAC, Keyring{"kitchen": "secret"}, DEFAULT_AUTH_MAX_SKEW)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Identical signed events are refused as replays
+	if err := verify(hmacAuth, event(map[string]string{}), ""); err != nil {
+		t.Fatalf("first event refused: %s", err)
+	}
+	if err := verify(hmacAuth, event(map[string]string{}), ""); err == nil || !strings.Contains(err.Error(), ErrReplayedEvent.Error()) {
+		t.Errorf("identical signed event error = %v, want %s", err, ErrReplayedEvent)
+	}
+
+	// Unless a signed attribute tells them apart
+	for _, seq := range []string{"1", "2"} {
+		if err := verify(hmacAuth, event(map[string]string{"seq": seq}), ""); err != nil {
+			t.Errorf("event of sequence %s refused: %s", seq, err)
+		}
+	}
+
+	// Events of token authenticated connexions are never deemed replayed
+	tokenAuth, err := NewAuthenticator(AUTH_MODE_TOKEN, Keyring{"kitchen": "secret"}, DEFAULT_AUTH_MAX_SKEW)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for index := 0; index < 2; index++ {
+		if err := verify(tokenAuth, event(nil), "kitchen"); err != nil {
+			t.Errorf("token authenticated event refused: %s", err)
+		}
+	}
+}
@@ -3,13 +3,17 @@ package happening
 import "flag"
 
 type Cmdline struct {
-	DaemonMode *bool
-	ConfigFile *string
-	PidFile    *string
-	LogFile    *string
-	LogLevel   *string
-	Host       *string
-	EventsPort *string
+	DaemonMode    *bool
+	ConfigFile    *string
+	PidFile       *string
+	LogFile       *string
+	LogLevel      *string
+	Host          *string
+	EventsPort    *string
+	UdpEventsPort *string
+	ApiPort       *string
+	RebuildIndex  *bool
+	Query         *string
 }
 
 func (c *Cmdline) ParseArgs() {
@@ -34,5 +38,17 @@ func (c *Cmdline) ParseArgs() {
 	c.EventsPort = flag.String("events-port",
 		DEFAULT_EVENTS_PORT,
 		"Port to be used for events registration")
+	c.UdpEventsPort = flag.String("udp-events-port",
+		DEFAULT_UDP_EVENTS_PORT,
+		"Port to be used for udp events datagrams, disabled when empty")
+	c.ApiPort = flag.String("api-port",
+		DEFAULT_API_PORT,
+		"Port to be used by the http API")
+	c.RebuildIndex = flag.Bool("rebuild-indexes",
+		false,
+		"Rebuilds the stored events indexes, then exits")
+	c.Query = flag.String("query",
+		"",
+		"Prints the stored events matching a query expression, then exits")
 	flag.Parse()
 }
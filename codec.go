@@ -0,0 +1,242 @@
+package happening
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/ugorji/go/codec"
+	"math"
+	"time"
+)
+
+// Codecs errors
+var (
+	ErrUnknownCodec = errors.New("unknown events codec")
+	ErrEmptyFrame   = errors.New("empty binary frame")
+)
+
+// EventCodec describes an events encoding: how event frames are
+// delimited in a stream, and how they are decoded to Events.
+type EventCodec interface {
+	// Name returns the codec configuration name.
+	Name() string
+
+	// Split extracts the next event frame from data, following
+	// the bufio.SplitFunc semantics. Once atEOF, remaining data
+	// is returned as a last frame.
+	Split(data []byte, atEOF bool) (advance int, frame []byte, err error)
+
+	// Decode builds an Event from a frame returned by Split.
+	Decode(frame []byte) (*Event, error)
+}
+
+var eventCodecs = map[string]EventCodec{
+	CODEC_PIPE:    PipeCodec{},
+	CODEC_JSON:    JsonCodec{},
+	CODEC_MSGPACK: MsgpackCodec{},
+}
+
+// EventCodecByName returns the EventCodec registered under name.
+func EventCodecByName(name string) (EventCodec, error) {
+	eventCodec, ok := eventCodecs[name]
+	if !ok {
+		return nil, fmt.Errorf("%s: %q", ErrUnknownCodec, name)
+	}
+
+	return eventCodec, nil
+}
+
+// ExtractFrames splits data holding whole frames, a datagram for
+// example, using eventCodec, and returns the non-empty frames found.
+func ExtractFrames(eventCodec EventCodec, data []byte) ([][]byte, error) {
+	var frames [][]byte
+
+	for len(data) > 0 {
+		advance, frame, err := eventCodec.Split(data, true)
+		if err != nil {
+			return frames, err
+		}
+
+		if advance == 0 {
+			break
+		}
+
+		if len(frame) > 0 {
+			frames = append(frames, frame)
+		}
+		data = data[advance:]
+	}
+
+	return frames, nil
+}
+
+// PipeCodec is the historical happening events encoding: events are
+// EVENT_PARAMS_SEPARATOR separated fields terminated by MSG_DELIMITER.
+// See Event.FromRaw.
+type PipeCodec struct{}
+
+func (c PipeCodec) Name() string {
+	return CODEC_PIPE
+}
+
+func (c PipeCodec) Split(data []byte, atEOF bool) (int, []byte, error) {
+	return splitDelimited(data, atEOF, []byte(MSG_DELIMITER))
+}
+
+func (c PipeCodec) Decode(frame []byte) (*Event, error) {
+	return NewEventFromRaw(string(frame))
+}
+
+// JsonCodec decodes newline delimited json objects events:
+//
+//	{"from": "kitchen", "sent_on": 1392821124, "type": "temperature",
+//	 "value": 21.5, "attributes": {"unit": "celsius"}}
+type JsonCodec struct{}
+
+func (c JsonCodec) Name() string {
+	return CODEC_JSON
+}
+
+func (c JsonCodec) Split(data []byte, atEOF bool) (int, []byte, error) {
+	advance, frame, err := splitDelimited(data, atEOF, []byte{'\n'})
+	return advance, bytes.TrimSuffix(frame, []byte{'\r'}), err
+}
+
+func (c JsonCodec) Decode(frame []byte) (*Event, error) {
+	var message eventMessage
+
+	if err := json.Unmarshal(frame, &message); err != nil {
+		return nil, &EventError{
+			Code:    NACK_MALFORMED_EVENT,
+			Message: fmt.Sprintf("[JsonCodec.Decode] Couldn't parse event: %s", err),
+		}
+	}
+
+	return message.toEvent(string(frame))
+}
+
+// MsgpackCodec decodes compact binary events: each frame is a
+// MessagePack map, holding the same fields as JsonCodec objects,
+// prefixed with it's length as a big endian uint16.
+type MsgpackCodec struct{}
+
+var msgpackHandle = &codec.MsgpackHandle{}
+
+func init() {
+	// Decode msgpack raw strings as strings rather than bytes
+	msgpackHandle.RawToString = true
+}
+
+func (c MsgpackCodec) Name() string {
+	return CODEC_MSGPACK
+}
+
+func (c MsgpackCodec) Split(data []byte, atEOF bool) (int, []byte, error) {
+	if len(data) < MSGPACK_FRAME_HEADER_SIZE {
+		if atEOF && len(data) > 0 {
+			return 0, nil, errors.New("truncated binary frame header")
+		}
+		return 0, nil, nil
+	}
+
+	length := int(binary.BigEndian.Uint16(data))
+	if length == 0 {
+		return 0, nil, ErrEmptyFrame
+	}
+
+	frameEnd := MSGPACK_FRAME_HEADER_SIZE + length
+	if len(data) < frameEnd {
+		if atEOF {
+			return 0, nil, errors.New("truncated binary frame")
+		}
+		return 0, nil, nil
+	}
+
+	return frameEnd, data[MSGPACK_FRAME_HEADER_SIZE:frameEnd], nil
+}
+
+func (c MsgpackCodec) Decode(frame []byte) (*Event, error) {
+	var message eventMessage
+
+	if err := codec.NewDecoderBytes(frame, msgpackHandle).Decode(&message); err != nil {
+		return nil, &EventError{
+			Code:    NACK_MALFORMED_EVENT,
+			Message: fmt.Sprintf("[MsgpackCodec.Decode] Couldn't parse event: %s", err),
+		}
+	}
+
+	return message.toEvent("")
+}
+
+// eventMessage is the structured representation of an
+// event shared by the json and msgpack codecs.
+type eventMessage struct {
+	From       *string           `json:"from"`
+	SentOn     *int64            `json:"sent_on"`
+	Type       *string           `json:"type"`
+	Value      interface{}       `json:"value"`
+	Attributes map[string]string `json:"attributes"`
+}
+
+func (m *eventMessage) toEvent(raw string) (*Event, error) {
+	if m.From == nil || m.SentOn == nil || m.Type == nil {
+		return nil, &EventError{
+			Code:    NACK_MALFORMED_EVENT,
+			Message: "[eventMessage.toEvent] Incomplete event received: from, sent_on and type are required",
+		}
+	}
+
+	event := NewEvent(*m.From, *m.SentOn, time.Now().Unix(), *m.Type)
+	event.raw = raw
+	event.Attributes = m.Attributes
+
+	var number float64
+	switch value := m.Value.(type) {
+	case nil:
+		return event, nil
+	case string:
+		event.Value = NewTextValue(value)
+		return event, nil
+	case float64:
+		number = value
+	case float32:
+		number = float64(value)
+	case int64:
+		number = float64(value)
+	case uint64:
+		number = float64(value)
+	default:
+		return nil, &EventError{
+			Code:    NACK_MALFORMED_EVENT,
+			Message: fmt.Sprintf("[eventMessage.toEvent] Unsupported value: %v", value),
+		}
+	}
+
+	// Just like ParseEventValue, only finite numbers are numeric
+	// values, and binary ones can't be taken as text instead.
+	if math.IsInf(number, 0) || math.IsNaN(number) {
+		return nil, &EventError{
+			Code:    NACK_MALFORMED_EVENT,
+			Message: fmt.Sprintf("[eventMessage.toEvent] Unsupported value: %v", number),
+		}
+	}
+	event.Value = NewNumericValue(number)
+
+	return event, nil
+}
+
+// splitDelimited is a bufio.SplitFunc extracting
+// delimiter terminated frames.
+func splitDelimited(data []byte, atEOF bool, delimiter []byte) (int, []byte, error) {
+	if index := bytes.Index(data, delimiter); index >= 0 {
+		return index + len(delimiter), data[:index], nil
+	}
+
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+
+	return 0, nil, nil
+}
@@ -0,0 +1,67 @@
+package happening
+
+import (
+	"encoding/binary"
+	"math"
+	"testing"
+
+	"github.com/ugorji/go/codec"
+)
+
+// msgpackFrame encodes fields as a MsgpackCodec frame, header included.
+func msgpackFrame(t *testing.T, fields map[string]interface{}) []byte {
+	t.Helper()
+
+	var payload []byte
+	if err := codec.NewEncoderBytes(&payload, msgpackHandle).Encode(fields); err != nil {
+		t.Fatal(err)
+	}
+
+	frame := make([]byte, MSGPACK_FRAME_HEADER_SIZE, MSGPACK_FRAME_HEADER_SIZE+len(payload))
+	binary.BigEndian.PutUint16(frame, uint16(len(payload)))
+
+	return append(frame, payload...)
+}
+
+func TestMsgpackCodecValues(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		want  string
+		code  int
+	}{
+		{"float", 21.5, "21.5", 0},
+		{"integer", 21, "21", 0},
+		{"text", "open", "open", 0},
+		{"NaN", math.NaN(), "", NACK_MALFORMED_EVENT},
+		{"+Inf", math.Inf(1), "", NACK_MALFORMED_EVENT},
+		{"-Inf", float32(math.Inf(-1)), "", NACK_MALFORMED_EVENT},
+	}
+
+	for _, test := range tests {
+		frame := msgpackFrame(t, map[string]interface{}{
+			"from": "kitchen", "sent_on": 1392821124, "type": "temperature", "value": test.value,
+		})
+
+		frames, err := ExtractFrames(MsgpackCodec{}, frame)
+		if err != nil || len(frames) != 1 {
+			t.Fatalf("%s: ExtractFrames = %d frames, %v", test.name, len(frames), err)
+		}
+
+		event, err := MsgpackCodec{}.Decode(frames[0])
+		if test.code != 0 {
+			if eventErr, ok := err.(*EventError); !ok || eventErr.Code != test.code {
+				t.Errorf("%s: Decode error = %v, want code %d", test.name, err, test.code)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: Decode: %s", test.name, err)
+			continue
+		}
+		if got := event.Value.String(); got != test.want {
+			t.Errorf("%s: value = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
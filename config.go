@@ -6,20 +6,78 @@ import (
 )
 
 type Config struct {
-	Daemon      bool   `ini:"daemonize"`
-	LogFile     string `ini:"log_file"`
-	LogLevel    string `ini:"log_level"`
-	Pidfile     string `ini:"pidfile"`
-	StoragePath string `ini:"storage_path"`
+	Daemon         bool   `ini:"daemonize"`
+	LogFile        string `ini:"log_file"`
+	LogLevel       string `ini:"log_level"`
+	Pidfile        string `ini:"pidfile"`
+	StoragePath    string `ini:"storage_path"`
+	StorageBackend string `ini:"storage_backend"`
+	MemoryMaxSize  int    `ini:"memory_max_size"`
+	MemorySnapshot string `ini:"memory_snapshot_file"`
+	Host           string `ini:"host"`
+	EventsPort     string `ini:"events_port"`
+	UdpEventsPort  string `ini:"udp_events_port"`
+	ApiPort        string `ini:"api_port"`
+	AckMode        string `ini:"ack_mode"`
+	EventsCodec    string `ini:"events_codec"`
+	UdpEventsCodec string `ini:"udp_events_codec"`
+	WalEnabled     bool   `ini:"wal_enabled"`
+	WalSync        string `ini:"wal_sync"`
+	WalSyncPeriod  int    `ini:"wal_sync_interval"`
+	QueueMaxSize   int    `ini:"queue_max_size"`
+	QueueOverflow  string `ini:"queue_overflow"`
+	RetentionAge   int    `ini:"retention_max_age"`
+	RetentionCount int    `ini:"retention_max_count"`
+	RetentionBytes int    `ini:"retention_max_bytes"`
+	RetentionRules string `ini:"retention_rules"`
+	RetentionEvery int    `ini:"retention_interval"`
+	Rollups        string `ini:"rollups"`
+	RollupEvery    int    `ini:"rollup_interval"`
+	AlertRules     string `ini:"alert_rules"`
+	TlsCert        string `ini:"tls_cert"`
+	TlsKey         string `ini:"tls_key"`
+	TlsClientCA    string `ini:"tls_client_ca"`
+	AuthMode       string `ini:"auth_mode"`
+	AuthKeyring    string `ini:"auth_keyring"`
+	AuthMaxSkew    int    `ini:"auth_max_skew"`
+	NodeTimeout    int    `ini:"node_timeout"`
+	MaxConnexions  int    `ini:"max_connexions"`
+	MaxLineLength  int    `ini:"max_line_length"`
+	AddrRateLimit  int    `ini:"rate_limit_addr"`
+	AddrRateBurst  int    `ini:"rate_limit_addr_burst"`
+	FromRateLimit  int    `ini:"rate_limit_from"`
+	FromRateBurst  int    `ini:"rate_limit_from_burst"`
+	LimitAction    string `ini:"rate_limit_action"`
 }
 
 func NewConfig() *Config {
 	return &Config{
-		Daemon:      DEFAULT_DAEMON_MODE,
-		LogLevel:    DEFAULT_LOG_LEVEL,
-		LogFile:     DEFAULT_LOG_FILE,
-		Pidfile:     DEFAULT_PID_FILE,
-		StoragePath: DEFAULT_STORAGE_PATH,
+		Daemon:         DEFAULT_DAEMON_MODE,
+		LogLevel:       DEFAULT_LOG_LEVEL,
+		LogFile:        DEFAULT_LOG_FILE,
+		Pidfile:        DEFAULT_PID_FILE,
+		StoragePath:    DEFAULT_STORAGE_PATH,
+		StorageBackend: DEFAULT_STORAGE_BACKEND,
+		Host:           DEFAULT_HOST,
+		EventsPort:     DEFAULT_EVENTS_PORT,
+		UdpEventsPort:  DEFAULT_UDP_EVENTS_PORT,
+		ApiPort:        DEFAULT_API_PORT,
+		AckMode:        DEFAULT_ACK_MODE,
+		EventsCodec:    DEFAULT_EVENTS_CODEC,
+		UdpEventsCodec: DEFAULT_EVENTS_CODEC,
+		WalEnabled:     DEFAULT_WAL_ENABLED,
+		WalSync:        DEFAULT_WAL_SYNC,
+		WalSyncPeriod:  DEFAULT_WAL_SYNC_PERIOD,
+		QueueMaxSize:   DEFAULT_QUEUE_MAX_SIZE,
+		QueueOverflow:  DEFAULT_QUEUE_OVERFLOW,
+		RetentionEvery: DEFAULT_RETENTION_EVERY,
+		RollupEvery:    DEFAULT_ROLLUP_EVERY,
+		AuthMode:       DEFAULT_AUTH_MODE,
+		AuthMaxSkew:    DEFAULT_AUTH_MAX_SKEW,
+		NodeTimeout:    DEFAULT_NODE_TIMEOUT,
+		MaxConnexions:  DEFAULT_MAX_CONNEXIONS,
+		MaxLineLength:  DEFAULT_MAX_LINE_LENGTH,
+		LimitAction:    DEFAULT_LIMIT_ACTION,
 	}
 }
 
@@ -72,4 +130,20 @@ func (c *Config) UpdateFromCmdline(cmdline *Cmdline) {
 	if *cmdline.LogLevel != DEFAULT_LOG_LEVEL {
 		c.LogLevel = *cmdline.LogLevel
 	}
+
+	if *cmdline.Host != DEFAULT_HOST {
+		c.Host = *cmdline.Host
+	}
+
+	if *cmdline.EventsPort != DEFAULT_EVENTS_PORT {
+		c.EventsPort = *cmdline.EventsPort
+	}
+
+	if *cmdline.UdpEventsPort != DEFAULT_UDP_EVENTS_PORT {
+		c.UdpEventsPort = *cmdline.UdpEventsPort
+	}
+
+	if *cmdline.ApiPort != DEFAULT_API_PORT {
+		c.ApiPort = *cmdline.ApiPort
+	}
 }
@@ -2,40 +2,252 @@ package happening
 
 // Sockets buffer sizes
 const (
-	EVENTS_FLOW_BUF_SIZE = 4096
+	EVENTS_FLOW_BUF_SIZE     = 4096
+	EVENTS_DATAGRAM_BUF_SIZE = 65535
+	EVENTS_FRAME_OVERHEAD    = 2 // longest frame delimiter or header
 )
 
 // Storage backends constants
 const (
+	STORAGE_LEVELDB        = "leveldb"
+	STORAGE_GOLEVELDB      = "goleveldb"
+	STORAGE_MEMORY         = "memory"
 	LEVELDB_LRU_CACHE_SIZE = 64 * 1048576 // 64Mo
+
+	MEMORY_MIN_WRITES_COMPACTION = 1024
+)
+
+// Storage writer constants
+const (
+	STORAGE_BATCH_SIZE     = 512
+	STORAGE_FLUSH_INTERVAL = 200 // in milliseconds
+)
+
+// Write-ahead log constants
+const (
+	WAL_DIRECTORY          = "wal"
+	WAL_SEGMENT_EXTENSION  = ".wal"
+	WAL_CHECKPOINT_FILE    = "checkpoint"
+	WAL_SEGMENT_SIZE       = 16 * 1048576 // 16Mo
+	WAL_RECORD_HEADER_SIZE = 16
+	WAL_RECORD_TOMBSTONE   = 1 << 31 // length flag of the records cancelling another
+	WAL_SYNC_ALWAYS        = "always"
+	WAL_SYNC_INTERVAL      = "interval"
+	WAL_SYNC_NEVER         = "never"
+)
+
+// Retention constants
+const (
+	RETENTION_SCOPE_TYPE   = "type"
+	RETENTION_SCOPE_SOURCE = "source"
+	RETENTION_MAX_AGE      = "max_age"
+	RETENTION_MAX_COUNT    = "max_count"
+	RETENTION_MAX_BYTES    = "max_bytes"
+)
+
+// Rollups constants
+const (
+	ROLLUP_MINUTE       = "minute"
+	ROLLUP_HOUR         = "hour"
+	ROLLUP_DAY          = "day"
+	ROLLUP_GRACE_PERIOD = 60 // in seconds
+	ROLLUP_LATE_DELAY   = 30 // in seconds, lower than the grace period
+)
+
+// Storage keyspaces constants
+const (
+	EVENTS_KEYSPACE       = 'e'
+	META_KEYSPACE         = 'm'
+	NODES_KEYSPACE        = 'n'
+	ROLLUPS_KEYSPACE      = 'r'
+	SOURCE_INDEX_KEYSPACE = 's'
+	TYPE_INDEX_KEYSPACE   = 't'
+)
+
+// Http API constants
+const (
+	API_EVENTS_PATH       = "/events"
+	API_DEFAULT_PAGE_SIZE = 100
+	API_MAX_PAGE_SIZE     = 1000
+	API_STREAM_PATH       = "/stream"
+	API_WS_STREAM_PATH    = "/stream/ws"
+	API_ROLLUPS_PATH      = "/rollups"
+	API_AGGREGATE_PATH    = "/aggregate"
+	API_NODES_PATH        = "/nodes"
+
+	API_ATTRIBUTE_PARAM_PREFIX = "attr."
+)
+
+// Aggregation constants
+const (
+	AGGREGATE_GROUP_FROM        = "from"
+	AGGREGATE_GROUP_TYPE        = "type"
+	AGGREGATE_MAX_GROUPS        = 10000
+	AGGREGATE_PERCENTILES       = "50,90,99"
+	LATENCY_HISTOGRAM_PRECISION = 4 // sub-buckets bits per power of two
+)
+
+// Query language constants
+const (
+	QUERY_FIELD_FROM        = "from"
+	QUERY_FIELD_TYPE        = "type"
+	QUERY_FIELD_SENT_ON     = "sent_on"
+	QUERY_FIELD_RECEIVED_ON = "received_on"
+	QUERY_FIELD_VALUE       = "value"
+	QUERY_ATTRIBUTE_PREFIX  = "attr."
+	QUERY_NOW               = "now"
+	QUERY_MAX_LENGTH        = 4096
+)
+
+// Alerting constants
+const (
+	ALERT_RATE_ABOVE      = "rate_above"
+	ALERT_RATE_BELOW      = "rate_below"
+	ALERT_DELAY           = "delay"
+	ALERT_SEQUENCE        = "sequence"
+	ALERT_PARAM_FROM      = "from"
+	ALERT_PARAM_TYPE      = "type"
+	ALERT_PARAM_COUNT     = "count"
+	ALERT_PARAM_WINDOW    = "window"
+	ALERT_PARAM_MAX_DELAY = "max_delay"
+	ALERT_PARAM_FIRST     = "first"
+	ALERT_PARAM_THEN      = "then"
+	ALERT_PARAM_WITHIN    = "within"
+	ALERT_EVENT_SOURCE    = "happening"
+	ALERT_EVENT_TYPE      = "alert"
+	ALERT_FIRING          = "firing"
+	ALERT_RESOLVED        = "resolved"
+	ALERT_CHECK_INTERVAL  = 1 // in seconds
+	ALERT_MAX_GROUPS      = 10000
+)
+
+// Node registry constants
+const (
+	NODE_ONLINE_EVENT_TYPE  = "node_online"
+	NODE_OFFLINE_EVENT_TYPE = "node_offline"
+	NODE_REGISTRY_INTERVAL  = 5 // in seconds
+	NODE_REGISTRY_MAX_NODES = 10000
+)
+
+// Live events streaming constants
+const (
+	SUBSCRIBER_BUFFER_SIZE           = 256
+	SUBSCRIBER_MAX_CONSECUTIVE_DROPS = 256
+	STREAM_HEARTBEAT_INTERVAL        = 15 // in seconds
+	STREAM_WRITE_TIMEOUT             = 10 // in seconds
+)
+
+// Events codecs constants
+const (
+	CODEC_PIPE                = "pipe"
+	CODEC_JSON                = "json"
+	CODEC_MSGPACK             = "msgpack"
+	MSGPACK_FRAME_HEADER_SIZE = 2
 )
 
 // Messages constants
 const (
-	MSG_DELIMITER          = "\r\n"
-	EVENT_PARAMS_SEPARATOR = '|'
+	MSG_DELIMITER             = "\r\n"
+	EVENT_PARAMS_SEPARATOR    = '|'
+	EVENT_ATTRIBUTE_SEPARATOR = '='
+)
+
+// Acknowledgement protocol constants
+const (
+	ACK_MSG           = "ACK"
+	NACK_MSG          = "NACK"
+	ACK_MODE_NONE     = "none"
+	ACK_MODE_RECEIVED = "received"
+	ACK_MODE_STORED   = "stored"
+)
+
+// Nodes authentication constants
+const (
+	AUTH_MODE_NONE           = "none"
+	AUTH_MODE_TOKEN          = "token"
+	AUTH_MODE_HMAC           = "hmac"
+	AUTH_MSG                 = "AUTH"
+	AUTH_SIGNATURE_ATTRIBUTE = "sig"
+)
+
+// Negative acknowledgements error codes
+const (
+	NACK_MALFORMED_EVENT   = 1
+	NACK_INVALID_TIMESTAMP = 2
+	NACK_STORAGE_FAILURE   = 3
+	NACK_STORAGE_TIMEOUT   = 4
+	NACK_INVALID_ATTRIBUTE = 5
+	NACK_QUEUE_FULL        = 6
+	NACK_AUTH_FAILED       = 7
+	NACK_RATE_LIMITED      = 8
+	NACK_FRAME_TOO_LONG    = 9
 )
 
 // Timeouts in seconds
 const (
-	EVENT_REG_CONN_TIMEOUT = 1
-	EVENT_FLOW_TIMEOUT     = 30
+	EVENT_REG_CONN_TIMEOUT      = 1
+	EVENT_FLOW_TIMEOUT          = 30
+	EVENT_ACK_WRITE_TIMEOUT     = 5
+	EVENT_STORED_TIMEOUT        = 10
+	EVENT_TLS_HANDSHAKE_TIMEOUT = 10
+	QUEUE_BLOCK_TIMEOUT         = 10
+)
+
+// Internal events queue and channel sizes
+const (
+	EVENTS_QUEUE_SIZE   = 4096
+	EVENTS_CHANNEL_SIZE = 1024
+)
+
+// Events queue overflow policies
+const (
+	QUEUE_POLICY_BLOCK       = "block"
+	QUEUE_POLICY_DROP_OLDEST = "drop_oldest"
+	QUEUE_POLICY_DROP_NEWEST = "drop_newest"
+	QUEUE_POLICY_REJECT      = "reject"
+)
+
+// Rate limits actions and bounds
+const (
+	RATE_LIMIT_ACTION_DROP       = "drop"
+	RATE_LIMIT_ACTION_NACK       = "nack"
+	RATE_LIMIT_ACTION_DISCONNECT = "disconnect"
+	RATE_LIMIT_PRUNE_INTERVAL    = 60 // in seconds
+	RATE_LIMIT_MAX_KEYS          = 65536
 )
 
-// Internal events queue size
+// Disabled udp events listener port value, besides an empty one
 const (
-	EVENTS_QUEUE_SIZE = 4096
+	UDP_EVENTS_DISABLED = "none"
 )
 
 // Configuration fallback constants
 const (
-	DEFAULT_CONFIG_FILE  = "/etc/happening/happening.conf"
-	DEFAULT_STORAGE_PATH = "/tmp"
-	DEFAULT_LOG_FILE     = "/tmp/happening.log"
-	DEFAULT_PID_FILE     = "/tmp/happening.pid"
-	DEFAULT_TRANSPORT    = "tcp"
-	DEFAULT_LOG_LEVEL    = "INFO"
-	DEFAULT_DAEMON_MODE  = false
-	DEFAULT_HOST         = "localhost"
-	DEFAULT_EVENTS_PORT  = ":4040"
+	DEFAULT_CONFIG_FILE     = "/etc/happening/happening.conf"
+	DEFAULT_STORAGE_PATH    = "/tmp"
+	DEFAULT_STORAGE_BACKEND = STORAGE_GOLEVELDB
+	DEFAULT_LOG_FILE        = "/tmp/happening.log"
+	DEFAULT_PID_FILE        = "/tmp/happening.pid"
+	DEFAULT_TRANSPORT       = "tcp"
+	DEFAULT_LOG_LEVEL       = "INFO"
+	DEFAULT_DAEMON_MODE     = false
+	DEFAULT_HOST            = "localhost"
+	DEFAULT_EVENTS_PORT     = ":4040"
+	DEFAULT_UDP_EVENTS_PORT = "" // disabled
+	DEFAULT_API_PORT        = ":4042"
+	DEFAULT_ACK_MODE        = ACK_MODE_RECEIVED
+	DEFAULT_EVENTS_CODEC    = CODEC_PIPE
+	DEFAULT_WAL_ENABLED     = true
+	DEFAULT_WAL_SYNC        = WAL_SYNC_INTERVAL
+	DEFAULT_WAL_SYNC_PERIOD = 1000 // in milliseconds
+	DEFAULT_QUEUE_MAX_SIZE  = 65536
+	DEFAULT_QUEUE_OVERFLOW  = QUEUE_POLICY_BLOCK
+	DEFAULT_RETENTION_EVERY = 60 // in seconds
+	DEFAULT_ROLLUP_EVERY    = 60 // in seconds
+	DEFAULT_AUTH_MODE       = AUTH_MODE_NONE
+	DEFAULT_AUTH_MAX_SKEW   = 300 // in seconds
+	DEFAULT_NODE_TIMEOUT    = 0   // in seconds, disabled
+	DEFAULT_MAX_CONNEXIONS  = 0   // unlimited
+	DEFAULT_MAX_LINE_LENGTH = 65536
+	DEFAULT_LIMIT_ACTION    = RATE_LIMIT_ACTION_NACK
 )
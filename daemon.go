@@ -5,9 +5,7 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
-	"os/signal"
 	"strconv"
-	"syscall"
 )
 
 func createPidFile(pidfile string) error {
@@ -38,21 +36,13 @@ func removePidFile(pidfile string) {
 	}
 }
 
+// Daemon runs happening maintaining config pid file. Signals are
+// handled by the Server, the pid file is removed once it's stopped.
 func Daemon(config *Config) error {
 	if err := createPidFile(config.Pidfile); err != nil {
 		log.Fatal(err)
 	}
 	defer removePidFile(config.Pidfile)
 
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, os.Kill, os.Signal(syscall.SIGTERM))
-
-	go func() {
-		sig := <-c
-		log.Printf("Received signal '%v', exiting\n", sig)
-		removePidFile(config.Pidfile)
-		os.Exit(0)
-	}()
-
-	return ListenAndAcknowledge()
+	return ListenAndAcknowledge(config)
 }
@@ -0,0 +1,434 @@
+package happening
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Events are stored using the following binary key layout:
+//
+//	'e' | From | 0x00 | Type | 0x00 | SentOn | Sequence
+//
+// where SentOn is the event timestamp encoded as a big endian
+// uint64 with it's sign bit flipped, so negative timestamps sort
+// before positive ones, and Sequence is a big endian uint64
+// tiebreaker distinguishing events sharing the same source, type
+// and timestamp.
+//
+// Keys are thus ordered by source, then by type, then by time.
+// Scanning the events of a source is a prefix scan over
+// 'e' | From | 0x00, and scanning the events of a source and type
+// between two timestamps is a range scan between the keys built
+// from both timestamps.
+//
+// As 0x00 is used as a separator, neither From nor Type
+// are allowed to contain it.
+
+// Events values kinds
+const (
+	eventNoValue      = 0
+	eventNumericValue = 1
+	eventTextValue    = 2
+)
+
+// Events keys encoding errors
+var (
+	ErrInvalidEventKey   = errors.New("invalid event key")
+	ErrInvalidEventValue = errors.New("invalid event value")
+)
+
+const (
+	eventKeySeparator     = 0x00
+	eventTimestampLength  = 8
+	eventSequenceLength   = 8
+	eventValueVersion     = 2
+	eventKeyMinimalLength = 1 + 2 + eventTimestampLength + eventSequenceLength
+)
+
+// eventSequence is seeded with the process startup time, and raised
+// past the greatest stored sequence on startup, see ResumeEventSequence,
+// so that sequences keep growing across restarts even though the clock
+// stepped back in the meantime.
+var eventSequence = uint64(time.Now().UnixNano())
+
+// eventSequenceKey is the meta key the greatest sequence
+// of the stored events is kept under.
+var eventSequenceKey = append([]byte{META_KEYSPACE}, "sequence"...)
+
+// nextEventSequence returns a process-wide unique, increasing,
+// event sequence number.
+func nextEventSequence() uint64 {
+	return atomic.AddUint64(&eventSequence, 1)
+}
+
+// raiseEventSequence ensures the next event
+// sequence numbers are greater than seq.
+func raiseEventSequence(seq uint64) {
+	for {
+		current := atomic.LoadUint64(&eventSequence)
+		if current >= seq || atomic.CompareAndSwapUint64(&eventSequence, current, seq) {
+			return
+		}
+	}
+}
+
+// ResumeEventSequence raises the event sequence past the
+// greatest sequence of the events stored in backend.
+func ResumeEventSequence(ctx context.Context, backend StorageBackend) error {
+	value, err := backend.Get(ctx, eventSequenceKey)
+	if err == ErrKeyNotFound {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(value) != eventSequenceLength {
+		return fmt.Errorf("%s: stored event sequence %x", ErrInvalidEventValue, value)
+	}
+	raiseEventSequence(binary.BigEndian.Uint64(value))
+
+	return nil
+}
+
+// eventSequenceKvPair returns the pair storing
+// seq as the greatest stored event sequence.
+func eventSequenceKvPair(seq uint64) KvPair {
+	return KvPair{Key: eventSequenceKey, Value: appendUint64(nil, seq)}
+}
+
+// EventKey represents the decoded storage key of an event.
+type EventKey struct {
+	From     string
+	Type     string
+	SentOn   int64
+	Sequence uint64
+}
+
+// NewEventKey builds the storage key of an event.
+func NewEventKey(event *Event) *EventKey {
+	return &EventKey{
+		From:     event.From,
+		Type:     event.Type,
+		SentOn:   event.SentOn,
+		Sequence: event.seq,
+	}
+}
+
+// Encode returns the binary representation of the EventKey.
+func (k *EventKey) Encode() ([]byte, error) {
+	prefix, err := EventStreamPrefix(k.From, k.Type)
+	if err != nil {
+		return nil, err
+	}
+
+	key := make([]byte, len(prefix), len(prefix)+eventTimestampLength+eventSequenceLength)
+	copy(key, prefix)
+	key = appendTimestamp(key, k.SentOn)
+	key = appendUint64(key, k.Sequence)
+
+	return key, nil
+}
+
+// DecodeEventKey parses an event key binary representation.
+func DecodeEventKey(key []byte) (*EventKey, error) {
+	if len(key) < eventKeyMinimalLength || key[0] != EVENTS_KEYSPACE {
+		return nil, ErrInvalidEventKey
+	}
+
+	// Split the variable length part of the key: the
+	// fixed-size timestamp and sequence are at it's tail
+	tail := len(key) - eventTimestampLength - eventSequenceLength
+	names := bytes.Split(key[1:tail], []byte{eventKeySeparator})
+	if len(names) != 3 || len(names[2]) != 0 {
+		return nil, ErrInvalidEventKey
+	}
+
+	return &EventKey{
+		From:     string(names[0]),
+		Type:     string(names[1]),
+		SentOn:   decodeTimestamp(key[tail : tail+eventTimestampLength]),
+		Sequence: binary.BigEndian.Uint64(key[tail+eventTimestampLength:]),
+	}, nil
+}
+
+// EventSourcePrefix returns the key prefix shared by every
+// event of a source.
+func EventSourcePrefix(from string) ([]byte, error) {
+	if err := validateKeyComponent("source", from); err != nil {
+		return nil, err
+	}
+
+	prefix := make([]byte, 0, len(from)+2)
+	prefix = append(prefix, EVENTS_KEYSPACE)
+	prefix = append(prefix, from...)
+	prefix = append(prefix, eventKeySeparator)
+
+	return prefix, nil
+}
+
+// EventStreamPrefix returns the key prefix shared by every
+// event of a given type sent by a source.
+func EventStreamPrefix(from string, eventType string) ([]byte, error) {
+	prefix, err := EventSourcePrefix(from)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := validateKeyComponent("type", eventType); err != nil {
+		return nil, err
+	}
+
+	prefix = append(prefix, eventType...)
+	prefix = append(prefix, eventKeySeparator)
+
+	return prefix, nil
+}
+
+// EventStreamTimeKey returns the smallest key an event of the
+// given source and type sent at timestamp can have. Events sent
+// in [start, end) are stored between EventStreamTimeKey(start)
+// included and EventStreamTimeKey(end) excluded.
+func EventStreamTimeKey(from string, eventType string, timestamp int64) ([]byte, error) {
+	prefix, err := EventStreamPrefix(from, eventType)
+	if err != nil {
+		return nil, err
+	}
+
+	return appendTimestamp(prefix, timestamp), nil
+}
+
+// EncodeEvent returns the binary representation of an event,
+// used as the value it's key points to:
+//
+//	version | SentOn | ReceivedOn | len(From) | From | len(Type) | Type |
+//	value kind | value | attributes count | (len(key) | key | len(value) | value)...
+//
+// where version and value kind are single bytes, timestamps are
+// varints, lengths and count are uvarints. Numeric values are encoded
+// as their big endian IEEE 754 representation, textual ones as a
+// length prefixed string, and no value as a zero value kind alone.
+//
+// Version 1 values, which end after the event Type, are still decoded.
+func EncodeEvent(event *Event) []byte {
+	buf := make([]byte, 1, 64+len(event.From)+len(event.Type))
+	buf[0] = eventValueVersion
+
+	buf = binary.AppendVarint(buf, event.SentOn)
+	buf = binary.AppendVarint(buf, event.ReceivedOn)
+	buf = appendString(buf, event.From)
+	buf = appendString(buf, event.Type)
+
+	switch {
+	case event.Value == nil:
+		buf = append(buf, eventNoValue)
+	case event.Value.Numeric:
+		buf = append(buf, eventNumericValue)
+		buf = appendUint64(buf, math.Float64bits(event.Value.Number))
+	default:
+		buf = append(buf, eventTextValue)
+		buf = appendString(buf, event.Value.Text)
+	}
+
+	// Sort attributes keys so an event encoding is deterministic
+	keys := make([]string, 0, len(event.Attributes))
+	for key := range event.Attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	buf = binary.AppendUvarint(buf, uint64(len(keys)))
+	for _, key := range keys {
+		buf = appendString(buf, key)
+		buf = appendString(buf, event.Attributes[key])
+	}
+
+	return buf
+}
+
+// DecodeEvent parses an event binary representation
+// as returned by EncodeEvent.
+func DecodeEvent(data []byte) (*Event, error) {
+	if len(data) == 0 || data[0] < 1 || data[0] > eventValueVersion {
+		return nil, ErrInvalidEventValue
+	}
+
+	version := data[0]
+	decoder := &valueDecoder{data: data[1:]}
+	event := &Event{
+		SentOn:     decoder.varint(),
+		ReceivedOn: decoder.varint(),
+		From:       decoder.string(),
+		Type:       decoder.string(),
+	}
+
+	if version >= 2 {
+		switch decoder.byte() {
+		case eventNoValue:
+		case eventNumericValue:
+			event.Value = NewNumericValue(math.Float64frombits(decoder.uint64()))
+		case eventTextValue:
+			event.Value = NewTextValue(decoder.string())
+		default:
+			decoder.err = ErrInvalidEventValue
+		}
+
+		count := decoder.uvarint()
+		if count > uint64(len(decoder.data)) {
+			decoder.err = ErrInvalidEventValue
+		}
+
+		for i := uint64(0); i < count && decoder.err == nil; i++ {
+			if event.Attributes == nil {
+				event.Attributes = make(map[string]string, count)
+			}
+			key := decoder.string()
+			event.Attributes[key] = decoder.string()
+		}
+	}
+
+	if decoder.err != nil {
+		return nil, decoder.err
+	}
+
+	return event, nil
+}
+
+// DecodeEventKvPair rebuilds an Event from it's storage key and value.
+func DecodeEventKvPair(key []byte, value []byte) (*Event, error) {
+	eventKey, err := DecodeEventKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	event, err := DecodeEvent(value)
+	if err != nil {
+		return nil, err
+	}
+	event.seq = eventKey.Sequence
+
+	return event, nil
+}
+
+func validateKeyComponent(name string, value string) error {
+	if strings.IndexByte(value, eventKeySeparator) != -1 {
+		return fmt.Errorf("%s: event %s %q contains a 0x00 byte", ErrInvalidEventKey, name, value)
+	}
+
+	return nil
+}
+
+// appendTimestamp appends a timestamp to buf so that the
+// bytewise order of encoded timestamps matches their numeric order.
+func appendTimestamp(buf []byte, timestamp int64) []byte {
+	return appendUint64(buf, uint64(timestamp)^(1<<63))
+}
+
+func decodeTimestamp(buf []byte) int64 {
+	return int64(binary.BigEndian.Uint64(buf) ^ (1 << 63))
+}
+
+func appendUint64(buf []byte, value uint64) []byte {
+	var encoded [8]byte
+	binary.BigEndian.PutUint64(encoded[:], value)
+	return append(buf, encoded[:]...)
+}
+
+func appendString(buf []byte, value string) []byte {
+	buf = binary.AppendUvarint(buf, uint64(len(value)))
+	return append(buf, value...)
+}
+
+// valueDecoder reads the fields of a binary encoded value,
+// keeping track of the first error encountered.
+type valueDecoder struct {
+	data []byte
+	err  error
+}
+
+func (d *valueDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+
+	value, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.err = ErrInvalidEventValue
+		return 0
+	}
+	d.data = d.data[n:]
+
+	return value
+}
+
+func (d *valueDecoder) byte() byte {
+	if d.err != nil {
+		return 0
+	}
+
+	if len(d.data) < 1 {
+		d.err = ErrInvalidEventValue
+		return 0
+	}
+
+	value := d.data[0]
+	d.data = d.data[1:]
+
+	return value
+}
+
+func (d *valueDecoder) uint64() uint64 {
+	if d.err != nil {
+		return 0
+	}
+
+	if len(d.data) < 8 {
+		d.err = ErrInvalidEventValue
+		return 0
+	}
+
+	value := binary.BigEndian.Uint64(d.data)
+	d.data = d.data[8:]
+
+	return value
+}
+
+func (d *valueDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+
+	value, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.err = ErrInvalidEventValue
+		return 0
+	}
+	d.data = d.data[n:]
+
+	return value
+}
+
+func (d *valueDecoder) string() string {
+	length := d.uvarint()
+	if d.err != nil {
+		return ""
+	}
+
+	if uint64(len(d.data)) < length {
+		d.err = ErrInvalidEventValue
+		return ""
+	}
+
+	value := string(d.data[:length])
+	d.data = d.data[length:]
+
+	return value
+}
@@ -0,0 +1,56 @@
+package happening
+
+import (
+	"context"
+	"encoding/binary"
+	"sync/atomic"
+	"testing"
+)
+
+func TestResumeEventSequence(t *testing.T) {
+	ctx := context.Background()
+	backend, err := NewMemoryBackend(0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved := atomic.LoadUint64(&eventSequence)
+	defer atomic.StoreUint64(&eventSequence, saved)
+
+	if err := ResumeEventSequence(ctx, backend); err != nil {
+		t.Fatalf("ResumeEventSequence without stored sequence: %s", err)
+	}
+
+	queue := NewQueue(EVENTS_QUEUE_SIZE)
+	writer := NewStorageWriter(backend, queue)
+	stored := NewEvent("kitchen", 1392821124, 1392821124, "temperature")
+	queue.Push(stored)
+	writer.Flush()
+
+	value, err := backend.Get(ctx, eventSequenceKey)
+	if err != nil {
+		t.Fatalf("stored sequence: %s", err)
+	}
+	if seq := binary.BigEndian.Uint64(value); seq != stored.seq {
+		t.Fatalf("stored sequence = %d, want %d", seq, stored.seq)
+	}
+
+	// The clock stepped back before the restart
+	atomic.StoreUint64(&eventSequence, stored.seq-1000)
+	if err := ResumeEventSequence(ctx, backend); err != nil {
+		t.Fatalf("ResumeEventSequence: %s", err)
+	}
+
+	if seq := nextEventSequence(); seq <= stored.seq {
+		t.Errorf("resumed sequence %d, want greater than %d", seq, stored.seq)
+	}
+
+	// A sequence ahead of the stored one is kept
+	atomic.StoreUint64(&eventSequence, stored.seq+1000)
+	if err := ResumeEventSequence(ctx, backend); err != nil {
+		t.Fatalf("ResumeEventSequence: %s", err)
+	}
+	if seq := nextEventSequence(); seq != stored.seq+1001 {
+		t.Errorf("resumed sequence %d, want %d", seq, stored.seq+1001)
+	}
+}
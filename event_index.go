@@ -0,0 +1,185 @@
+package happening
+
+import (
+	"context"
+	"fmt"
+
+	l4g "github.com/alecthomas/log4go"
+)
+
+// Events are indexed by type and by source, so that the events of
+// a type sent by any source, or the events of any type sent by a
+// source, can be range scanned by time. Indexes entries use the
+// following binary key layouts:
+//
+//	't' | Type | 0x00 | SentOn | Sequence
+//	's' | From | 0x00 | SentOn | Sequence
+//
+// where SentOn and Sequence are encoded as in events keys, and
+// point to the event key. Indexes entries are written and deleted
+// along with the event they point to, in the same batch.
+
+var eventIndexesKeyspaces = []byte{TYPE_INDEX_KEYSPACE, SOURCE_INDEX_KEYSPACE}
+
+// EventIndexPrefix returns the key prefix shared by every entry
+// of the keyspace index pointing to the events having name as
+// type, or source.
+func EventIndexPrefix(keyspace byte, name string) ([]byte, error) {
+	if err := validateKeyComponent("index", name); err != nil {
+		return nil, err
+	}
+
+	prefix := make([]byte, 0, len(name)+2+eventTimestampLength+eventSequenceLength)
+	prefix = append(prefix, keyspace)
+	prefix = append(prefix, name...)
+	prefix = append(prefix, eventKeySeparator)
+
+	return prefix, nil
+}
+
+// EventIndexTimeKey returns the smallest key an entry of the keyspace
+// index pointing to an event having name as type, or source, sent at
+// timestamp can have.
+func EventIndexTimeKey(keyspace byte, name string, timestamp int64) ([]byte, error) {
+	prefix, err := EventIndexPrefix(keyspace, name)
+	if err != nil {
+		return nil, err
+	}
+
+	return appendTimestamp(prefix, timestamp), nil
+}
+
+// EventIndexKeys returns the keys of the indexes entries
+// pointing to the event stored under key.
+func EventIndexKeys(key *EventKey) ([][]byte, error) {
+	keys := make([][]byte, 0, len(eventIndexesKeyspaces))
+
+	for _, keyspace := range eventIndexesKeyspaces {
+		name := key.Type
+		if keyspace == SOURCE_INDEX_KEYSPACE {
+			name = key.From
+		}
+
+		indexKey, err := EventIndexTimeKey(keyspace, name, key.SentOn)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, appendUint64(indexKey, key.Sequence))
+	}
+
+	return keys, nil
+}
+
+// eventIndexKvPairs returns the indexes entries
+// pointing to the event stored under key.
+func eventIndexKvPairs(key []byte) ([]KvPair, error) {
+	eventKey, err := DecodeEventKey(key)
+	if err != nil {
+		return nil, err
+	}
+
+	indexKeys, err := EventIndexKeys(eventKey)
+	if err != nil {
+		return nil, err
+	}
+
+	pairs := make([]KvPair, 0, len(indexKeys))
+	for _, indexKey := range indexKeys {
+		pairs = append(pairs, KvPair{Key: indexKey, Value: key})
+	}
+
+	return pairs, nil
+}
+
+// withIndexKeys returns the events keys along with the
+// keys of the indexes entries pointing to them, so that
+// they can be deleted together.
+func withIndexKeys(keys [][]byte) [][]byte {
+	all := make([][]byte, 0, len(keys)*(1+len(eventIndexesKeyspaces)))
+
+	for _, key := range keys {
+		all = append(all, key)
+
+		if pairs, err := eventIndexKvPairs(key); err == nil {
+			for _, pair := range pairs {
+				all = append(all, pair.Key)
+			}
+		}
+	}
+
+	return all
+}
+
+// RebuildIndexes drops every index entry of backend, and indexes
+// the stored events again. It returns how many events were indexed.
+func RebuildIndexes(ctx context.Context, backend StorageBackend) (int, error) {
+	for _, keyspace := range eventIndexesKeyspaces {
+		for {
+			keys, err := iteratorKeys(ctx, backend, IteratorOptions{
+				Prefix: []byte{keyspace},
+				Limit:  STORAGE_BATCH_SIZE,
+			})
+			if err != nil {
+				return 0, err
+			}
+
+			if len(keys) == 0 {
+				break
+			}
+
+			if err := backend.MDelete(ctx, keys); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	var indexed int
+	start := []byte{EVENTS_KEYSPACE}
+
+	for {
+		keys, err := iteratorKeys(ctx, backend, IteratorOptions{
+			Start:  start,
+			Prefix: []byte{EVENTS_KEYSPACE},
+			Limit:  STORAGE_BATCH_SIZE,
+		})
+		if err != nil || len(keys) == 0 {
+			return indexed, err
+		}
+
+		var pairs []KvPair
+		for _, key := range keys {
+			indexPairs, err := eventIndexKvPairs(key)
+			if err != nil {
+				l4g.Warn(fmt.Sprintf("[RebuildIndexes] Skipping key %q: %s", key, err))
+				continue
+			}
+			pairs = append(pairs, indexPairs...)
+			indexed++
+		}
+
+		if err := backend.MPut(ctx, pairs); err != nil {
+			return indexed, err
+		}
+
+		start = append(keys[len(keys)-1], 0x00)
+	}
+}
+
+// RebuildEventIndexes opens the storage backend selected by
+// config, and rebuilds it's events indexes.
+func RebuildEventIndexes(config *Config) error {
+	backend, err := NewStorageBackend(config)
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+
+	indexed, err := RebuildIndexes(context.Background(), backend)
+	if err != nil {
+		return err
+	}
+
+	l4g.Info(fmt.Sprintf("[RebuildEventIndexes] %d events indexed", indexed))
+
+	return nil
+}
@@ -0,0 +1,67 @@
+package happening
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRebuildIndexes(t *testing.T) {
+	ctx := context.Background()
+	backend, err := NewMemoryBackend(0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	// Events are stored without their index entries, across
+	// several batches, along with a malformed event key.
+	now := time.Now().Unix()
+	ages := make([]int64, STORAGE_BATCH_SIZE+1)
+	for index := range ages {
+		ages[index] = int64(len(ages) - index)
+
+		pairs, err := eventKvPairs(NewEvent("kitchen", now-ages[index], now, "temperature"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := backend.Put(ctx, pairs[0]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := backend.Put(ctx, KvPair{Key: []byte{EVENTS_KEYSPACE, 'x'}, Value: []byte("{}")}); err != nil {
+		t.Fatal(err)
+	}
+
+	// And stale index entries point to an event long gone
+	gone, err := eventKvPairs(NewEvent("cellar", now, now, "temperature"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := backend.MPut(ctx, gone[1:]); err != nil {
+		t.Fatal(err)
+	}
+
+	indexed, err := RebuildIndexes(ctx, backend)
+	if err != nil {
+		t.Fatalf("RebuildIndexes: %s", err)
+	}
+	if indexed != len(ages) {
+		t.Errorf("RebuildIndexes indexed %d events, want %d", indexed, len(ages))
+	}
+
+	if retained := retainedAges(t, backend, "kitchen", now); !equalAges(retained, ages) {
+		t.Errorf("indexed %d kitchen events, want %d", len(retained), len(ages))
+	}
+	if entries, want := indexEntries(t, backend), len(eventIndexesKeyspaces)*len(ages); entries != want {
+		t.Errorf("%d index entries, want %d", entries, want)
+	}
+
+	// Rebuilding again leaves the indexes untouched
+	if indexed, err := RebuildIndexes(ctx, backend); err != nil || indexed != len(ages) {
+		t.Errorf("second RebuildIndexes = %d, %v, want %d", indexed, err, len(ages))
+	}
+	if entries, want := indexEntries(t, backend), len(eventIndexesKeyspaces)*len(ages); entries != want {
+		t.Errorf("%d index entries after a second rebuild, want %d", entries, want)
+	}
+}
@@ -0,0 +1,433 @@
+package happening
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"math"
+)
+
+// Event store errors
+var (
+	ErrInvalidEventId = errors.New("invalid event id")
+	ErrInvalidCursor  = errors.New("invalid cursor")
+)
+
+// EventFilter describes the events an EventStore query should match.
+// Empty From and Type match any source and type, events are
+// matched if Since <= SentOn < Until, and if they carry every
+// filter Attributes. As soon as ValueMin or ValueMax are finite,
+// only events carrying a numeric value within [ValueMin, ValueMax]
+// are matched. A non nil Query further restricts the matched events.
+type EventFilter struct {
+	From       string
+	Type       string
+	Since      int64
+	Until      int64
+	Attributes map[string]string
+	ValueMin   float64
+	ValueMax   float64
+	Query      *Query
+}
+
+// NewEventFilter returns an EventFilter matching every event.
+func NewEventFilter() *EventFilter {
+	return &EventFilter{
+		Since:    math.MinInt64,
+		Until:    math.MaxInt64,
+		ValueMin: math.Inf(-1),
+		ValueMax: math.Inf(1),
+	}
+}
+
+// IsEmpty returns whether the filter matches every event.
+func (f *EventFilter) IsEmpty() bool {
+	return f.From == "" && f.Type == "" &&
+		f.Since == math.MinInt64 && f.Until == math.MaxInt64 &&
+		len(f.Attributes) == 0 && !f.hasValueRange() && f.Query == nil
+}
+
+func (f *EventFilter) hasValueRange() bool {
+	return !math.IsInf(f.ValueMin, -1) || !math.IsInf(f.ValueMax, 1)
+}
+
+// Match returns whether an event matches the filter.
+func (f *EventFilter) Match(event *Event) bool {
+	if (f.From != "" && f.From != event.From) ||
+		(f.Type != "" && f.Type != event.Type) ||
+		event.SentOn < f.Since ||
+		event.SentOn >= f.Until {
+		return false
+	}
+
+	for key, value := range f.Attributes {
+		if eventValue, ok := event.Attributes[key]; !ok || eventValue != value {
+			return false
+		}
+	}
+
+	if f.hasValueRange() {
+		if event.Value == nil || !event.Value.Numeric ||
+			event.Value.Number < f.ValueMin || event.Value.Number > f.ValueMax {
+			return false
+		}
+	}
+
+	if f.Query != nil && !f.Query.Match(event) {
+		return false
+	}
+
+	return true
+}
+
+// iteratorOptions returns the narrowest keyspace range holding
+// the events the filter may match, and whether it is an index range:
+//
+//   - a time range of a source events stream when both From and Type are set
+//   - a time range of the type index when only Type is set
+//   - a time range of the source index when only From and a time range are set
+//   - the source events when only From is set
+//   - every event otherwise
+func (f *EventFilter) iteratorOptions() (opts IteratorOptions, indexed bool, err error) {
+	hasTimeRange := f.Since != math.MinInt64 || f.Until != math.MaxInt64
+
+	switch {
+	case f.From != "" && f.Type != "":
+		if opts.Start, err = EventStreamTimeKey(f.From, f.Type, f.Since); err != nil {
+			return opts, false, err
+		}
+		opts.End, err = EventStreamTimeKey(f.From, f.Type, f.Until)
+		return opts, false, err
+	case f.Type != "":
+		return indexTimeRange(TYPE_INDEX_KEYSPACE, f.Type, f.Since, f.Until)
+	case f.From != "" && hasTimeRange:
+		return indexTimeRange(SOURCE_INDEX_KEYSPACE, f.From, f.Since, f.Until)
+	case f.From != "":
+		opts.Prefix, err = EventSourcePrefix(f.From)
+		return opts, false, err
+	default:
+		return IteratorOptions{Prefix: []byte{EVENTS_KEYSPACE}}, false, nil
+	}
+}
+
+func indexTimeRange(keyspace byte, name string, since int64, until int64) (opts IteratorOptions, indexed bool, err error) {
+	if opts.Start, err = EventIndexTimeKey(keyspace, name, since); err != nil {
+		return opts, true, err
+	}
+	opts.End, err = EventIndexTimeKey(keyspace, name, until)
+
+	return opts, true, err
+}
+
+// EventStore exposes the events persisted in a
+// StorageBackend by the StorageWriter.
+type EventStore struct {
+	Backend StorageBackend
+}
+
+// NewEventStore builds an EventStore over backend.
+func NewEventStore(backend StorageBackend) *EventStore {
+	return &EventStore{
+		Backend: backend,
+	}
+}
+
+// EventId returns the public identifier of a stored event.
+func EventId(event *Event) (string, error) {
+	key, err := NewEventKey(event).Encode()
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(key), nil
+}
+
+// parseEventId returns the storage key an event id refers to.
+func parseEventId(id string) ([]byte, error) {
+	key, err := base64.RawURLEncoding.DecodeString(id)
+	if err != nil {
+		return nil, ErrInvalidEventId
+	}
+
+	if _, err = DecodeEventKey(key); err != nil {
+		return nil, ErrInvalidEventId
+	}
+
+	return key, nil
+}
+
+// Get fetches a single event by id. Returns ErrKeyNotFound
+// if no such event is stored.
+func (s *EventStore) Get(ctx context.Context, id string) (*Event, error) {
+	key, err := parseEventId(id)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := s.Backend.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+
+	return DecodeEventKvPair(key, value)
+}
+
+// Delete removes a single event by id.
+func (s *EventStore) Delete(ctx context.Context, id string) error {
+	key, err := parseEventId(id)
+	if err != nil {
+		return err
+	}
+
+	if _, err = s.Backend.Get(ctx, key); err != nil {
+		return err
+	}
+
+	return s.Backend.MDelete(ctx, withIndexKeys([][]byte{key}))
+}
+
+// Find returns at most limit events matching filter, in storage order,
+// starting after cursor. It also returns the cursor to resume the
+// query from, which is empty once there are no more events to return.
+func (s *EventStore) Find(ctx context.Context, filter *EventFilter, cursor string, limit int) ([]*Event, string, error) {
+	var events []*Event
+	var lastKey []byte
+	var more bool
+
+	after, err := parseCursor(cursor)
+	if err != nil {
+		return nil, "", err
+	}
+
+	err = s.scan(ctx, filter, after, func(position []byte, key []byte, event *Event) bool {
+		if len(events) == limit {
+			more = true
+			return false
+		}
+
+		events = append(events, event)
+		lastKey = position
+		return true
+	})
+	if err != nil {
+		return nil, "", err
+	}
+
+	if !more {
+		return events, "", nil
+	}
+
+	return events, base64.RawURLEncoding.EncodeToString(lastKey), nil
+}
+
+// DeleteMatching removes every event matching filter and
+// returns how many events were removed.
+func (s *EventStore) DeleteMatching(ctx context.Context, filter *EventFilter) (int, error) {
+	var count int
+	var keys [][]byte
+
+	err := s.scan(ctx, filter, nil, func(position []byte, key []byte, event *Event) bool {
+		keys = append(keys, key)
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for len(keys) > 0 {
+		batchSize := STORAGE_BATCH_SIZE
+		if len(keys) < batchSize {
+			batchSize = len(keys)
+		}
+
+		if err := s.Backend.MDelete(ctx, withIndexKeys(keys[:batchSize])); err != nil {
+			return count, err
+		}
+
+		count += batchSize
+		keys = keys[batchSize:]
+	}
+
+	return count, nil
+}
+
+// Rollups returns at most limit rollups of the events of eventType
+// sent by from at resolution, whose buckets start in [since, until),
+// ordered by time.
+func (s *EventStore) Rollups(ctx context.Context, resolution string, from string, eventType string, since int64, until int64, limit int) ([]*Rollup, error) {
+	if _, ok := rollupResolutions[resolution]; !ok {
+		return nil, ErrUnknownResolution
+	}
+
+	prefix, err := RollupStreamPrefix(resolution, from, eventType)
+	if err != nil {
+		// No rollup can be stored with such a source or type
+		return nil, nil
+	}
+
+	it, err := s.Backend.NewIterator(ctx, IteratorOptions{
+		Start: appendTimestamp(append([]byte(nil), prefix...), since),
+		End:   appendTimestamp(append([]byte(nil), prefix...), until),
+		Limit: limit,
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	var rollups []*Rollup
+	for it.Next() {
+		rollup, err := DecodeRollupKvPair(it.Key(), it.Value())
+		if err != nil {
+			return nil, err
+		}
+		rollups = append(rollups, rollup)
+	}
+
+	return rollups, it.Err()
+}
+
+// scan calls fn with every stored event matching filter whose
+// position, it's key in the scanned keyspace, is greater than after,
+// until fn returns false.
+func (s *EventStore) scan(ctx context.Context, filter *EventFilter, after []byte, fn func(position []byte, key []byte, event *Event) bool) error {
+	opts, indexed, err := filter.iteratorOptions()
+	if err != nil {
+		// No event can be stored with such a source or type
+		return nil
+	}
+
+	// Resume right after the cursor position
+	if after != nil {
+		if resume := append(append([]byte(nil), after...), 0x00); bytes.Compare(resume, opts.Start) > 0 {
+			opts.Start = resume
+		}
+	}
+
+	if indexed {
+		return s.scanIndex(ctx, filter, opts, fn)
+	}
+
+	it, err := s.Backend.NewIterator(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+
+	for it.Next() {
+		key := it.Key()
+
+		event, err := DecodeEventKvPair(key, it.Value())
+		if err != nil {
+			return err
+		}
+
+		if !filter.Match(event) {
+			continue
+		}
+
+		if !fn(key, key, event) {
+			break
+		}
+	}
+
+	return it.Err()
+}
+
+// scanIndex calls fn with every stored event matching filter an
+// index entry within opts points to, until fn returns false. Events
+// are fetched in batches of STORAGE_BATCH_SIZE.
+func (s *EventStore) scanIndex(ctx context.Context, filter *EventFilter, opts IteratorOptions, fn func(position []byte, key []byte, event *Event) bool) error {
+	it, err := s.Backend.NewIterator(ctx, opts)
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+
+	for {
+		var positions, keys [][]byte
+		for len(keys) < STORAGE_BATCH_SIZE && it.Next() {
+			positions = append(positions, it.Key())
+			keys = append(keys, it.Value())
+		}
+
+		if len(keys) == 0 {
+			return it.Err()
+		}
+
+		values, err := s.Backend.MGet(ctx, keys)
+		if err != nil {
+			return err
+		}
+
+		for index, value := range values {
+			// Skip entries pointing to events deleted meanwhile
+			if value == nil {
+				continue
+			}
+
+			event, err := DecodeEventKvPair(keys[index], value)
+			if err != nil {
+				return err
+			}
+
+			if !filter.Match(event) {
+				continue
+			}
+
+			if !fn(positions[index], keys[index], event) {
+				return nil
+			}
+		}
+	}
+}
+
+// forEachEventStream calls fn with the source, type and key prefix
+// of every events stream stored in backend, in key order, until fn
+// returns an error. Streams are looked up one at a time, so that no
+// snapshot is held while fn runs.
+func forEachEventStream(ctx context.Context, backend StorageBackend, fn func(from string, eventType string, prefix []byte) error) error {
+	start := []byte{EVENTS_KEYSPACE}
+
+	for {
+		key, err := firstKey(ctx, backend, IteratorOptions{Start: start, Prefix: []byte{EVENTS_KEYSPACE}})
+		if err != nil || key == nil {
+			return err
+		}
+
+		eventKey, err := DecodeEventKey(key)
+		if err != nil {
+			start = append(key, 0x00)
+			continue
+		}
+
+		prefix, err := EventStreamPrefix(eventKey.From, eventKey.Type)
+		if err != nil {
+			return err
+		}
+
+		if err := fn(eventKey.From, eventKey.Type, prefix); err != nil {
+			return err
+		}
+
+		// Jump to the next stream
+		start = prefixSuccessor(prefix)
+		if start == nil {
+			return nil
+		}
+	}
+}
+
+func parseCursor(cursor string) ([]byte, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+
+	after, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	return after, nil
+}
@@ -0,0 +1,53 @@
+package happening
+
+import (
+	"encoding/json"
+	"math"
+	"strconv"
+)
+
+// EventValue holds the optional reading carried by an event,
+// which is either a number or a text.
+type EventValue struct {
+	Numeric bool
+	Number  float64
+	Text    string
+}
+
+// NewNumericValue builds a numeric EventValue.
+func NewNumericValue(number float64) *EventValue {
+	return &EventValue{Numeric: true, Number: number}
+}
+
+// NewTextValue builds a textual EventValue.
+func NewTextValue(text string) *EventValue {
+	return &EventValue{Text: text}
+}
+
+// ParseEventValue builds an EventValue from it's raw representation,
+// which is numeric whenever it can be parsed as a finite float.
+func ParseEventValue(raw string) *EventValue {
+	number, err := strconv.ParseFloat(raw, 64)
+	if err == nil && !math.IsInf(number, 0) && !math.IsNaN(number) {
+		return NewNumericValue(number)
+	}
+
+	return NewTextValue(raw)
+}
+
+// String returns the EventValue raw representation.
+func (v *EventValue) String() string {
+	if v.Numeric {
+		return strconv.FormatFloat(v.Number, 'g', -1, 64)
+	}
+	return v.Text
+}
+
+// MarshalJSON encodes numeric values as json numbers
+// and textual values as json strings.
+func (v *EventValue) MarshalJSON() ([]byte, error) {
+	if v.Numeric {
+		return json.Marshal(v.Number)
+	}
+	return json.Marshal(v.Text)
+}
@@ -1,21 +1,41 @@
 package happening
 
 import (
-	"errors"
+	"bytes"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 )
 
-// Event represents a event sent by the source
+// EventError is returned when an event is rejected, and
+// holds the error code reported back to the event source.
+type EventError struct {
+	Code    int
+	Message string
+}
+
+func (e *EventError) Error() string {
+	return e.Message
+}
+
+// Event represents a event sent by the source. Besides it's source,
+// timestamp and type, an event may carry a value and attributes.
 type Event struct {
-	raw string
+	raw       string
+	seq       uint64
+	lsn       uint64
+	stored    chan error
+	signature string // remembered by Authenticator.Verify
+
+	From       string `json:"from"`
+	SentOn     int64  `json:"sent_on"`
+	ReceivedOn int64  `json:"received_on"`
+	Type       string `json:"type"`
 
-	From       string
-	SentOn     int64
-	ReceivedOn int64
-	Type       string
+	Value      *EventValue       `json:"value,omitempty"`
+	Attributes map[string]string `json:"attributes,omitempty"`
 }
 
 // NewEvent initializes an event from it's component
@@ -25,13 +45,14 @@ func NewEvent(from string, sentOn int64, receivedOn int64, eventType string) *Ev
 		SentOn:     sentOn,
 		ReceivedOn: receivedOn,
 		Type:       eventType,
+		seq:        nextEventSequence(),
 	}
 }
 
 // NewEventFromRaw initializes an Event from it's raw representation
 // which MSG_DELIMITER has been removed from.
 func NewEventFromRaw(raw string) (*Event, error) {
-	event := new(Event)
+	event := &Event{seq: nextEventSequence()}
 	err := event.FromRaw(raw)
 	if err != nil {
 		return nil, err
@@ -44,24 +65,126 @@ func NewEventFromRaw(raw string) (*Event, error) {
 // from it's raw description. As event flow splits event messages
 // based on the MSG_DELIMITER and discards it, the method artificially
 // restores the MSG_DELIMITER in Event.raw attribute.
+//
+// The raw description is made of EVENT_PARAMS_SEPARATOR separated
+// fields: the source, timestamp and type, optionally followed by a
+// value, numeric or textual, and key=value attributes:
+//
+//	from|timestamp|type[|value[|key=value...]]
 func (e *Event) FromRaw(raw string) error {
 	e.raw = raw + MSG_DELIMITER // Keep track of the raw version with MSG_DELIMITER
 	parts := strings.Split(strings.Trim(raw, MSG_DELIMITER), string(EVENT_PARAMS_SEPARATOR))
 
-	if len(parts) == 3 {
+	if len(parts) >= 3 {
 		e.From = parts[0]
 		e.ReceivedOn = time.Now().Unix()
 		e.Type = parts[2]
 
 		sentOn, err := strconv.Atoi(parts[1])
 		if err != nil {
-			return errors.New(fmt.Sprintf("[Event.FromRaw] Couldn't parse timestamp: %s", err))
+			return &EventError{
+				Code:    NACK_INVALID_TIMESTAMP,
+				Message: fmt.Sprintf("[Event.FromRaw] Couldn't parse timestamp: %s", err),
+			}
 		} else {
 			e.SentOn = int64(sentOn)
 		}
+
+		if len(parts) > 3 && parts[3] != "" {
+			e.Value = ParseEventValue(parts[3])
+		}
+
+		if len(parts) > 4 {
+			e.Attributes = make(map[string]string, len(parts)-4)
+		}
+
+		for index := 4; index < len(parts); index++ {
+			separator := strings.IndexByte(parts[index], EVENT_ATTRIBUTE_SEPARATOR)
+			if separator <= 0 {
+				return &EventError{
+					Code:    NACK_INVALID_ATTRIBUTE,
+					Message: fmt.Sprintf("[Event.FromRaw] Couldn't parse attribute: %q", parts[index]),
+				}
+			}
+
+			e.Attributes[parts[index][:separator]] = parts[index][separator+1:]
+		}
 	} else {
-		return errors.New(fmt.Sprintf("[%s.FromRaw] Incomplete event received: %s", "Event", e.raw))
+		return &EventError{
+			Code:    NACK_MALFORMED_EVENT,
+			Message: fmt.Sprintf("[%s.FromRaw] Incomplete event received: %s", "Event", e.raw),
+		}
 	}
 
 	return nil
 }
+
+// String returns the Event representation in the
+// events wire format, without MSG_DELIMITER.
+func (e *Event) String() string {
+	var buf bytes.Buffer
+
+	fmt.Fprintf(&buf, "%s%c%d%c%s", e.From, EVENT_PARAMS_SEPARATOR, e.SentOn, EVENT_PARAMS_SEPARATOR, e.Type)
+
+	if e.Value != nil || len(e.Attributes) > 0 {
+		buf.WriteByte(EVENT_PARAMS_SEPARATOR)
+		if e.Value != nil {
+			buf.WriteString(e.Value.String())
+		}
+	}
+
+	keys := make([]string, 0, len(e.Attributes))
+	for key := range e.Attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		fmt.Fprintf(&buf, "%c%s%c%s", EVENT_PARAMS_SEPARATOR, key, EVENT_ATTRIBUTE_SEPARATOR, e.Attributes[key])
+	}
+
+	return buf.String()
+}
+
+// awaitStorage marks the event as expecting to be notified
+// once it has been persisted, see WaitStored.
+func (e *Event) awaitStorage() {
+	e.stored = make(chan error, 1)
+}
+
+// markStored notifies the event persistence outcome
+// to whoever awaits it.
+func (e *Event) markStored(err error) {
+	if e.stored == nil {
+		return
+	}
+
+	select {
+	case e.stored <- err:
+	default:
+	}
+}
+
+// WaitStored blocks until the event has been persisted, or timeout
+// expires, and returns the persistence error if any.
+func (e *Event) WaitStored(timeout time.Duration) error {
+	if e.stored == nil {
+		return nil
+	}
+
+	select {
+	case err := <-e.stored:
+		return err
+	default:
+	}
+
+	select {
+	case err := <-e.stored:
+		return err
+	case <-time.After(timeout):
+		return &EventError{
+			Code:    NACK_STORAGE_TIMEOUT,
+			Message: fmt.Sprintf("[Event.WaitStored] %s not stored after %s", e, timeout),
+		}
+	}
+}
@@ -2,18 +2,82 @@ package happening
 
 import (
 	"bytes"
+	"crypto/tls"
 	"fmt"
 	l4g "github.com/alecthomas/log4go"
 	"net"
-	"strings"
+	"sync"
 	"time"
 )
 
+// EventsHandler is a NetworkService receiving events from the
+// events sources connexions.
+//
+// Events frames are decoded using the EventsHandler Codec. Unless
+// AckMode is ACK_MODE_NONE, every event frame received is answered,
+// in order, on the source connexion with either:
+//
+//	ACK\r\n
+//	NACK|<code>|<reason>\r\n
+//
+// In ACK_MODE_RECEIVED events are acknowledged as soon as they are
+// queued, in ACK_MODE_STORED once they have been persisted.
+//
+// When the EventsHandler has a Wal, events are appended to it
+// before being queued, so they survive a crash until stored. The
+// records of events the queue refuses or drops are cancelled, so
+// that they're not recovered after a crash.
+//
+// When the EventsHandler TLSConfig requires clients certificates,
+// the common name of a source certificate is it's trusted identity,
+// and overrides the From of the events it sends.
+//
+// When the EventsHandler has Alerts, every queued event, received
+// or injected, is evaluated against the alert rules before being
+// published, so that alerts never miss events the way live
+// listeners may.
+//
+// When the EventsHandler has an Auth, events sources are required to
+// authenticate as known nodes, and events failing verification are
+// refused.
+//
+// Events exceeding the AddrLimiter rate limit of the host they are
+// sent from, or the FromLimiter rate limit of their From, are handled
+// according to LimitAction:
+//
+//   - RATE_LIMIT_ACTION_DROP: the event is discarded, but acknowledged
+//     as if it was received so that the source does not retry it
+//   - RATE_LIMIT_ACTION_NACK: the event is refused
+//   - RATE_LIMIT_ACTION_DISCONNECT: the event is refused, and the
+//     source connexion closed
+//
+// Sources sending a line longer than MaxLineLength are refused and
+// disconnected, as the events stream can't be resynchronized.
 type EventsHandler struct {
 	NetworkService
 	Queue         *Queue
-	Buffer        []byte
 	EventsChannel chan *Event
+	AckMode       string
+	Codec         EventCodec
+	Wal           *WriteAheadLog
+	Auth          *Authenticator
+	Nodes         *NodeRegistry
+	Alerts        *AlertService
+	AddrLimiter   *RateLimiter
+	FromLimiter   *RateLimiter
+	LimitAction   string
+	MaxLineLength int
+
+	// walMu keeps the queue in the write-ahead log order
+	walMu sync.Mutex
+}
+
+// EventsSource describes where events are received from: the
+// remote address they are sent from, and the trusted identity of
+// the node sending them, if known.
+type EventsSource struct {
+	Addr     string
+	Identity string
 }
 
 // NewEventsHandler initializes an EventsHandler.
@@ -21,7 +85,11 @@ func NewEventsHandler() *EventsHandler {
 	return &EventsHandler{
 		NetworkService: *NewNetworkService("EventsHandler"),
 		Queue:          NewQueue(EVENTS_QUEUE_SIZE),
-		EventsChannel:  make(chan *Event),
+		EventsChannel:  make(chan *Event, EVENTS_CHANNEL_SIZE),
+		AckMode:        DEFAULT_ACK_MODE,
+		Codec:          PipeCodec{},
+		LimitAction:    DEFAULT_LIMIT_ACTION,
+		MaxLineLength:  DEFAULT_MAX_LINE_LENGTH,
 	}
 }
 
@@ -40,7 +108,6 @@ func (m *EventsHandler) Serve() {
 		// signal has been sent, set sync as done
 		// and goroutine ready to be collected
 		case <-m.ch:
-			close(m.ConnexionsLifeline)
 			close(eventsState)
 			return
 		// Otherwise, process the events source connection and events
@@ -53,88 +120,345 @@ func (m *EventsHandler) Serve() {
 
 // HandleEvents should be run as a long-running goroutine to listen
 // on the EventsHandler source and process incoming events.
-// It reads on the socket, maintain the EventsHandler buffer,
-// extracts the message from the buffer, instantiates Events,
-// and pushes them to the PriorityQueue.
-func (m *EventsHandler) HandleEvents(eventsState chan bool, source *net.TCPConn) {
+// It reads on the socket through a FrameReader of it's own,
+// extracts the events frames, instantiates Events, pushes them
+// to the PriorityQueue and acknowledges them.
+func (m *EventsHandler) HandleEvents(eventsState chan bool, source net.Conn) {
 	defer m.waitGroup.Done()
 	defer source.Close()
 
+	identity, err := m.authenticate(source)
+	eventsSource := &EventsSource{Addr: source.RemoteAddr().String(), Identity: identity}
+	if err != nil {
+		l4g.Error(fmt.Sprintf("[%s.HandleEvents] Refusing events source %s: %s", m.name, source.RemoteAddr(), err))
+		return
+	}
+
+	// Connexions start with an authentication handshake
+	// when events sources authenticate using tokens.
+	handshaken := m.Auth == nil || !m.Auth.RequiresHandshake()
+
+	reader := NewFrameReader(source, m.Codec, m.MaxLineLength)
+
 	for {
 		select {
 		case <-eventsState:
 			return
 		default:
-			socketInput := make([]byte, EVENTS_FLOW_BUF_SIZE)
-
 			source.SetDeadline(time.Now().Add(time.Duration(EVENT_FLOW_TIMEOUT) * time.Second))
 			// Await for client id to be sent
-			readLen, err := source.Read(socketInput)
-			if err != nil {
-				if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
+			if err := reader.Fill(); err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
 					continue
 				}
 				l4g.Error(fmt.Sprintf("[%s.HandleEvents] Events source connexion closed", m.name))
 				return
 			}
 
-			items := m.ExtractEventsFromSocketInput(socketInput, readLen)
-			go m.PushEventsToQueue(items)
+			frames, err := reader.Frames()
+			if !handshaken && len(frames) > 0 {
+				node, authErr := m.handshake(source, frames[0], eventsSource.Identity)
+				if authErr != nil {
+					l4g.Error(fmt.Sprintf("[%s.HandleEvents] Refusing events source %s: %s", m.name, source.RemoteAddr(), authErr))
+					return
+				}
+				eventsSource.Identity, handshaken, frames = node, true, frames[1:]
+			}
+
+			events, errs := m.PushEventsToQueue(m.Codec, frames, eventsSource)
+
+			if ackErr := m.Acknowledge(source, events, errs); ackErr != nil {
+				l4g.Error(fmt.Sprintf("[%s.HandleEvents] Unable to acknowledge events: %s", m.name, ackErr))
+				return
+			}
+
+			if m.LimitAction == RATE_LIMIT_ACTION_DISCONNECT && rateLimited(errs) {
+				l4g.Warn(fmt.Sprintf("[%s.HandleEvents] Disconnecting rate limited events source %s", m.name, source.RemoteAddr()))
+				return
+			}
+
+			// The stream can't be resynchronized after
+			// a framing error, so let's drop the source.
+			if err != nil {
+				l4g.Error(fmt.Sprintf("[%s.HandleEvents] Invalid events stream: %s", m.name, err))
+				if _, ok := err.(*EventError); ok && m.AckMode != ACK_MODE_NONE {
+					source.SetWriteDeadline(time.Now().Add(time.Duration(EVENT_ACK_WRITE_TIMEOUT) * time.Second))
+					source.Write([]byte(acknowledgement(err)))
+				}
+				return
+			}
 		}
 	}
 }
 
-func (m *EventsHandler) ExtractEventsFromSocketInput(input []byte, readLen int) []string {
-	// In order to protect the events splitted accross two
-	// socket read buffers, we copy the eventual rest and the
-	// newly received data into a new buffer removing zero
-	// bytes from the actual socket buffer
-	data := make([]byte, readLen+len(m.Buffer))
-	copy(data, m.Buffer)
-	copy(data[len(m.Buffer):], input[:readLen])
-	m.Buffer = []byte{} // reinitialize to empty
+// authenticate completes the TLS handshake of a source connexion,
+// if served over TLS, and returns the source trusted identity: the
+// common name of it's verified certificate, if any.
+func (m *EventsHandler) authenticate(source net.Conn) (string, error) {
+	tlsSource, ok := source.(*tls.Conn)
+	if !ok {
+		return "", nil
+	}
 
-	// Was the socket buffer ended with an incomplete
-	// event message? And was the actual content of buffer
-	// ended with the msg delimiter?
-	isIncomplete := !bytes.HasSuffix(input, []byte(MSG_DELIMITER)) && input[len(input)-1] != byte(0)
-	isBackslashEnded := bytes.Compare(data[len(data)-len(MSG_DELIMITER):], []byte(MSG_DELIMITER)) == 0
+	tlsSource.SetDeadline(time.Now().Add(time.Duration(EVENT_TLS_HANDSHAKE_TIMEOUT) * time.Second))
+	if err := tlsSource.Handshake(); err != nil {
+		return "", err
+	}
 
-	// extract events from the input data
-	items := strings.Split(string(data), MSG_DELIMITER)
+	if m.TLSConfig.ClientAuth != tls.RequireAndVerifyClientCert {
+		return "", nil
+	}
 
-	// If socket buffer was ended with an incomplete message
-	// push the rest in the EventsHandler buffer, and remove
-	// last event extracted as it is incomplete.
-	// Else, if the last event found was actually ended with
-	// MSG_DELIMITER, strings.Split will return an empty string
-	// elem after it, so let's remove it.
-	if isIncomplete {
-		m.Buffer = []byte(items[len(items)-1])
-		items = items[:len(items)-1]
-	} else if isBackslashEnded {
-		items = items[:len(items)-1]
+	identity := tlsSource.ConnectionState().PeerCertificates[0].Subject.CommonName
+	if identity == "" {
+		return "", fmt.Errorf("client certificate has no common name")
 	}
 
-	return items
+	return identity, nil
 }
 
-// PushEventsToQueue adds a list of Event instances to
-// the EventsHandler PriorityQueue.
-func (m *EventsHandler) PushEventsToQueue(events []string) {
-	for _, event := range events {
-		event, err := NewEventFromRaw(event)
+// handshake verifies the authentication handshake frame of a source
+// connexion, whose trusted identity may already be known, and replies
+// to it unless AckMode is ACK_MODE_NONE. It returns the authenticated
+// node.
+func (m *EventsHandler) handshake(source net.Conn, frame []byte, identity string) (string, error) {
+	node, err := m.Auth.Handshake(frame, identity)
+
+	if m.AckMode != ACK_MODE_NONE {
+		source.SetWriteDeadline(time.Now().Add(time.Duration(EVENT_ACK_WRITE_TIMEOUT) * time.Second))
+		if _, writeErr := source.Write([]byte(acknowledgement(err))); writeErr != nil && err == nil {
+			err = writeErr
+		}
+	}
+
+	return node, err
+}
+
+// PushEventsToQueue decodes a list of event frames using eventCodec
+// and adds the resulting Event instances to the EventsHandler
+// PriorityQueue. The trusted identity of the events source, if
+// known, overrides their From. Events exceeding the address rate limit
+// are handled according to LimitAction, events failing the Auth
+// verification, if any, are refused, and only then are events
+// exceeding the From rate limit handled according to LimitAction. The
+// queued ones are recorded in the Nodes registry, if any. It returns,
+// for each frame, either the queued Event or the error it was rejected
+// with.
+func (m *EventsHandler) PushEventsToQueue(eventCodec EventCodec, frames [][]byte, source *EventsSource) ([]*Event, []error) {
+	events := make([]*Event, len(frames))
+	errs := make([]error, len(frames))
+
+	host := addrHost(source.Addr)
+	for index, frame := range frames {
+		if m.AddrLimiter != nil && !m.AddrLimiter.Allow(host, time.Now()) {
+			errs[index] = m.rateLimit(fmt.Sprintf("events from %s", host))
+			continue
+		}
+
+		event, err := eventCodec.Decode(frame)
 		if err != nil {
 			l4g.Error(fmt.Sprintf("[%s.PushEventsToQueue] %s", m.name, err))
+			errs[index] = err
 			continue
 		}
 
+		if source.Identity != "" {
+			event.From = source.Identity
+		}
+
+		if m.Auth != nil {
+			if err := m.Auth.Verify(event, source.Identity, time.Now().Unix()); err != nil {
+				l4g.Error(fmt.Sprintf("[%s.PushEventsToQueue] Refusing %s: %s", m.name, event, err))
+				errs[index] = err
+				continue
+			}
+		}
+
+		// From is only limited once authenticated, so that
+		// no source can exhaust the budget of another node.
+		if m.FromLimiter != nil && !m.FromLimiter.Allow(event.From, time.Now()) {
+			m.forget(event)
+			errs[index] = m.rateLimit(fmt.Sprintf("events from node %q", event.From))
+			continue
+		}
+
+		if m.AckMode == ACK_MODE_STORED {
+			event.awaitStorage()
+		}
+
+		if err := m.enqueue(event); err != nil {
+			l4g.Error(fmt.Sprintf("[%s.PushEventsToQueue] Unable to queue %s: %s", m.name, event, err))
+			m.forget(event)
+			errs[index] = err
+			continue
+		}
+		events[index] = event
+
 		l4g.Info(fmt.Sprintf("[%s.PushEventsToQueue] %s inserted in queue", m.name, event))
-		m.Queue.Push(event)
+		m.observe(event)
+		m.publish(event)
 
-		// Send event in events channel for listener
-		// to be notified of the event pushed to queue
-		// the forwarder for example.
-		go func() { m.EventsChannel <- event }()
+		if m.Nodes != nil {
+			m.Nodes.Record(event, source.Addr)
+		}
 	}
+
+	return events, errs
+}
+
+// rateLimit logs the rate limited events described by what, and
+// returns the error they should be answered with according to the
+// LimitAction, nil when they are dropped.
+func (m *EventsHandler) rateLimit(what string) error {
+	if m.LimitAction == RATE_LIMIT_ACTION_DROP {
+		l4g.Debug(fmt.Sprintf("[%s.PushEventsToQueue] Dropping %s: %s", m.name, what, ErrRateLimited))
+		return nil
+	}
+
+	l4g.Warn(fmt.Sprintf("[%s.PushEventsToQueue] Refusing %s: %s", m.name, what, ErrRateLimited))
+	return &EventError{Code: NACK_RATE_LIMITED, Message: fmt.Sprintf("%s: %s", ErrRateLimited, what)}
+}
+
+// Inject pushes an event generated by the happening itself, an
+// alert for example, into the events pipeline, just like a received
+// one: it is queued for storage and published to the live listeners.
+func (m *EventsHandler) Inject(event *Event) error {
+	if err := m.enqueue(event); err != nil {
+		return err
+	}
+	m.observe(event)
+	m.publish(event)
+
+	return nil
+}
+
+// forget forgets the signature of an event refused after it's
+// verification, if any, so that it may be sent again.
+func (m *EventsHandler) forget(event *Event) {
+	if m.Auth != nil {
+		m.Auth.Forget(event)
+	}
+}
+
+// observe evaluates the Alerts rules, if any, against a queued event.
+func (m *EventsHandler) observe(event *Event) {
+	if m.Alerts != nil {
+		m.Alerts.Record(event)
+	}
+}
+
+// publish sends a queued event in the events channel, for
+// listeners to be notified of the event pushed to queue, the
+// subscriptions hub for example. It never blocks ingestion when
+// no listener keeps up with the events flow.
+func (m *EventsHandler) publish(event *Event) {
+	select {
+	case m.EventsChannel <- event:
+	default:
+	}
+}
+
+// enqueue appends an event to the EventsHandler write-ahead log,
+// if any, and pushes it to the queue. The event awaiting storage
+// which the queue dropped on overflow, if any, is notified it
+// won't be persisted. An event refused or dropped by the queue
+// is returned a NACK_QUEUE_FULL EventError. Either way, the
+// write-ahead log record of the event left out is cancelled.
+func (m *EventsHandler) enqueue(event *Event) error {
+	m.walMu.Lock()
+	defer m.walMu.Unlock()
+
+	if m.Wal != nil {
+		lsn, err := m.Wal.Append(EncodeWalEvent(event))
+		if err != nil {
+			return &EventError{Code: NACK_STORAGE_FAILURE, Message: err.Error()}
+		}
+		event.lsn = lsn
+	}
+
+	node, err := m.Queue.Push(event)
+	if err != nil {
+		m.cancel(event)
+		return &EventError{Code: NACK_QUEUE_FULL, Message: err.Error()}
+	}
+
+	if dropped, ok := node.(*Event); ok {
+		l4g.Warn(fmt.Sprintf("[%s.enqueue] Queue full, %s dropped", m.name, dropped))
+		m.cancel(dropped)
+		m.forget(dropped)
+		dropped.markStored(&EventError{Code: NACK_QUEUE_FULL, Message: ErrQueueFull.Error()})
+	}
+
+	return nil
+}
+
+// cancel cancels the write-ahead log record of an event
+// which won't be persisted, if any.
+func (m *EventsHandler) cancel(event *Event) {
+	if m.Wal == nil || event.lsn == 0 {
+		return
+	}
+
+	if err := m.Wal.Cancel(event.lsn); err != nil {
+		l4g.Error(fmt.Sprintf("[%s.cancel] Unable to cancel %s write-ahead log record: %s", m.name, event, err))
+	}
+}
+
+// Acknowledge replies to the events source, in order, with an ACK
+// for each successfully received event and a NACK for each rejected
+// one. In ACK_MODE_STORED, it blocks until received events have been
+// persisted.
+func (m *EventsHandler) Acknowledge(source net.Conn, events []*Event, errs []error) error {
+	if m.AckMode == ACK_MODE_NONE || len(events) == 0 {
+		return nil
+	}
+
+	var replies bytes.Buffer
+	deadline := time.Now().Add(time.Duration(EVENT_STORED_TIMEOUT) * time.Second)
+	for index, event := range events {
+		err := errs[index]
+		// Dropped events have neither event nor error
+		if err == nil && event != nil && m.AckMode == ACK_MODE_STORED {
+			err = event.WaitStored(deadline.Sub(time.Now()))
+		}
+
+		replies.WriteString(acknowledgement(err))
+	}
+
+	source.SetWriteDeadline(time.Now().Add(time.Duration(EVENT_ACK_WRITE_TIMEOUT) * time.Second))
+	_, err := source.Write(replies.Bytes())
+
+	return err
+}
+
+// acknowledgement returns the reply to an event
+// received with the err outcome.
+func acknowledgement(err error) string {
+	if err == nil {
+		return ACK_MSG + MSG_DELIMITER
+	}
+
+	code := NACK_MALFORMED_EVENT
+	if eventErr, ok := err.(*EventError); ok {
+		code = eventErr.Code
+	}
+
+	return fmt.Sprintf("%s%c%d%c%s%s",
+		NACK_MSG, EVENT_PARAMS_SEPARATOR,
+		code, EVENT_PARAMS_SEPARATOR,
+		nackReasons[code], MSG_DELIMITER)
+}
+
+// nackReasons holds the human readable reason sent
+// along with each negative acknowledgement code.
+var nackReasons = map[int]string{
+	NACK_MALFORMED_EVENT:   "malformed event",
+	NACK_INVALID_TIMESTAMP: "invalid timestamp",
+	NACK_STORAGE_FAILURE:   "storage failure",
+	NACK_STORAGE_TIMEOUT:   "storage timeout",
+	NACK_INVALID_ATTRIBUTE: "invalid attribute",
+	NACK_QUEUE_FULL:        "queue full",
+	NACK_AUTH_FAILED:       "authentication failed",
+	NACK_RATE_LIMITED:      "rate limited",
+	NACK_FRAME_TOO_LONG:    "frame too long",
 }
@@ -0,0 +1,304 @@
+package happening
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// connectTestEventsHandler serves an in-memory connexion with handler,
+// over TLS when it's TLSConfig is set, and returns it's client side,
+// along with a channel closed once the handler is done with it.
+func connectTestEventsHandler(t *testing.T, handler *EventsHandler) (net.Conn, chan struct{}) {
+	t.Helper()
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+
+	var source net.Conn = server
+	if handler.TLSConfig != nil {
+		source = tls.Server(server, handler.TLSConfig)
+	}
+
+	handler.waitGroup.Add(1)
+	go func() {
+		handler.HandleEvents(make(chan bool), source)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		client.Close()
+		<-done
+	})
+
+	return client, done
+}
+
+// sendFrames writes raw events frames to a connexion in background,
+// as the handler may answer them before they are all read.
+func sendFrames(conn net.Conn, frames string) {
+	go conn.Write([]byte(frames))
+}
+
+// readReplies reads count acknowledgements from a connexion,
+// without their delimiter.
+func readReplies(t *testing.T, reader *bufio.Reader, conn net.Conn, count int) []string {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	defer conn.SetReadDeadline(time.Time{})
+
+	replies := make([]string, 0, count)
+	for len(replies) < count {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("reading acknowledgements %q: %s", replies, err)
+		}
+		replies = append(replies, strings.TrimSuffix(line, MSG_DELIMITER))
+	}
+
+	return replies
+}
+
+// awaitQueued waits for count events to be queued by handler,
+// and pops them.
+func awaitQueued(t *testing.T, handler *EventsHandler, count int) []*Event {
+	t.Helper()
+
+	deadline := time.Now().Add(time.Second)
+	for handler.Queue.Len() < count {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d events queued, want %d", handler.Queue.Len(), count)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	events := make([]*Event, 0, count)
+	for handler.Queue.Len() > 0 {
+		events = append(events, handler.Queue.Pop().(*Event))
+	}
+
+	return events
+}
+
+// assertSilent checks no reply is pending on a connexion.
+func assertSilent(t *testing.T, conn net.Conn) {
+	t.Helper()
+
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	defer conn.SetReadDeadline(time.Time{})
+
+	buffer := make([]byte, 64)
+	if n, err := conn.Read(buffer); err == nil {
+		t.Errorf("unexpected reply %q", buffer[:n])
+	}
+}
+
+// equalReplies returns whether two lists of acknowledgements are equal.
+func equalReplies(a []string, b []string) bool {
+	return strings.Join(a, MSG_DELIMITER) == strings.Join(b, MSG_DELIMITER)
+}
+
+const testAcknowledgedFrames = "kitchen|1392821124|temperature|21.5\r\n" +
+	"kitchen\r\n" +
+	"kitchen|yesterday|temperature\r\n" +
+	"kitchen|1392821124|temperature|21.5|unit\r\n" +
+	"cellar|1392821124|temperature|12|unit=celsius\r\n"
+
+func TestEventsHandlerAckModeReceived(t *testing.T) {
+	handler := NewEventsHandler()
+	client, _ := connectTestEventsHandler(t, handler)
+
+	sendFrames(client, testAcknowledgedFrames)
+	replies := readReplies(t, bufio.NewReader(client), client, 5)
+
+	want := []string{
+		"ACK",
+		"NACK|1|malformed event",
+		"NACK|2|invalid timestamp",
+		"NACK|5|invalid attribute",
+		"ACK",
+	}
+	if !equalReplies(replies, want) {
+		t.Errorf("acknowledgements = %q, want %q", replies, want)
+	}
+	if queued := handler.Queue.Len(); queued != 2 {
+		t.Errorf("%d events queued, want 2", queued)
+	}
+}
+
+func TestEventsHandlerAckModeStored(t *testing.T) {
+	handler := NewEventsHandler()
+	handler.AckMode = ACK_MODE_STORED
+	client, _ := connectTestEventsHandler(t, handler)
+
+	sendFrames(client, testAcknowledgedFrames)
+	events := awaitQueued(t, handler, 2)
+
+	// Nothing is acknowledged until the queued events are persisted
+	assertSilent(t, client)
+
+	events[0].markStored(nil)
+	events[1].markStored(&EventError{Code: NACK_STORAGE_FAILURE, Message: "disk full"})
+	replies := readReplies(t, bufio.NewReader(client), client, 5)
+
+	want := []string{
+		"ACK",
+		"NACK|1|malformed event",
+		"NACK|2|invalid timestamp",
+		"NACK|5|invalid attribute",
+		"NACK|3|storage failure",
+	}
+	if !equalReplies(replies, want) {
+		t.Errorf("acknowledgements = %q, want %q", replies, want)
+	}
+}
+
+func TestEventsHandlerAckModeNone(t *testing.T) {
+	handler := NewEventsHandler()
+	handler.AckMode = ACK_MODE_NONE
+	client, done := connectTestEventsHandler(t, handler)
+
+	sendFrames(client, testAcknowledgedFrames)
+	awaitQueued(t, handler, 2)
+	assertSilent(t, client)
+
+	// Framing errors close the connexion without a reply either
+	sendFrames(client, strings.Repeat("x", DEFAULT_MAX_LINE_LENGTH+1)+MSG_DELIMITER)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("connexion still open after a framing error")
+	}
+	assertSilent(t, client)
+}
+
+// testCertificate issues a certificate for commonName, signed by
+// parent, or self-signed as a certificate authority when nil.
+func testCertificate(t *testing.T, commonName string, parent *tls.Certificate) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	signer, signerKey := template, interface{}(key)
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// writeTestCertificate writes a certificate and it's key as PEM
+// encoded files of dir, and returns their paths.
+func writeTestCertificate(t *testing.T, dir string, name string, certificate tls.Certificate) (string, string) {
+	t.Helper()
+
+	certFile := filepath.Join(dir, name+".crt")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: certificate.Certificate[0]}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(certificate.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, name+".key")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile
+}
+
+func TestEventsHandlerClientCertificateIdentity(t *testing.T) {
+	dir := t.TempDir()
+	ca := testCertificate(t, "happening ca", nil)
+	caFile, _ := writeTestCertificate(t, dir, "ca", ca)
+	certFile, keyFile := writeTestCertificate(t, dir, "server", testCertificate(t, "localhost", &ca))
+
+	tlsConfig, err := BuildTlsConfig(certFile, keyFile, caFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	clientConfig := &tls.Config{
+		RootCAs:      roots,
+		ServerName:   "localhost",
+		Certificates: []tls.Certificate{testCertificate(t, "kitchen", &ca)},
+	}
+
+	handler := NewEventsHandler()
+	handler.TLSConfig = tlsConfig
+	conn, _ := connectTestEventsHandler(t, handler)
+	client := tls.Client(conn, clientConfig)
+
+	// The certificate common name overrides the events From
+	sendFrames(client, "cellar|1392821124|temperature|12\r\nkitchen|1392821124|humidity|40\r\n")
+	if replies := readReplies(t, bufio.NewReader(client), client, 2); !equalReplies(replies, []string{"ACK", "ACK"}) {
+		t.Fatalf("acknowledgements = %q, want two ACKs", replies)
+	}
+	for _, event := range awaitQueued(t, handler, 2) {
+		if event.From != "kitchen" {
+			t.Errorf("queued event from %q, want kitchen", event.From)
+		}
+	}
+
+	// Clients without a certificate are refused
+	anonymous := NewEventsHandler()
+	anonymous.TLSConfig = tlsConfig
+	conn, done := connectTestEventsHandler(t, anonymous)
+	client = tls.Client(conn, &tls.Config{RootCAs: roots, ServerName: "localhost"})
+
+	sendFrames(client, "cellar|1392821124|temperature|12\r\n")
+	client.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := client.Read(make([]byte, 64)); err == nil {
+		t.Errorf("connexion without client certificate answered")
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("connexion without client certificate still open")
+	}
+	if queued := anonymous.Queue.Len(); queued != 0 {
+		t.Errorf("%d events queued without client certificate, want 0", queued)
+	}
+}
@@ -0,0 +1,107 @@
+package happening
+
+import (
+	"io"
+)
+
+// FrameReader reads the events frames of a single events source
+// stream, delimited using an EventCodec.
+//
+// Data is read into a buffer owned by the FrameReader, which only
+// grows to hold a frame of up to MaxLength bytes, unless MaxLength is
+// zero. MaxLength doesn't count the frame delimiter, or header, which
+// may take up to EVENTS_FRAME_OVERHEAD more bytes. Frames are returned
+// as slices of this buffer, and are thus only valid until the next
+// call to Fill.
+type FrameReader struct {
+	Codec     EventCodec
+	MaxLength int
+
+	source io.Reader
+	buf    []byte
+	start  int // start of the data not split yet
+	end    int // end of the data read
+}
+
+// NewFrameReader builds a FrameReader splitting the
+// frames read from source using eventCodec.
+func NewFrameReader(source io.Reader, eventCodec EventCodec, maxLength int) *FrameReader {
+	size := EVENTS_FLOW_BUF_SIZE
+	if maxLength > 0 && maxLength+EVENTS_FRAME_OVERHEAD < size {
+		size = maxLength + EVENTS_FRAME_OVERHEAD
+	}
+
+	return &FrameReader{
+		Codec:     eventCodec,
+		MaxLength: maxLength,
+		source:    source,
+		buf:       make([]byte, size),
+	}
+}
+
+// Fill reads once from the source into the buffer, after moving the
+// incomplete trailing frame, if any, to it's start, and growing it if
+// needed. Frames previously returned by Frames are invalidated.
+func (r *FrameReader) Fill() error {
+	if r.start > 0 {
+		r.end = copy(r.buf, r.buf[r.start:r.end])
+		r.start = 0
+	}
+
+	if r.end == len(r.buf) {
+		size := 2 * len(r.buf)
+		if r.MaxLength > 0 && size > r.MaxLength+EVENTS_FRAME_OVERHEAD {
+			size = r.MaxLength + EVENTS_FRAME_OVERHEAD
+		}
+
+		buf := make([]byte, size)
+		copy(buf, r.buf[:r.end])
+		r.buf = buf
+	}
+
+	readLen, err := r.source.Read(r.buf[r.end:])
+	r.end += readLen
+
+	// Data read along with an error is split anyway, the
+	// error being returned again by the next read.
+	if readLen > 0 {
+		return nil
+	}
+
+	return err
+}
+
+// Frames splits the complete frames out of the data read so far.
+// Frames, complete or not, longer than MaxLength, unless zero, are
+// refused with ErrFrameTooLong, along with the ones found before.
+func (r *FrameReader) Frames() ([][]byte, error) {
+	var frames [][]byte
+
+	for r.start < r.end {
+		advance, frame, err := r.Codec.Split(r.buf[r.start:r.end], false)
+		if err != nil {
+			return frames, err
+		}
+
+		// No complete frame left, keep the rest
+		// to be completed by the next read.
+		if advance == 0 {
+			break
+		}
+
+		if r.MaxLength > 0 && len(frame) > r.MaxLength {
+			return frames, frameTooLong(len(frame))
+		}
+
+		frames = append(frames, frame)
+		r.start += advance
+	}
+
+	// An incomplete frame filling the buffer up can't
+	// be completed by a delimiter within MaxLength.
+	if pending := r.end - r.start; r.MaxLength > 0 && pending >= r.MaxLength+EVENTS_FRAME_OVERHEAD {
+		return frames, frameTooLong(pending)
+	}
+
+	return frames, nil
+}
@@ -0,0 +1,199 @@
+package happening
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// chunkedReader returns it's data in chunks of the sizes
+// listed by chunks, cycling through them.
+type chunkedReader struct {
+	data   []byte
+	chunks []byte
+	index  int
+}
+
+func (r *chunkedReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+
+	size := len(r.data)
+	if len(r.chunks) > 0 {
+		// A zero size chunk is an empty read
+		size = int(r.chunks[r.index%len(r.chunks)])
+		r.index++
+	}
+	if size > len(p) {
+		size = len(p)
+	}
+	if size > len(r.data) {
+		size = len(r.data)
+	}
+
+	n := copy(p, r.data[:size])
+	r.data = r.data[n:]
+
+	return n, nil
+}
+
+// randomFrame returns a random event frame for eventCodec, along
+// with it's framing, delimiter or header.
+func randomFrame(t *testing.T, random *rand.Rand, eventCodec EventCodec) ([]byte, []byte) {
+	name := func(alphabet string) string {
+		buf := make([]byte, 1+random.Intn(12))
+		for index := range buf {
+			buf[index] = alphabet[random.Intn(len(alphabet))]
+		}
+		return string(buf)
+	}
+
+	from := name("abcdefghijklmnopqrstuvwxyz-_0123456789")
+	eventType := name("abcdefghijklmnopqrstuvwxyz")
+	sentOn := 1392821124 + random.Int63n(1000000)
+	value := random.NormFloat64()
+
+	switch eventCodec.(type) {
+	case JsonCodec:
+		// Delimiters are escaped in json strings
+		frame, err := json.Marshal(map[string]interface{}{
+			"from": from, "sent_on": sentOn, "type": eventType, "value": value,
+			"attributes": map[string]string{"note": name("ab\r\n|=\"")},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return frame, []byte("\n")
+	case MsgpackCodec:
+		// Binary frames may hold any byte
+		frame := msgpackFrame(t, map[string]interface{}{
+			"from": from, "sent_on": sentOn, "type": eventType, "value": value,
+			"attributes": map[string]string{"note": name("ab\r\n\x00\xff")},
+		})
+		return frame[MSGPACK_FRAME_HEADER_SIZE:], frame[:MSGPACK_FRAME_HEADER_SIZE]
+	default:
+		return []byte(fmt.Sprintf("%s|%d|%s|%g|note=%s", from, sentOn, eventType, value, name("ab="))), []byte(MSG_DELIMITER)
+	}
+}
+
+// readFrames returns copies of the frames a FrameReader
+// splits out of source, until it's exhausted.
+func readFrames(source io.Reader, eventCodec EventCodec, maxLength int) ([][]byte, error) {
+	var frames [][]byte
+
+	reader := NewFrameReader(source, eventCodec, maxLength)
+	for {
+		err := reader.Fill()
+		if err != nil && err != io.EOF {
+			return frames, err
+		}
+
+		split, splitErr := reader.Frames()
+		for _, frame := range split {
+			frames = append(frames, append([]byte(nil), frame...))
+		}
+		if splitErr != nil {
+			return frames, splitErr
+		}
+
+		if err == io.EOF {
+			return frames, nil
+		}
+	}
+}
+
+func FuzzFrameReader(f *testing.F) {
+	f.Add(int64(1), uint8(0), uint16(10), []byte{1})
+	f.Add(int64(2), uint8(1), uint16(50), []byte{0, 3, 255, 7})
+	f.Add(int64(3), uint8(2), uint16(200), []byte{2, 1, 64})
+
+	codecs := []EventCodec{PipeCodec{}, JsonCodec{}, MsgpackCodec{}}
+
+	f.Fuzz(func(t *testing.T, seed int64, codecIndex uint8, count uint16, chunks []byte) {
+		random := rand.New(rand.NewSource(seed))
+		eventCodec := codecs[int(codecIndex)%len(codecs)]
+
+		// Empty reads only are never going anywhere
+		if bytes.Count(chunks, []byte{0}) == len(chunks) {
+			chunks = nil
+		}
+
+		var data []byte
+		var want [][]byte
+		maxLength := 0
+		for index := 0; index < int(count%500)+1; index++ {
+			frame, framing := randomFrame(t, random, eventCodec)
+			if eventCodec.Name() == CODEC_MSGPACK {
+				data = append(append(data, framing...), frame...)
+			} else {
+				data = append(append(data, frame...), framing...)
+			}
+			want = append(want, frame)
+
+			if len(frame) > maxLength {
+				maxLength = len(frame)
+			}
+		}
+
+		// The longest frame is exactly as long as allowed
+		got, err := readFrames(&chunkedReader{data: data, chunks: chunks}, eventCodec, maxLength)
+		if err != nil {
+			t.Fatalf("%s frames: %s", eventCodec.Name(), err)
+		}
+
+		if len(got) != len(want) {
+			t.Fatalf("%d %s frames read, want %d", len(got), eventCodec.Name(), len(want))
+		}
+		for index := range want {
+			if !bytes.Equal(got[index], want[index]) {
+				t.Fatalf("%s frame %d = %q, want %q", eventCodec.Name(), index, got[index], want[index])
+			}
+			if _, err := eventCodec.Decode(got[index]); err != nil {
+				t.Fatalf("%s frame %d: %s", eventCodec.Name(), index, err)
+			}
+		}
+	})
+}
+
+func TestFrameReaderMaxLength(t *testing.T) {
+	msgpackFrame := func(length int) []byte {
+		frame := make([]byte, MSGPACK_FRAME_HEADER_SIZE+length)
+		binary.BigEndian.PutUint16(frame, uint16(length))
+		return frame
+	}
+
+	tests := []struct {
+		name       string
+		eventCodec EventCodec
+		data       []byte
+		tooLong    bool
+	}{
+		{"pipe", PipeCodec{}, []byte("0123456789\r\n"), false},
+		{"pipe too long", PipeCodec{}, []byte("0123456789a\r\n"), true},
+		{"pipe incomplete", PipeCodec{}, []byte("0123456789ab"), true},
+		{"json", JsonCodec{}, []byte("0123456789\r\n"), false},
+		{"json too long", JsonCodec{}, []byte("0123456789a\n"), true},
+		{"msgpack", MsgpackCodec{}, msgpackFrame(10), false},
+		{"msgpack too long", MsgpackCodec{}, msgpackFrame(11), true},
+	}
+
+	for _, test := range tests {
+		// Data is read a byte at a time, and then at once
+		for _, chunks := range [][]byte{{1}, nil} {
+			frames, err := readFrames(&chunkedReader{data: test.data, chunks: chunks}, test.eventCodec, 10)
+
+			eventErr, ok := err.(*EventError)
+			if test.tooLong && (!ok || eventErr.Code != NACK_FRAME_TOO_LONG) {
+				t.Errorf("%s: error = %v, want a %d NACK", test.name, err, NACK_FRAME_TOO_LONG)
+			}
+			if !test.tooLong && (err != nil || len(frames) != 1 || len(frames[0]) != 10) {
+				t.Errorf("%s: frames = %q, %v, want a single 10 bytes frame", test.name, frames, err)
+			}
+		}
+	}
+}
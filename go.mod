@@ -0,0 +1,14 @@
+module github.com/oleiade/happening
+
+go 1.21
+
+require (
+	github.com/alecthomas/log4go v0.0.0-20180109082532-d146e6b86faa
+	github.com/gorilla/websocket v1.4.2
+	github.com/jmhodges/levigo v1.0.0
+	github.com/msbranco/goconfig v0.0.0-20160629072055-3189001257ce
+	github.com/syndtr/goleveldb v1.0.0
+	github.com/ugorji/go/codec v1.1.7
+)
+
+require github.com/golang/snappy v0.0.4 // indirect
@@ -0,0 +1,326 @@
+package happening
+
+import (
+	"context"
+	"path/filepath"
+	"sync"
+
+	"github.com/syndtr/goleveldb/leveldb"
+	leveldbErrors "github.com/syndtr/goleveldb/leveldb/errors"
+	"github.com/syndtr/goleveldb/leveldb/iterator"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+)
+
+func init() {
+	storageBackends[STORAGE_GOLEVELDB] = func(config *Config) (StorageBackend, error) {
+		return NewGoleveldbBackend(config.StoragePath)
+	}
+}
+
+// GoleveldbBackend implements the StorageBackend interface over
+// a pure Go leveldb database, and thus requires no cgo. It's
+// database files are compatible with the LeveldbBackend ones.
+type GoleveldbBackend struct {
+	Db *leveldb.DB
+
+	mu     sync.RWMutex
+	closed bool
+
+	iteratorsMu sync.Mutex
+	iterators   map[*goleveldbIterator]bool
+}
+
+var _ StorageBackend = (*GoleveldbBackend)(nil)
+
+// NewGoleveldbBackend creates a new pure Go leveldb database connector.
+func NewGoleveldbBackend(storagePath string) (*GoleveldbBackend, error) {
+	db, err := leveldb.OpenFile(filepath.Join(storagePath, "data"), &opt.Options{
+		BlockCacheCapacity: LEVELDB_LRU_CACHE_SIZE,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &GoleveldbBackend{Db: db}, nil
+}
+
+// acquire read-locks the backend for the duration of an operation
+// and ensures it is still usable. Callers have to release it
+// using backend.mu.RUnlock once done.
+func (backend *GoleveldbBackend) acquire(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	backend.mu.RLock()
+	if backend.closed {
+		backend.mu.RUnlock()
+		return ErrBackendClosed
+	}
+
+	return nil
+}
+
+func (backend *GoleveldbBackend) Get(ctx context.Context, key []byte) ([]byte, error) {
+	if err := backend.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer backend.mu.RUnlock()
+
+	value, err := backend.Db.Get(key, nil)
+	if err == leveldbErrors.ErrNotFound {
+		return nil, ErrKeyNotFound
+	}
+
+	return value, err
+}
+
+func (backend *GoleveldbBackend) Put(ctx context.Context, pair KvPair) error {
+	return backend.MPut(ctx, []KvPair{pair})
+}
+
+func (backend *GoleveldbBackend) Delete(ctx context.Context, key []byte) error {
+	return backend.MDelete(ctx, [][]byte{key})
+}
+
+func (backend *GoleveldbBackend) MGet(ctx context.Context, keys [][]byte) ([][]byte, error) {
+	if err := backend.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer backend.mu.RUnlock()
+
+	// Read over a Db read-only snapshot
+	snapshot, err := backend.Db.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	defer snapshot.Release()
+
+	values := make([][]byte, len(keys))
+	for index, key := range keys {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		value, err := snapshot.Get(key, nil)
+		if err != nil && err != leveldbErrors.ErrNotFound {
+			return nil, err
+		}
+		values[index] = value
+	}
+
+	return values, nil
+}
+
+func (backend *GoleveldbBackend) MPut(ctx context.Context, pairs []KvPair) error {
+	if err := validateKvPairs(pairs); err != nil {
+		return err
+	}
+
+	if err := backend.acquire(ctx); err != nil {
+		return err
+	}
+	defer backend.mu.RUnlock()
+
+	batch := new(leveldb.Batch)
+	for _, pair := range pairs {
+		batch.Put(pair.Key, pair.Value)
+	}
+
+	return backend.Db.Write(batch, nil)
+}
+
+func (backend *GoleveldbBackend) MDelete(ctx context.Context, keys [][]byte) error {
+	if err := backend.acquire(ctx); err != nil {
+		return err
+	}
+	defer backend.mu.RUnlock()
+
+	batch := new(leveldb.Batch)
+	for _, key := range keys {
+		batch.Delete(key)
+	}
+
+	return backend.Db.Write(batch, nil)
+}
+
+// NewIterator returns an Iterator over a snapshot of the database
+// restricted by opts. Iterators still open when the backend is
+// closed are released, and fail with ErrBackendClosed.
+func (backend *GoleveldbBackend) NewIterator(ctx context.Context, opts IteratorOptions) (Iterator, error) {
+	if err := backend.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer backend.mu.RUnlock()
+
+	snapshot, err := backend.Db.GetSnapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	keyRange := newIteratorRange(opts)
+	slice := &util.Range{Start: keyRange.start, Limit: keyRange.end}
+
+	it := &goleveldbIterator{
+		ctx:      ctx,
+		keyRange: keyRange,
+		backend:  backend,
+		snapshot: snapshot,
+		it:       snapshot.NewIterator(slice, &opt.ReadOptions{DontFillCache: true}),
+	}
+
+	backend.iteratorsMu.Lock()
+	if backend.iterators == nil {
+		backend.iterators = make(map[*goleveldbIterator]bool)
+	}
+	backend.iterators[it] = true
+	backend.iteratorsMu.Unlock()
+
+	return it, nil
+}
+
+// Close releases the database and its associated resources, along
+// with the iterators left open. It blocks until in-flight operations
+// are done.
+func (backend *GoleveldbBackend) Close() error {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	if backend.closed {
+		return ErrBackendClosed
+	}
+	backend.closed = true
+
+	backend.iteratorsMu.Lock()
+	for it := range backend.iterators {
+		it.release()
+	}
+	backend.iterators = nil
+	backend.iteratorsMu.Unlock()
+
+	return backend.Db.Close()
+}
+
+// forget stops tracking an open iterator, and reports
+// whether it was still tracked.
+func (backend *GoleveldbBackend) forget(it *goleveldbIterator) bool {
+	backend.iteratorsMu.Lock()
+	defer backend.iteratorsMu.Unlock()
+
+	if !backend.iterators[it] {
+		return false
+	}
+	delete(backend.iterators, it)
+
+	return true
+}
+
+// goleveldbIterator implements the Iterator interface over
+// a goleveldb iterator and it's snapshot. As the goleveldb
+// iterator is restricted to the key range already, only the
+// iteration direction and limit are left to handle.
+//
+// The backend is only read-locked for the duration of each
+// call, so that it can be used, or closed, during iteration.
+type goleveldbIterator struct {
+	ctx      context.Context
+	keyRange *iteratorRange
+	backend  *GoleveldbBackend
+	snapshot *leveldb.Snapshot
+	it       iterator.Iterator
+	started  bool
+	valid    bool
+	closed   bool
+	err      error
+}
+
+func (i *goleveldbIterator) Next() bool {
+	i.valid = false
+	if i.closed || i.err != nil || i.keyRange.done {
+		return false
+	}
+
+	if i.err = i.ctx.Err(); i.err != nil {
+		return false
+	}
+
+	i.backend.mu.RLock()
+	defer i.backend.mu.RUnlock()
+
+	if i.backend.closed {
+		i.err = ErrBackendClosed
+		return false
+	}
+
+	var ok bool
+	switch {
+	case !i.started && i.keyRange.reverse:
+		ok = i.it.Last()
+	case i.keyRange.reverse:
+		ok = i.it.Prev()
+	default:
+		ok = i.it.Next()
+	}
+	i.started = true
+
+	if !ok {
+		i.keyRange.done = true
+		i.err = i.it.Error()
+		return false
+	}
+
+	i.valid = i.keyRange.next(i.it.Key())
+	return i.valid
+}
+
+// Key returns a copy of the current key, as goleveldb
+// reuses it's buffers on iteration.
+func (i *goleveldbIterator) Key() []byte {
+	i.backend.mu.RLock()
+	defer i.backend.mu.RUnlock()
+
+	if i.closed || !i.valid || i.backend.closed {
+		return nil
+	}
+	return append([]byte(nil), i.it.Key()...)
+}
+
+// Value returns a copy of the current value, as goleveldb
+// reuses it's buffers on iteration.
+func (i *goleveldbIterator) Value() []byte {
+	i.backend.mu.RLock()
+	defer i.backend.mu.RUnlock()
+
+	if i.closed || !i.valid || i.backend.closed {
+		return nil
+	}
+	return append([]byte(nil), i.it.Value()...)
+}
+
+func (i *goleveldbIterator) Err() error {
+	return i.err
+}
+
+func (i *goleveldbIterator) Close() error {
+	if i.closed {
+		return ErrIteratorClosed
+	}
+	i.closed = true
+	i.valid = false
+
+	i.backend.mu.RLock()
+	defer i.backend.mu.RUnlock()
+
+	if i.backend.forget(i) {
+		i.release()
+	}
+
+	return nil
+}
+
+// release frees the goleveldb iterator and it's snapshot.
+func (i *goleveldbIterator) release() {
+	i.it.Release()
+	i.snapshot.Release()
+}
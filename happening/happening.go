@@ -1,11 +1,8 @@
 package main
 
 import (
-    "os"
-    "fmt"
     "log"
-    "syscall"
-    "os/signal"
+    "os"
     l4g "github.com/alecthomas/log4go"
     happening "github.com/oleiade/happening"
 )
@@ -34,25 +31,31 @@ func main() {
         log.Fatal(err)
     }
 
-    // build client store
-    events_handler := happening.NewEventsHandler()
-    events_handler.Start(*cmdline.Host, *cmdline.EventsPort)
-
-    // build server
-    server := happening.NewServer(events_handler)
-
-    l4g.Info("Hapening events listener routine started")
+    // Rebuild the events indexes of existing data, and exit
+    if *cmdline.RebuildIndex {
+        err = happening.RebuildEventIndexes(config)
+        if err != nil {
+            log.Fatal(err)
+        }
+        return
+    }
 
-    // Handle SIGINT and SIGTERM.
-    ch := make(chan os.Signal)
-    signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
-    go func() {
-        for sig := range ch {
-            l4g.Info(fmt.Sprintf("%s received, stopping the happening", sig))
-            server.Stop()
-            os.Exit(1)
+    // Print the stored events matching a query, and exit
+    if *cmdline.Query != "" {
+        err = happening.QueryStoredEvents(config, *cmdline.Query, os.Stdout)
+        if err != nil {
+            log.Fatal(err)
         }
-    }()
+        return
+    }
 
-    server.Run()
-}
\ No newline at end of file
+    // Run happening services until SIGINT or SIGTERM
+    if config.Daemon {
+        err = happening.Daemon(config)
+    } else {
+        err = happening.ListenAndAcknowledge(config)
+    }
+    if err != nil {
+        log.Fatal(err)
+    }
+}
@@ -1,27 +1,52 @@
+//go:build cgo
+// +build cgo
+
 package happening
 
 import (
-	"bytes"
+	"context"
 	leveldb "github.com/jmhodges/levigo"
 	"path/filepath"
+	"sync"
 )
 
+func init() {
+	storageBackends[STORAGE_LEVELDB] = func(config *Config) (StorageBackend, error) {
+		return NewLeveldbBackend(config.StoragePath)
+	}
+}
+
+// LeveldbBackend implements the StorageBackend interface over a
+// leveldb database, using the C leveldb library, and thus requires
+// cgo.
 type LeveldbBackend struct {
 	Options *leveldb.Options
 	Db      *leveldb.DB
+
+	cache  *leveldb.Cache
+	mu     sync.RWMutex
+	closed bool
+
+	iteratorsMu sync.Mutex
+	iterators   map[*leveldbIterator]bool
 }
 
+var _ StorageBackend = (*LeveldbBackend)(nil)
+
 // NewLeveldbBackend creates a new leveldb database connector.
 func NewLeveldbBackend(storagePath string) (backend *LeveldbBackend, err error) {
 	// Set up backend to use a lru cache and
 	// create store files if not existing yet
+	cache := leveldb.NewLRUCache(LEVELDB_LRU_CACHE_SIZE)
 	opts := leveldb.NewOptions()
-	opts.SetCache(leveldb.NewLRUCache(LEVELDB_LRU_CACHE_SIZE))
+	opts.SetCache(cache)
 	opts.SetCreateIfMissing(true)
 
 	// Open database file
 	db, err := leveldb.Open(filepath.Join(storagePath, "data"), opts)
 	if err != nil {
+		opts.Close()
+		cache.Close()
 		return nil, err
 	}
 
@@ -30,80 +55,329 @@ func NewLeveldbBackend(storagePath string) (backend *LeveldbBackend, err error)
 	backend = &LeveldbBackend{
 		Options: opts,
 		Db:      db,
+		cache:   cache,
 	}
 
 	return backend, nil
 }
 
-func (backend *LeveldbBackend) Get(key []byte) (value []byte, err error) {
+// acquire read-locks the backend for the duration of an operation
+// and ensures it is still usable. Callers have to release it
+// using backend.mu.RUnlock once done.
+func (backend *LeveldbBackend) acquire(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	backend.mu.RLock()
+	if backend.closed {
+		backend.mu.RUnlock()
+		return ErrBackendClosed
+	}
+
+	return nil
+}
+
+func (backend *LeveldbBackend) Get(ctx context.Context, key []byte) (value []byte, err error) {
+	if err = backend.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer backend.mu.RUnlock()
+
 	ro := leveldb.NewReadOptions()
+	defer ro.Close()
+
 	value, err = backend.Db.Get(ro, key)
 	if err != nil {
 		return nil, err
 	}
 
+	// levigo returns a nil value with no error
+	// when the key does not exist.
+	if value == nil {
+		return nil, ErrKeyNotFound
+	}
+
 	return value, nil
 }
 
-func (backend *LeveldbBackend) Put(pair KvPair) error {
-	wo := leveldb.NewWriteOptions()
-	return backend.Db.Put(wo, pair.Key, pair.Value)
+func (backend *LeveldbBackend) Put(ctx context.Context, pair KvPair) error {
+	return backend.MPut(ctx, []KvPair{pair})
 }
 
-func (backend *LeveldbBackend) Delete(key []byte) (err error) {
-	wo := leveldb.NewWriteOptions()
-	return backend.Db.Delete(wo, key)
+func (backend *LeveldbBackend) Delete(ctx context.Context, key []byte) (err error) {
+	return backend.MDelete(ctx, [][]byte{key})
 }
 
-func (backend *LeveldbBackend) MGet(keys [][]byte) (values [][]byte, err error) {
-	var data [][]byte = make([][]byte, len(keys))
+func (backend *LeveldbBackend) MGet(ctx context.Context, keys [][]byte) (values [][]byte, err error) {
+	if err = backend.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer backend.mu.RUnlock()
 
 	// Read over a Db read-only snapshot
 	readOptions := leveldb.NewReadOptions()
+	defer readOptions.Close()
 	snapshot := backend.Db.NewSnapshot()
+	defer backend.Db.ReleaseSnapshot(snapshot)
 	readOptions.SetSnapshot(snapshot)
 
-	if len(keys) > 0 {
-		// Extract start -> end key range to extract
-		// from leveldb using an iterator
-		start := keys[0]
-		end := keys[len(keys)-1]
-
-		// Keep track of the input keys index
-		// in order to output results in order
-		keysIndex := make(map[string]int)
-		for index, element := range keys {
-			keysIndex[string(element)] = index
+	values = make([][]byte, len(keys))
+	for index, key := range keys {
+		if err = ctx.Err(); err != nil {
+			return nil, err
 		}
 
-		// Fetch values using an iterator
-		it := backend.Db.NewIterator(readOptions)
-		defer it.Close()
-		it.Seek([]byte(start))
-
-		for ; it.Valid(); it.Next() {
-			if bytes.Compare(it.Key(), []byte(end)) > 1 {
-				break
-			}
-
-			if index, present := keysIndex[string(it.Key())]; present {
-				data[index] = it.Value()
-			}
+		if values[index], err = backend.Db.Get(readOptions, key); err != nil {
+			return nil, err
 		}
 	}
 
-	backend.Db.ReleaseSnapshot(snapshot)
-
-	return data, nil
+	return values, nil
 }
 
-func (backend *LeveldbBackend) MPut(pairs []KvPair) (err error) {
+func (backend *LeveldbBackend) MPut(ctx context.Context, pairs []KvPair) (err error) {
+	if err = validateKvPairs(pairs); err != nil {
+		return err
+	}
+
+	if err = backend.acquire(ctx); err != nil {
+		return err
+	}
+	defer backend.mu.RUnlock()
+
 	var batch *leveldb.WriteBatch = leveldb.NewWriteBatch()
+	defer batch.Close()
 
 	for _, pair := range pairs {
 		batch.Put(pair.Key, pair.Value)
 	}
 
 	wo := leveldb.NewWriteOptions()
+	defer wo.Close()
+
+	return backend.Db.Write(wo, batch)
+}
+
+func (backend *LeveldbBackend) MDelete(ctx context.Context, keys [][]byte) (err error) {
+	if err = backend.acquire(ctx); err != nil {
+		return err
+	}
+	defer backend.mu.RUnlock()
+
+	var batch *leveldb.WriteBatch = leveldb.NewWriteBatch()
+	defer batch.Close()
+
+	for _, key := range keys {
+		batch.Delete(key)
+	}
+
+	wo := leveldb.NewWriteOptions()
+	defer wo.Close()
+
 	return backend.Db.Write(wo, batch)
 }
+
+// NewIterator returns an Iterator over a snapshot of the database
+// restricted by opts. Iterators still open when the backend is
+// closed are released, and fail with ErrBackendClosed.
+func (backend *LeveldbBackend) NewIterator(ctx context.Context, opts IteratorOptions) (Iterator, error) {
+	if err := backend.acquire(ctx); err != nil {
+		return nil, err
+	}
+	defer backend.mu.RUnlock()
+
+	readOptions := leveldb.NewReadOptions()
+	readOptions.SetFillCache(false)
+	snapshot := backend.Db.NewSnapshot()
+	readOptions.SetSnapshot(snapshot)
+
+	it := &leveldbIterator{
+		ctx:         ctx,
+		keyRange:    newIteratorRange(opts),
+		backend:     backend,
+		snapshot:    snapshot,
+		readOptions: readOptions,
+		it:          backend.Db.NewIterator(readOptions),
+	}
+
+	backend.iteratorsMu.Lock()
+	if backend.iterators == nil {
+		backend.iterators = make(map[*leveldbIterator]bool)
+	}
+	backend.iterators[it] = true
+	backend.iteratorsMu.Unlock()
+
+	return it, nil
+}
+
+// Close releases the database and its associated resources, along
+// with the iterators left open. It blocks until in-flight operations
+// are done.
+func (backend *LeveldbBackend) Close() error {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	if backend.closed {
+		return ErrBackendClosed
+	}
+	backend.closed = true
+
+	backend.iteratorsMu.Lock()
+	for it := range backend.iterators {
+		it.release()
+	}
+	backend.iterators = nil
+	backend.iteratorsMu.Unlock()
+
+	backend.Db.Close()
+	backend.Options.Close()
+	backend.cache.Close()
+
+	return nil
+}
+
+// forget stops tracking an open iterator, and reports
+// whether it was still tracked.
+func (backend *LeveldbBackend) forget(it *leveldbIterator) bool {
+	backend.iteratorsMu.Lock()
+	defer backend.iteratorsMu.Unlock()
+
+	if !backend.iterators[it] {
+		return false
+	}
+	delete(backend.iterators, it)
+
+	return true
+}
+
+// leveldbIterator implements the Iterator interface over
+// a levigo iterator and it's snapshot.
+//
+// The backend is only read-locked for the duration of each
+// call, so that it can be used, or closed, during iteration.
+type leveldbIterator struct {
+	ctx         context.Context
+	keyRange    *iteratorRange
+	backend     *LeveldbBackend
+	snapshot    *leveldb.Snapshot
+	readOptions *leveldb.ReadOptions
+	it          *leveldb.Iterator
+	started     bool
+	valid       bool
+	closed      bool
+	err         error
+}
+
+func (i *leveldbIterator) Next() bool {
+	i.valid = false
+	if i.closed || i.err != nil || i.keyRange.done {
+		return false
+	}
+
+	if i.err = i.ctx.Err(); i.err != nil {
+		return false
+	}
+
+	i.backend.mu.RLock()
+	defer i.backend.mu.RUnlock()
+
+	if i.backend.closed {
+		i.err = ErrBackendClosed
+		return false
+	}
+
+	switch {
+	case !i.started:
+		i.started = true
+		i.seek()
+	case i.keyRange.reverse:
+		i.it.Prev()
+	default:
+		i.it.Next()
+	}
+
+	if !i.it.Valid() {
+		i.keyRange.done = true
+		i.err = i.it.GetError()
+		return false
+	}
+
+	i.valid = i.keyRange.next(i.it.Key())
+	return i.valid
+}
+
+// seek positions the levigo iterator on the first
+// entry of the range in iteration order.
+func (i *leveldbIterator) seek() {
+	if !i.keyRange.reverse {
+		if i.keyRange.start != nil {
+			i.it.Seek(i.keyRange.start)
+		} else {
+			i.it.SeekToFirst()
+		}
+		return
+	}
+
+	// The last entry of the range is the one
+	// preceding the first one after it's end.
+	if i.keyRange.end == nil {
+		i.it.SeekToLast()
+		return
+	}
+
+	i.it.Seek(i.keyRange.end)
+	if i.it.Valid() {
+		i.it.Prev()
+	} else {
+		i.it.SeekToLast()
+	}
+}
+
+func (i *leveldbIterator) Key() []byte {
+	i.backend.mu.RLock()
+	defer i.backend.mu.RUnlock()
+
+	if i.closed || !i.valid || i.backend.closed {
+		return nil
+	}
+	return i.it.Key()
+}
+
+func (i *leveldbIterator) Value() []byte {
+	i.backend.mu.RLock()
+	defer i.backend.mu.RUnlock()
+
+	if i.closed || !i.valid || i.backend.closed {
+		return nil
+	}
+	return i.it.Value()
+}
+
+func (i *leveldbIterator) Err() error {
+	return i.err
+}
+
+func (i *leveldbIterator) Close() error {
+	if i.closed {
+		return ErrIteratorClosed
+	}
+	i.closed = true
+	i.valid = false
+
+	i.backend.mu.RLock()
+	defer i.backend.mu.RUnlock()
+
+	if i.backend.forget(i) {
+		i.release()
+	}
+
+	return nil
+}
+
+// release frees the levigo iterator, it's read options and snapshot.
+func (i *leveldbIterator) release() {
+	i.it.Close()
+	i.readOptions.Close()
+	i.backend.Db.ReleaseSnapshot(i.snapshot)
+}
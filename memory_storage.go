@@ -0,0 +1,407 @@
+package happening
+
+import (
+	"context"
+	"encoding/gob"
+	"os"
+	"sync"
+)
+
+func init() {
+	storageBackends[STORAGE_MEMORY] = func(config *Config) (StorageBackend, error) {
+		return NewMemoryBackend(config.MemoryMaxSize, config.MemorySnapshot)
+	}
+}
+
+// MemoryBackend implements the StorageBackend interface in memory,
+// over a key ordered persistent tree of entries.
+//
+// When MaxSize is positive, the backend holds at most MaxSize events,
+// and evicts the least recently written ones, along with their index
+// entries, to make room for new ones. Other data, such as nodes or
+// rollups, is never evicted. When SnapshotFile is set, the backend
+// entries are loaded from it on creation, and saved to it on Close.
+type MemoryBackend struct {
+	MaxSize      int
+	SnapshotFile string
+
+	mu     sync.RWMutex
+	closed bool
+
+	// entries is replaced, never modified, on write so that
+	// iterators can walk over it as a snapshot.
+	entries memoryTree
+	events  int
+
+	// writes lists events entries in write order, and may hold
+	// stale items for overwritten or deleted entries.
+	writes []*memoryEntry
+}
+
+// memoryEntry is a MemoryBackend key/value pair.
+type memoryEntry struct {
+	key   []byte
+	value []byte
+}
+
+var _ StorageBackend = (*MemoryBackend)(nil)
+
+// NewMemoryBackend creates a new in-memory backend holding at
+// most maxSize events, zero meaning no limit, and loads it's
+// snapshotFile if any.
+func NewMemoryBackend(maxSize int, snapshotFile string) (*MemoryBackend, error) {
+	backend := &MemoryBackend{
+		MaxSize:      maxSize,
+		SnapshotFile: snapshotFile,
+	}
+
+	if snapshotFile != "" {
+		if err := backend.loadSnapshot(); err != nil {
+			return nil, err
+		}
+	}
+
+	return backend, nil
+}
+
+// acquire locks the backend for the duration of an operation
+// and ensures it is still usable. Callers have to release it
+// using release once done.
+func (backend *MemoryBackend) acquire(ctx context.Context, write bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if write {
+		backend.mu.Lock()
+	} else {
+		backend.mu.RLock()
+	}
+
+	if backend.closed {
+		backend.release(write)
+		return ErrBackendClosed
+	}
+
+	return nil
+}
+
+func (backend *MemoryBackend) release(write bool) {
+	if write {
+		backend.mu.Unlock()
+	} else {
+		backend.mu.RUnlock()
+	}
+}
+
+func (backend *MemoryBackend) Get(ctx context.Context, key []byte) ([]byte, error) {
+	if err := backend.acquire(ctx, false); err != nil {
+		return nil, err
+	}
+	defer backend.release(false)
+
+	entry := backend.entries.get(key)
+	if entry == nil {
+		return nil, ErrKeyNotFound
+	}
+
+	return copyBytes(entry.value), nil
+}
+
+func (backend *MemoryBackend) Put(ctx context.Context, pair KvPair) error {
+	return backend.MPut(ctx, []KvPair{pair})
+}
+
+func (backend *MemoryBackend) Delete(ctx context.Context, key []byte) error {
+	return backend.MDelete(ctx, [][]byte{key})
+}
+
+func (backend *MemoryBackend) MGet(ctx context.Context, keys [][]byte) ([][]byte, error) {
+	if err := backend.acquire(ctx, false); err != nil {
+		return nil, err
+	}
+	defer backend.release(false)
+
+	values := make([][]byte, len(keys))
+	for index, key := range keys {
+		if entry := backend.entries.get(key); entry != nil {
+			values[index] = copyBytes(entry.value)
+		}
+	}
+
+	return values, nil
+}
+
+func (backend *MemoryBackend) MPut(ctx context.Context, pairs []KvPair) error {
+	if err := validateKvPairs(pairs); err != nil {
+		return err
+	}
+
+	if err := backend.acquire(ctx, true); err != nil {
+		return err
+	}
+	defer backend.release(true)
+
+	for _, pair := range pairs {
+		backend.write(&memoryEntry{key: copyBytes(pair.Key), value: copyBytes(pair.Value)})
+	}
+	backend.evict()
+
+	return nil
+}
+
+func (backend *MemoryBackend) MDelete(ctx context.Context, keys [][]byte) error {
+	if err := backend.acquire(ctx, true); err != nil {
+		return err
+	}
+	defer backend.release(true)
+
+	for _, key := range keys {
+		backend.remove(key)
+	}
+	backend.compactWrites()
+
+	return nil
+}
+
+// NewIterator returns an Iterator over a snapshot of the
+// backend restricted by opts.
+func (backend *MemoryBackend) NewIterator(ctx context.Context, opts IteratorOptions) (Iterator, error) {
+	if err := backend.acquire(ctx, false); err != nil {
+		return nil, err
+	}
+	defer backend.release(false)
+
+	keyRange := newIteratorRange(opts)
+
+	return &memoryIterator{
+		ctx:      ctx,
+		keyRange: keyRange,
+		backend:  backend,
+		cursor:   backend.entries.cursor(keyRange.start, keyRange.end, keyRange.reverse),
+	}, nil
+}
+
+// Close releases the backend entries, after saving
+// them to the backend SnapshotFile if any.
+func (backend *MemoryBackend) Close() error {
+	backend.mu.Lock()
+	defer backend.mu.Unlock()
+
+	if backend.closed {
+		return ErrBackendClosed
+	}
+	backend.closed = true
+
+	var err error
+	if backend.SnapshotFile != "" {
+		err = backend.saveSnapshot()
+	}
+
+	backend.entries = memoryTree{}
+	backend.writes = nil
+
+	return err
+}
+
+// write stores entry, and tracks the write of events entries.
+func (backend *MemoryBackend) write(entry *memoryEntry) {
+	if isEventKey(entry.key) {
+		if backend.entries.get(entry.key) == nil {
+			backend.events++
+		}
+		backend.writes = append(backend.writes, entry)
+	}
+
+	backend.entries = backend.entries.put(entry)
+}
+
+// remove deletes the entry holding key, if any.
+func (backend *MemoryBackend) remove(key []byte) {
+	if backend.entries.get(key) == nil {
+		return
+	}
+
+	if isEventKey(key) {
+		backend.events--
+	}
+	backend.entries = backend.entries.remove(key)
+}
+
+// evict removes the least recently written events, along with
+// their index entries, until the backend holds at most MaxSize
+// events.
+func (backend *MemoryBackend) evict() {
+	for backend.MaxSize > 0 && backend.events > backend.MaxSize && len(backend.writes) > 0 {
+		oldest := backend.writes[0]
+		backend.writes = backend.writes[1:]
+
+		if backend.entries.get(oldest.key) != oldest {
+			continue
+		}
+
+		for _, key := range withIndexKeys([][]byte{oldest.key}) {
+			backend.remove(key)
+		}
+	}
+
+	backend.compactWrites()
+}
+
+// compactWrites drops the stale writes items once
+// they outnumber the live ones.
+func (backend *MemoryBackend) compactWrites() {
+	if len(backend.writes) <= 2*backend.events+MEMORY_MIN_WRITES_COMPACTION {
+		return
+	}
+
+	writes := make([]*memoryEntry, 0, backend.events)
+	for _, entry := range backend.writes {
+		if backend.entries.get(entry.key) == entry {
+			writes = append(writes, entry)
+		}
+	}
+	backend.writes = writes
+}
+
+// isEventKey returns whether key is the storage key of an event.
+func isEventKey(key []byte) bool {
+	return len(key) > 0 && key[0] == EVENTS_KEYSPACE
+}
+
+// saveSnapshot writes the backend entries to it's SnapshotFile,
+// events last and in write order, so that they are evicted in the
+// same order once loaded.
+func (backend *MemoryBackend) saveSnapshot() error {
+	pairs := make([]KvPair, 0, backend.entries.size)
+
+	cursor := backend.entries.cursor(nil, nil, false)
+	for entry := cursor.next(); entry != nil; entry = cursor.next() {
+		if !isEventKey(entry.key) {
+			pairs = append(pairs, KvPair{Key: entry.key, Value: entry.value})
+		}
+	}
+
+	for _, entry := range backend.writes {
+		if backend.entries.get(entry.key) == entry {
+			pairs = append(pairs, KvPair{Key: entry.key, Value: entry.value})
+		}
+	}
+
+	tmpPath := backend.SnapshotFile + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	if err = gob.NewEncoder(file).Encode(pairs); err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, backend.SnapshotFile)
+}
+
+// loadSnapshot reads the backend entries from it's
+// SnapshotFile, if it exists.
+func (backend *MemoryBackend) loadSnapshot() error {
+	file, err := os.Open(backend.SnapshotFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var pairs []KvPair
+	if err := gob.NewDecoder(file).Decode(&pairs); err != nil {
+		return err
+	}
+
+	return backend.MPut(context.Background(), pairs)
+}
+
+func copyBytes(data []byte) []byte {
+	if data == nil {
+		return nil
+	}
+	return append(make([]byte, 0, len(data)), data...)
+}
+
+// memoryIterator implements the Iterator interface over a
+// MemoryBackend entries snapshot, restricted to the key range.
+// Like the other backends ones, it fails once the backend is closed.
+type memoryIterator struct {
+	ctx      context.Context
+	keyRange *iteratorRange
+	backend  *MemoryBackend
+	cursor   *memoryCursor
+	entry    *memoryEntry
+	closed   bool
+	err      error
+}
+
+func (i *memoryIterator) Next() bool {
+	i.entry = nil
+	if i.closed || i.err != nil || i.keyRange.done {
+		return false
+	}
+
+	if i.err = i.ctx.Err(); i.err != nil {
+		return false
+	}
+
+	i.backend.mu.RLock()
+	closed := i.backend.closed
+	i.backend.mu.RUnlock()
+
+	if closed {
+		i.err = ErrBackendClosed
+		return false
+	}
+
+	entry := i.cursor.next()
+	if entry == nil {
+		i.keyRange.done = true
+		return false
+	}
+
+	if i.keyRange.next(entry.key) {
+		i.entry = entry
+	}
+	return i.entry != nil
+}
+
+func (i *memoryIterator) Key() []byte {
+	if i.closed || i.entry == nil {
+		return nil
+	}
+	return copyBytes(i.entry.key)
+}
+
+func (i *memoryIterator) Value() []byte {
+	if i.closed || i.entry == nil {
+		return nil
+	}
+	return copyBytes(i.entry.value)
+}
+
+func (i *memoryIterator) Err() error {
+	return i.err
+}
+
+func (i *memoryIterator) Close() error {
+	if i.closed {
+		return ErrIteratorClosed
+	}
+	i.closed = true
+	i.entry = nil
+	i.cursor = nil
+
+	return nil
+}
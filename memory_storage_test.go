@@ -0,0 +1,172 @@
+package happening
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"sort"
+	"testing"
+)
+
+func TestMemoryBackendEviction(t *testing.T) {
+	ctx := context.Background()
+	backend, err := NewMemoryBackend(2, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	nodeKey := []byte{NODES_KEYSPACE, 'k'}
+	if err := backend.Put(ctx, KvPair{Key: nodeKey, Value: []byte("node")}); err != nil {
+		t.Fatal(err)
+	}
+
+	queue := NewQueue(EVENTS_QUEUE_SIZE)
+	writer := NewStorageWriter(backend, queue)
+	for index := int64(0); index < 3; index++ {
+		queue.Push(NewEvent("kitchen", 1392821124+index, 1392821124+index, "temperature"))
+		writer.Flush()
+	}
+
+	counts := map[byte]int{}
+	keys, err := iteratorKeys(ctx, backend, IteratorOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		counts[key[0]]++
+	}
+
+	want := map[byte]int{
+		EVENTS_KEYSPACE:       2,
+		TYPE_INDEX_KEYSPACE:   2,
+		SOURCE_INDEX_KEYSPACE: 2,
+		NODES_KEYSPACE:        1,
+		'm':                   1, // events sequence
+	}
+	for keyspace, count := range want {
+		if counts[keyspace] != count {
+			t.Errorf("%d keys in the %q keyspace, want %d", counts[keyspace], keyspace, count)
+		}
+	}
+
+	// The oldest event was evicted
+	events, err := iteratorKeys(ctx, backend, IteratorOptions{Prefix: []byte{EVENTS_KEYSPACE}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range events {
+		event, err := DecodeEventKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if event.SentOn == 1392821124 {
+			t.Errorf("oldest event was not evicted")
+		}
+	}
+}
+
+func TestMemoryBackendSnapshot(t *testing.T) {
+	ctx := context.Background()
+	snapshot := filepath.Join(t.TempDir(), "snapshot")
+
+	backend, err := NewMemoryBackend(0, snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Events are written out of key order
+	putStrings(t, backend, "e2", "n1", "e1", "e3")
+	if err := backend.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	backend, err = NewMemoryBackend(2, snapshot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	keys, err := iteratorKeys(ctx, backend, IteratorOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := joinKeys(keys); got != "e1,e3,n1" {
+		t.Errorf("keys loaded from snapshot = %q, want the least recently written event evicted", got)
+	}
+}
+
+func TestMemoryTree(t *testing.T) {
+	random := rand.New(rand.NewSource(1))
+
+	var tree memoryTree
+	model := map[string]string{}
+	snapshots := []memoryTree{}
+	models := []map[string]string{}
+
+	for step := 0; step < 5000; step++ {
+		key := fmt.Sprintf("%03d", random.Intn(500))
+
+		if random.Intn(3) == 0 {
+			tree = tree.remove([]byte(key))
+			delete(model, key)
+		} else {
+			value := fmt.Sprint(step)
+			tree = tree.put(&memoryEntry{key: []byte(key), value: []byte(value)})
+			model[key] = value
+		}
+
+		if step%500 == 0 {
+			snapshot := make(map[string]string, len(model))
+			for key, value := range model {
+				snapshot[key] = value
+			}
+			snapshots = append(snapshots, tree)
+			models = append(models, snapshot)
+		}
+	}
+	snapshots = append(snapshots, tree)
+	models = append(models, model)
+
+	// Former trees are left untouched by later writes
+	for index, snapshot := range snapshots {
+		checkMemoryTree(t, snapshot, models[index])
+	}
+}
+
+// checkMemoryTree verifies that tree holds the model
+// entries, in order, and only them.
+func checkMemoryTree(t *testing.T, tree memoryTree, model map[string]string) {
+	t.Helper()
+
+	keys := make([]string, 0, len(model))
+	for key := range model {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	if tree.size != len(keys) {
+		t.Errorf("tree size = %d, want %d", tree.size, len(keys))
+	}
+
+	for _, reverse := range []bool{false, true} {
+		cursor := tree.cursor(nil, nil, reverse)
+		for index := range keys {
+			key := keys[index]
+			if reverse {
+				key = keys[len(keys)-1-index]
+			}
+
+			entry := cursor.next()
+			if entry == nil || string(entry.key) != key || string(entry.value) != model[key] {
+				t.Fatalf("entry %d (reverse %v) = %v, want %s=%s", index, reverse, entry, key, model[key])
+			}
+			if tree.get([]byte(key)) != entry {
+				t.Fatalf("get(%s) = %v, want %v", key, tree.get([]byte(key)), entry)
+			}
+		}
+		if entry := cursor.next(); entry != nil {
+			t.Fatalf("extra entry %s (reverse %v)", entry.key, reverse)
+		}
+	}
+}
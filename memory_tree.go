@@ -0,0 +1,194 @@
+package happening
+
+import (
+	"bytes"
+	"math/rand"
+)
+
+// memoryTree is a persistent treap of memoryEntry, ordered by key.
+//
+// Trees are never modified: put and remove return a new tree sharing
+// the untouched nodes of the former one, so that a tree remains a
+// consistent snapshot for as long as it is referenced. Both run in
+// O(log n) on average.
+type memoryTree struct {
+	root *memoryNode
+	size int
+}
+
+type memoryNode struct {
+	entry    *memoryEntry
+	priority uint32
+	left     *memoryNode
+	right    *memoryNode
+}
+
+// get returns the tree entry holding key, if any.
+func (tree memoryTree) get(key []byte) *memoryEntry {
+	node := tree.root
+	for node != nil {
+		switch bytes.Compare(key, node.entry.key) {
+		case -1:
+			node = node.left
+		case 1:
+			node = node.right
+		default:
+			return node.entry
+		}
+	}
+
+	return nil
+}
+
+// put returns a tree holding entry, in place of the
+// entry holding the same key if any.
+func (tree memoryTree) put(entry *memoryEntry) memoryTree {
+	root, added := insertMemoryNode(tree.root, entry)
+	if added {
+		tree.size++
+	}
+	tree.root = root
+
+	return tree
+}
+
+// remove returns a tree without the entry holding key.
+func (tree memoryTree) remove(key []byte) memoryTree {
+	if tree.get(key) == nil {
+		return tree
+	}
+
+	return memoryTree{root: removeMemoryNode(tree.root, key), size: tree.size - 1}
+}
+
+// cursor returns a memoryCursor walking over the tree entries from
+// the first one whose key is greater or equal to start, or, in
+// reverse order, from the last one whose key is lower than end, a
+// nil end standing for the end of the tree.
+func (tree memoryTree) cursor(start []byte, end []byte, reverse bool) *memoryCursor {
+	cursor := &memoryCursor{reverse: reverse}
+
+	node := tree.root
+	for node != nil {
+		if reverse {
+			if end == nil || bytes.Compare(node.entry.key, end) < 0 {
+				cursor.stack = append(cursor.stack, node)
+				node = node.right
+			} else {
+				node = node.left
+			}
+		} else {
+			if bytes.Compare(node.entry.key, start) >= 0 {
+				cursor.stack = append(cursor.stack, node)
+				node = node.left
+			} else {
+				node = node.right
+			}
+		}
+	}
+
+	return cursor
+}
+
+// insertMemoryNode returns a copy of the node subtree holding entry,
+// and whether entry's key was added to it.
+func insertMemoryNode(node *memoryNode, entry *memoryEntry) (*memoryNode, bool) {
+	if node == nil {
+		return &memoryNode{entry: entry, priority: rand.Uint32()}, true
+	}
+
+	copied := *node
+	added := false
+
+	switch bytes.Compare(entry.key, node.entry.key) {
+	case -1:
+		copied.left, added = insertMemoryNode(node.left, entry)
+		if copied.left.priority > copied.priority {
+			// Rotate right, the new left node being a copy already
+			left := copied.left
+			copied.left = left.right
+			left.right = &copied
+			return left, added
+		}
+	case 1:
+		copied.right, added = insertMemoryNode(node.right, entry)
+		if copied.right.priority > copied.priority {
+			// Rotate left, the new right node being a copy already
+			right := copied.right
+			copied.right = right.left
+			right.left = &copied
+			return right, added
+		}
+	default:
+		copied.entry = entry
+	}
+
+	return &copied, added
+}
+
+// removeMemoryNode returns a copy of the node subtree, which
+// holds key, without it.
+func removeMemoryNode(node *memoryNode, key []byte) *memoryNode {
+	copied := *node
+
+	switch bytes.Compare(key, node.entry.key) {
+	case -1:
+		copied.left = removeMemoryNode(node.left, key)
+	case 1:
+		copied.right = removeMemoryNode(node.right, key)
+	default:
+		return mergeMemoryNodes(node.left, node.right)
+	}
+
+	return &copied
+}
+
+// mergeMemoryNodes returns a subtree holding the nodes of
+// both subtrees, every key of left being lower than right's.
+func mergeMemoryNodes(left *memoryNode, right *memoryNode) *memoryNode {
+	if left == nil {
+		return right
+	}
+	if right == nil {
+		return left
+	}
+
+	if left.priority > right.priority {
+		copied := *left
+		copied.right = mergeMemoryNodes(left.right, right)
+		return &copied
+	}
+
+	copied := *right
+	copied.left = mergeMemoryNodes(left, right.left)
+	return &copied
+}
+
+// memoryCursor walks over the entries of a memoryTree, in
+// key order or reverse key order.
+type memoryCursor struct {
+	stack   []*memoryNode
+	reverse bool
+}
+
+// next returns the next entry of the walk, nil once it's over.
+func (c *memoryCursor) next() *memoryEntry {
+	if len(c.stack) == 0 {
+		return nil
+	}
+
+	node := c.stack[len(c.stack)-1]
+	c.stack = c.stack[:len(c.stack)-1]
+
+	if c.reverse {
+		for child := node.left; child != nil; child = child.right {
+			c.stack = append(c.stack, child)
+		}
+	} else {
+		for child := node.right; child != nil; child = child.left {
+			c.stack = append(c.stack, child)
+		}
+	}
+
+	return node.entry
+}
@@ -1,19 +1,29 @@
 package happening
 
 import (
+	"crypto/tls"
 	"fmt"
 	l4g "github.com/alecthomas/log4go"
 	"net"
+	"sync/atomic"
 	"time"
 )
 
 // NetworkService is built on the Service structure and adds the support
 // for a net.TCPListener in order to create a service ready for networking.
+// When TLSConfig is set, accepted connexions are served over TLS.
+// When MaxConnexions is not zero, connexions exceeding it are closed
+// as soon as they are accepted.
 type NetworkService struct {
 	Service
 	Socket             *net.TCPListener
+	TLSConfig          *tls.Config
+	MaxConnexions      int
 	ConnexionsLifeline chan bool
-	IncomingConnexions chan *net.TCPConn
+	IncomingConnexions chan net.Conn
+
+	// openConnexions counts the accepted connexions not closed yet
+	openConnexions int32
 }
 
 // NewNetworkService builds a new NetworkService instance. In order
@@ -26,7 +36,7 @@ func NewNetworkService(name string) *NetworkService {
 		Service:            *NewService(name),
 		Socket:             nil,
 		ConnexionsLifeline: make(chan bool),
-		IncomingConnexions: make(chan *net.TCPConn),
+		IncomingConnexions: make(chan net.Conn),
 	}
 	return ns
 }
@@ -90,7 +100,38 @@ func (ns *NetworkService) HandleConnexions() {
 				return
 			}
 
-			ns.IncomingConnexions <- source
+			conn, ok := ns.admit(source)
+			if !ok {
+				l4g.Warn(fmt.Sprintf("[%s.HandleConnexion] Too many connexions, refusing %s", ns.name, source.RemoteAddr()))
+				source.Close()
+				continue
+			}
+
+			if ns.TLSConfig != nil {
+				ns.IncomingConnexions <- tls.Server(conn, ns.TLSConfig)
+				continue
+			}
+
+			ns.IncomingConnexions <- conn
 		}
 	}
 }
+
+// admit accounts for an accepted connexion, and returns it wrapped
+// so that closing it releases it's slot, unless the MaxConnexions
+// limit is already reached.
+func (ns *NetworkService) admit(source net.Conn) (net.Conn, bool) {
+	if ns.MaxConnexions <= 0 {
+		return source, true
+	}
+
+	if atomic.AddInt32(&ns.openConnexions, 1) > int32(ns.MaxConnexions) {
+		atomic.AddInt32(&ns.openConnexions, -1)
+		return nil, false
+	}
+
+	return &limitedConn{
+		Conn:    source,
+		release: func() { atomic.AddInt32(&ns.openConnexions, -1) },
+	}, true
+}
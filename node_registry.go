@@ -0,0 +1,287 @@
+package happening
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	l4g "github.com/alecthomas/log4go"
+)
+
+// Nodes are persisted in their own keyspace, as json
+// values stored under the following key layout:
+//
+//	'n' | Name
+
+// Node describes an events source, known by it's events From.
+type Node struct {
+	Name      string            `json:"name"`
+	FirstSeen int64             `json:"first_seen"`
+	LastSeen  int64             `json:"last_seen"`
+	Addr      string            `json:"remote_addr"`
+	Events    uint64            `json:"events"`
+	Types     map[string]uint64 `json:"types"`
+	Online    bool              `json:"online"`
+}
+
+// copy returns a deep copy of the node.
+func (n *Node) copy() *Node {
+	node := *n
+	node.Types = make(map[string]uint64, len(n.Types))
+	for eventType, count := range n.Types {
+		node.Types[eventType] = count
+	}
+
+	return &node
+}
+
+// NodeKey returns the storage key of a node.
+func NodeKey(name string) []byte {
+	return append([]byte{NODES_KEYSPACE}, name...)
+}
+
+// NodeRegistry is a Service keeping track of the nodes events are
+// received from, and periodically persisting them to a StorageBackend.
+//
+// When it's Timeout is not zero, a node which sent no event for
+// Timeout is considered offline, and a NODE_OFFLINE_EVENT_TYPE event
+// sent by the node is injected into the Handler events pipeline.
+// Once an offline, or unknown, node sends an event again, a
+// NODE_ONLINE_EVENT_TYPE event is injected.
+type NodeRegistry struct {
+	Service
+	Backend StorageBackend
+	Handler *EventsHandler
+	Timeout time.Duration
+
+	mu    sync.Mutex
+	nodes map[string]*Node
+	dirty map[string]bool
+}
+
+// NewNodeRegistry builds a NodeRegistry persisting nodes to backend,
+// and injecting their state changes events into the handler pipeline.
+func NewNodeRegistry(backend StorageBackend, handler *EventsHandler, timeout time.Duration) *NodeRegistry {
+	return &NodeRegistry{
+		Service: *NewService("NodeRegistry"),
+		Backend: backend,
+		Handler: handler,
+		Timeout: timeout,
+		nodes:   make(map[string]*Node),
+		dirty:   make(map[string]bool),
+	}
+}
+
+// Load reads the persisted nodes from the registry backend. Loaded
+// nodes are considered offline until they send an event again, so
+// that Check doesn't report as offline on now nodes which may have
+// gone offline long before, while the registry wasn't running.
+func (r *NodeRegistry) Load(ctx context.Context) error {
+	it, err := r.Backend.NewIterator(ctx, IteratorOptions{Prefix: []byte{NODES_KEYSPACE}})
+	if err != nil {
+		return err
+	}
+	defer it.Close()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for it.Next() {
+		node := &Node{}
+		if err := json.Unmarshal(it.Value(), node); err != nil {
+			l4g.Error(fmt.Sprintf("[%s.Load] Skipping malformed node %q: %s", r.name, it.Key()[1:], err))
+			continue
+		}
+
+		if node.Online {
+			node.Online = false
+			r.dirty[node.Name] = true
+		}
+		r.nodes[node.Name] = node
+	}
+
+	return it.Err()
+}
+
+// Start runs the NodeRegistry routine in background.
+func (r *NodeRegistry) Start() {
+	go r.Run()
+}
+
+// Run should be run as a long-running goroutine. It checks for
+// offline nodes and persists the updated ones every
+// NODE_REGISTRY_INTERVAL until the service is stopped, and then
+// persists them a last time.
+func (r *NodeRegistry) Run() {
+	defer r.waitGroup.Done()
+	l4g.Info(fmt.Sprintf("[%s.Run] Node registry tracking %d nodes", r.name, len(r.Nodes())))
+
+	ticker := time.NewTicker(time.Duration(NODE_REGISTRY_INTERVAL) * time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.ch:
+			if err := r.Flush(context.Background()); err != nil {
+				l4g.Error(fmt.Sprintf("[%s.Run] Unable to persist nodes: %s", r.name, err))
+			}
+			return
+		case <-ticker.C:
+			r.inject(r.Check(time.Now().Unix()))
+			if err := r.Flush(context.Background()); err != nil {
+				l4g.Error(fmt.Sprintf("[%s.Run] Unable to persist nodes: %s", r.name, err))
+			}
+		}
+	}
+}
+
+// Record accounts for an event received from addr.
+func (r *NodeRegistry) Record(event *Event, addr string) {
+	var online *Event
+
+	r.mu.Lock()
+	node, ok := r.nodes[event.From]
+	if !ok {
+		if len(r.nodes) >= NODE_REGISTRY_MAX_NODES {
+			r.mu.Unlock()
+			l4g.Warn(fmt.Sprintf("[%s.Record] Too many nodes, not tracking %q", r.name, event.From))
+			return
+		}
+
+		node = &Node{Name: event.From, FirstSeen: event.ReceivedOn, Types: make(map[string]uint64)}
+		r.nodes[event.From] = node
+	}
+
+	if !node.Online && r.Timeout > 0 {
+		online = nodeEvent(node, NODE_ONLINE_EVENT_TYPE, event.ReceivedOn)
+	}
+
+	node.LastSeen = event.ReceivedOn
+	node.Addr = addr
+	node.Events++
+	node.Types[event.Type]++
+	node.Online = true
+	r.dirty[node.Name] = true
+	r.mu.Unlock()
+
+	if online != nil {
+		r.inject([]*Event{online})
+	}
+}
+
+// Check marks the nodes which sent no event for Timeout as
+// offline on now, and returns the resulting events.
+func (r *NodeRegistry) Check(now int64) []*Event {
+	var events []*Event
+
+	if r.Timeout <= 0 {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	deadline := now - int64(r.Timeout/time.Second)
+	for _, node := range r.nodes {
+		if node.Online && node.LastSeen < deadline {
+			node.Online = false
+			r.dirty[node.Name] = true
+			events = append(events, nodeEvent(node, NODE_OFFLINE_EVENT_TYPE, now))
+		}
+	}
+
+	return events
+}
+
+// Flush persists the nodes updated since the last flush.
+func (r *NodeRegistry) Flush(ctx context.Context) error {
+	var pairs []KvPair
+
+	r.mu.Lock()
+	for name := range r.dirty {
+		value, err := json.Marshal(r.nodes[name])
+		if err != nil {
+			r.mu.Unlock()
+			return err
+		}
+		pairs = append(pairs, KvPair{Key: NodeKey(name), Value: value})
+	}
+	dirty := r.dirty
+	r.dirty = make(map[string]bool)
+	r.mu.Unlock()
+
+	for start := 0; start < len(pairs); start += STORAGE_BATCH_SIZE {
+		end := start + STORAGE_BATCH_SIZE
+		if end > len(pairs) {
+			end = len(pairs)
+		}
+
+		if err := r.Backend.MPut(ctx, pairs[start:end]); err != nil {
+			// Retry on next flush
+			r.mu.Lock()
+			for name := range dirty {
+				r.dirty[name] = true
+			}
+			r.mu.Unlock()
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Nodes returns a copy of the known nodes, ordered by name.
+func (r *NodeRegistry) Nodes() []*Node {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	nodes := make([]*Node, 0, len(r.nodes))
+	for _, node := range r.nodes {
+		nodes = append(nodes, node.copy())
+	}
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Name < nodes[j].Name })
+
+	return nodes
+}
+
+// Node returns a copy of the node named name.
+func (r *NodeRegistry) Node(name string) (*Node, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	node, ok := r.nodes[name]
+	if !ok {
+		return nil, false
+	}
+
+	return node.copy(), true
+}
+
+// inject logs and injects node events into the events pipeline.
+func (r *NodeRegistry) inject(events []*Event) {
+	for _, event := range events {
+		l4g.Info(fmt.Sprintf("[%s.inject] Node %s %s", r.name, event.From, event.Type))
+
+		if err := r.Handler.Inject(event); err != nil {
+			l4g.Error(fmt.Sprintf("[%s.inject] Unable to inject %s: %s", r.name, event, err))
+		}
+	}
+}
+
+// nodeEvent returns a node state change event, of type eventType,
+// sent by the node on now, whose last_seen attribute holds the time
+// the node was last seen on, if ever.
+func nodeEvent(node *Node, eventType string, now int64) *Event {
+	event := NewEvent(node.Name, now, now, eventType)
+	if node.LastSeen > 0 {
+		event.Attributes = map[string]string{
+			"last_seen": strconv.FormatInt(node.LastSeen, 10),
+		}
+	}
+
+	return event
+}
@@ -0,0 +1,178 @@
+package happening
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newTestNodeRegistry returns a NodeRegistry over a memory backend,
+// injecting it's events into the queue of the returned handler.
+func newTestNodeRegistry(t *testing.T, backend StorageBackend, timeout time.Duration) (*NodeRegistry, *EventsHandler) {
+	t.Helper()
+
+	if backend == nil {
+		memory, err := NewMemoryBackend(0, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { memory.Close() })
+		backend = memory
+	}
+
+	handler := NewEventsHandler()
+	return NewNodeRegistry(backend, handler, timeout), handler
+}
+
+// injectedEvents pops the events injected into a handler queue.
+func injectedEvents(handler *EventsHandler) []*Event {
+	var events []*Event
+	for handler.Queue.Len() > 0 {
+		events = append(events, handler.Queue.Pop().(*Event))
+	}
+
+	return events
+}
+
+// recordNodeEvent records a temperature event sent by from on now.
+func recordNodeEvent(registry *NodeRegistry, from string, now int64) {
+	registry.Record(NewEvent(from, now, now, "temperature"), "127.0.0.1:4040")
+}
+
+func TestNodeRegistryTransitions(t *testing.T) {
+	registry, handler := newTestNodeRegistry(t, nil, time.Minute)
+	now := int64(1392821124)
+
+	// Unknown nodes come online with their first event
+	recordNodeEvent(registry, "kitchen", now)
+	recordNodeEvent(registry, "kitchen", now+10)
+	events := injectedEvents(handler)
+	if len(events) != 1 || events[0].Type != NODE_ONLINE_EVENT_TYPE || events[0].From != "kitchen" || events[0].Attributes != nil {
+		t.Fatalf("injected %v, want a single kitchen online event", events)
+	}
+
+	node, ok := registry.Node("kitchen")
+	if !ok || !node.Online || node.FirstSeen != now || node.LastSeen != now+10 || node.Events != 2 || node.Types["temperature"] != 2 {
+		t.Fatalf("kitchen node = %+v, want online, seen twice from %d to %d", node, now, now+10)
+	}
+
+	// Nodes stay online up to Timeout
+	if events := registry.Check(now + 70); len(events) != 0 {
+		t.Errorf("Check within the timeout = %v, want no event", events)
+	}
+
+	events = registry.Check(now + 71)
+	if len(events) != 1 || events[0].Type != NODE_OFFLINE_EVENT_TYPE || events[0].SentOn != now+71 {
+		t.Fatalf("Check after the timeout = %v, want a kitchen offline event", events)
+	}
+	if lastSeen := events[0].Attributes["last_seen"]; lastSeen != strconv.FormatInt(now+10, 10) {
+		t.Errorf("offline event last_seen = %q, want %d", lastSeen, now+10)
+	}
+	if node, _ := registry.Node("kitchen"); node.Online {
+		t.Errorf("kitchen node online after the timeout")
+	}
+
+	// Offline nodes are reported once
+	if events := registry.Check(now + 200); len(events) != 0 {
+		t.Errorf("second Check = %v, want no event", events)
+	}
+
+	// And come back online with their next event
+	recordNodeEvent(registry, "kitchen", now+300)
+	events = injectedEvents(handler)
+	if len(events) != 1 || events[0].Type != NODE_ONLINE_EVENT_TYPE || events[0].Attributes["last_seen"] != strconv.FormatInt(now+10, 10) {
+		t.Errorf("injected %v, want a kitchen online event", events)
+	}
+}
+
+func TestNodeRegistryWithoutTimeout(t *testing.T) {
+	registry, handler := newTestNodeRegistry(t, nil, 0)
+	now := int64(1392821124)
+
+	recordNodeEvent(registry, "kitchen", now)
+	if events := injectedEvents(handler); len(events) != 0 {
+		t.Errorf("injected %v without timeout, want no event", events)
+	}
+	if events := registry.Check(now + 3600); events != nil {
+		t.Errorf("Check without timeout = %v, want no event", events)
+	}
+}
+
+func TestNodeRegistryMaxNodes(t *testing.T) {
+	registry, _ := newTestNodeRegistry(t, nil, 0)
+	now := int64(1392821124)
+
+	for index := 0; index < NODE_REGISTRY_MAX_NODES; index++ {
+		recordNodeEvent(registry, "node"+strconv.Itoa(index), now)
+	}
+
+	// New nodes are no longer tracked, while the known ones still are
+	recordNodeEvent(registry, "kitchen", now)
+	recordNodeEvent(registry, "node0", now+1)
+
+	if _, ok := registry.Node("kitchen"); ok {
+		t.Errorf("node tracked beyond NODE_REGISTRY_MAX_NODES")
+	}
+	if nodes := registry.Nodes(); len(nodes) != NODE_REGISTRY_MAX_NODES {
+		t.Errorf("registry tracks %d nodes, want %d", len(nodes), NODE_REGISTRY_MAX_NODES)
+	}
+	if node, _ := registry.Node("node0"); node.Events != 2 || node.LastSeen != now+1 {
+		t.Errorf("known node = %+v, want 2 events last seen on %d", node, now+1)
+	}
+}
+
+func TestNodeRegistryLoad(t *testing.T) {
+	backend, err := NewMemoryBackend(0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	now := int64(1392821124)
+
+	registry, _ := newTestNodeRegistry(t, backend, time.Minute)
+	recordNodeEvent(registry, "kitchen", now)
+	recordNodeEvent(registry, "cellar", now)
+	if err := registry.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush: %s", err)
+	}
+
+	// Nodes restored by another process are considered offline,
+	// and never reported offline on it's behalf.
+	restored, handler := newTestNodeRegistry(t, backend, time.Minute)
+	if err := restored.Load(context.Background()); err != nil {
+		t.Fatalf("Load: %s", err)
+	}
+
+	nodes := restored.Nodes()
+	if len(nodes) != 2 || nodes[0].Name != "cellar" || nodes[1].Name != "kitchen" {
+		t.Fatalf("loaded nodes = %v, want cellar and kitchen", nodes)
+	}
+	for _, node := range nodes {
+		if node.Online || node.LastSeen != now || node.Events != 1 {
+			t.Errorf("loaded node = %+v, want offline, seen once on %d", node, now)
+		}
+	}
+	if events := restored.Check(now + 3600); len(events) != 0 {
+		t.Errorf("Check of loaded nodes = %v, want no event", events)
+	}
+
+	recordNodeEvent(restored, "kitchen", now+3600)
+	if events := injectedEvents(handler); len(events) != 1 || events[0].Type != NODE_ONLINE_EVENT_TYPE || events[0].From != "kitchen" {
+		t.Errorf("injected %v, want a kitchen online event", events)
+	}
+
+	// The offline state of the loaded nodes is persisted
+	if err := restored.Flush(context.Background()); err != nil {
+		t.Fatalf("Flush: %s", err)
+	}
+	value, err := backend.Get(context.Background(), NodeKey("cellar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var persisted Node
+	if err := json.Unmarshal(value, &persisted); err != nil || persisted.Online {
+		t.Errorf("persisted cellar node %s, want offline", value)
+	}
+}
@@ -0,0 +1,698 @@
+package happening
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	l4g "github.com/alecthomas/log4go"
+)
+
+// Query is a compiled events filter expression, such as:
+//
+//	type = "temp" and from ~ "kitchen-*" and sent_on > now-1h
+//
+// Expressions compare events fields, from, type, sent_on,
+// received_on, value and attr.<key>, to string or numeric literals
+// using the =, !=, <, <=, >, >= and ~ (glob match) operators, and
+// combine comparisons using and, or, not and parentheses. Numeric
+// literals may be written in decimal or exponent notation, such as
+// 1.5e3, or relatively to the query time using now, and offset by
+// durations suffixed with s, m, h, d or w. String literals are double
+// or single quoted, and may hold backslash escapes.
+//
+// Comparisons on a field an event lacks, such as an attribute it
+// does not carry, or a numeric literal against a textual value,
+// never match.
+type Query struct {
+	text string
+	root queryNode
+}
+
+// Query errors
+var (
+	ErrInvalidQuery = errors.New("invalid query")
+)
+
+// ParseQuery compiles a query expression, resolving now
+// to the now unix timestamp.
+func ParseQuery(text string, now int64) (*Query, error) {
+	if len(text) > QUERY_MAX_LENGTH {
+		return nil, fmt.Errorf("%s: longer than %d characters", ErrInvalidQuery, QUERY_MAX_LENGTH)
+	}
+
+	tokens, err := lexQuery(text)
+	if err != nil {
+		return nil, err
+	}
+
+	parser := &queryParser{tokens: tokens, now: now}
+	root, err := parser.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if token := parser.peek(); token.kind != queryEOF {
+		return nil, parser.errorf(token, "unexpected %q", token.text)
+	}
+
+	return &Query{text: text, root: root}, nil
+}
+
+// String returns the query expression.
+func (q *Query) String() string {
+	return q.text
+}
+
+// Match returns whether an event matches the query.
+func (q *Query) Match(event *Event) bool {
+	return q.root.match(event)
+}
+
+// Narrow plans the query execution by narrowing the From, Type,
+// Since and Until fields of filter to the events the query may
+// match, so that they are looked up in the right index and time
+// range. Only comparisons every matching event satisfies, the ones
+// joined by a top level and, are taken into account.
+func (q *Query) Narrow(filter *EventFilter) {
+	for _, node := range queryConjuncts(q.root) {
+		comparison, ok := node.(*queryComparison)
+		if !ok {
+			continue
+		}
+
+		switch comparison.field {
+		case QUERY_FIELD_FROM:
+			if comparison.operator == "=" && filter.From == "" {
+				filter.From = comparison.text
+			}
+		case QUERY_FIELD_TYPE:
+			if comparison.operator == "=" && filter.Type == "" {
+				filter.Type = comparison.text
+			}
+		case QUERY_FIELD_SENT_ON:
+			comparison.narrowTimeRange(filter)
+		}
+	}
+}
+
+// queryConjuncts returns the nodes joined by the top
+// level and operators of a query.
+func queryConjuncts(node queryNode) []queryNode {
+	and, ok := node.(*queryAnd)
+	if !ok {
+		return []queryNode{node}
+	}
+
+	return append(queryConjuncts(and.left), queryConjuncts(and.right)...)
+}
+
+type queryNode interface {
+	match(event *Event) bool
+}
+
+type queryAnd struct {
+	left  queryNode
+	right queryNode
+}
+
+func (n *queryAnd) match(event *Event) bool {
+	return n.left.match(event) && n.right.match(event)
+}
+
+type queryOr struct {
+	left  queryNode
+	right queryNode
+}
+
+func (n *queryOr) match(event *Event) bool {
+	return n.left.match(event) || n.right.match(event)
+}
+
+type queryNot struct {
+	node queryNode
+}
+
+func (n *queryNot) match(event *Event) bool {
+	return !n.node.match(event)
+}
+
+// queryComparison compares an event field, or the attribute
+// key of it's attributes, to either a numeric or text literal.
+type queryComparison struct {
+	field     string
+	attribute string
+	operator  string
+	numeric   bool
+	number    float64
+	text      string
+}
+
+func (c *queryComparison) match(event *Event) bool {
+	switch c.field {
+	case QUERY_FIELD_FROM:
+		return c.matchText(event.From)
+	case QUERY_FIELD_TYPE:
+		return c.matchText(event.Type)
+	case QUERY_FIELD_SENT_ON:
+		return c.matchNumber(float64(event.SentOn))
+	case QUERY_FIELD_RECEIVED_ON:
+		return c.matchNumber(float64(event.ReceivedOn))
+	case QUERY_FIELD_VALUE:
+		if event.Value == nil {
+			return false
+		}
+		if c.numeric {
+			return event.Value.Numeric && c.matchNumber(event.Value.Number)
+		}
+		return c.matchText(event.Value.String())
+	default:
+		value, ok := event.Attributes[c.attribute]
+		if !ok {
+			return false
+		}
+		if c.numeric {
+			number, err := strconv.ParseFloat(value, 64)
+			return err == nil && c.matchNumber(number)
+		}
+		return c.matchText(value)
+	}
+}
+
+func (c *queryComparison) matchText(value string) bool {
+	if c.operator == "~" {
+		matched, _ := path.Match(c.text, value)
+		return matched
+	}
+
+	return c.compare(strings.Compare(value, c.text))
+}
+
+func (c *queryComparison) matchNumber(value float64) bool {
+	switch {
+	case value < c.number:
+		return c.compare(-1)
+	case value > c.number:
+		return c.compare(1)
+	default:
+		return c.compare(0)
+	}
+}
+
+// compare returns whether the comparison operator holds, given
+// the ordering of the compared value relatively to the literal.
+func (c *queryComparison) compare(order int) bool {
+	switch c.operator {
+	case "=":
+		return order == 0
+	case "!=":
+		return order != 0
+	case "<":
+		return order < 0
+	case "<=":
+		return order <= 0
+	case ">":
+		return order > 0
+	default:
+		return order >= 0
+	}
+}
+
+// narrowTimeRange narrows the [Since, Until) range of filter to the
+// events timestamps satisfying a sent_on comparison.
+func (c *queryComparison) narrowTimeRange(filter *EventFilter) {
+	if c.number < math.MinInt64/2 || c.number > math.MaxInt64/2 {
+		return
+	}
+
+	since, until := filter.Since, filter.Until
+	switch c.operator {
+	case "=":
+		since, until = int64(math.Ceil(c.number)), int64(math.Floor(c.number))+1
+	case ">":
+		since = int64(math.Floor(c.number)) + 1
+	case ">=":
+		since = int64(math.Ceil(c.number))
+	case "<":
+		until = int64(math.Ceil(c.number))
+	case "<=":
+		until = int64(math.Floor(c.number)) + 1
+	}
+
+	if since > filter.Since {
+		filter.Since = since
+	}
+	if until < filter.Until {
+		filter.Until = until
+	}
+}
+
+// Query tokens kinds
+const (
+	queryEOF = iota
+	queryIdentifier
+	queryString
+	queryNumber
+	queryDuration
+	queryOperator
+	queryPlus
+	queryMinus
+	queryOpenParen
+	queryCloseParen
+)
+
+type queryToken struct {
+	kind     int
+	text     string
+	position int
+}
+
+// queryDurations holds the query durations units, in seconds.
+var queryDurations = map[string]int64{
+	"s": 1,
+	"m": 60,
+	"h": 3600,
+	"d": 86400,
+	"w": 604800,
+}
+
+// lexQuery splits a query expression into tokens.
+func lexQuery(text string) ([]queryToken, error) {
+	var tokens []queryToken
+
+	for position := 0; position < len(text); {
+		start := position
+		char := text[position]
+
+		switch {
+		case char == ' ' || char == '\t' || char == '\r' || char == '\n':
+			position++
+			continue
+		case char == '(':
+			tokens = append(tokens, queryToken{queryOpenParen, "(", start})
+			position++
+		case char == ')':
+			tokens = append(tokens, queryToken{queryCloseParen, ")", start})
+			position++
+		case char == '+':
+			tokens = append(tokens, queryToken{queryPlus, "+", start})
+			position++
+		case char == '-':
+			tokens = append(tokens, queryToken{queryMinus, "-", start})
+			position++
+		case char == '=' || char == '~':
+			tokens = append(tokens, queryToken{queryOperator, string(char), start})
+			position++
+		case char == '!' || char == '<' || char == '>':
+			position++
+			if position < len(text) && text[position] == '=' {
+				position++
+			} else if char == '!' {
+				return nil, fmt.Errorf("%s: unexpected %q at offset %d", ErrInvalidQuery, "!", start)
+			}
+			tokens = append(tokens, queryToken{queryOperator, text[start:position], start})
+		case char == '"' || char == '\'':
+			position++
+			for position < len(text) && text[position] != char {
+				if text[position] == '\\' {
+					position++
+				}
+				position++
+			}
+			if position >= len(text) {
+				return nil, fmt.Errorf("%s: unterminated string at offset %d", ErrInvalidQuery, start)
+			}
+			position++
+
+			value, err := unquoteQueryString(text[start:position])
+			if err != nil {
+				return nil, fmt.Errorf("%s: malformed string at offset %d", ErrInvalidQuery, start)
+			}
+			tokens = append(tokens, queryToken{queryString, value, start})
+		case char >= '0' && char <= '9' || char == '.':
+			for position < len(text) && (isQueryDigit(text[position]) || text[position] == '.') {
+				position++
+			}
+			position += queryExponentLength(text[position:])
+			number := text[start:position]
+
+			for position < len(text) && unicode.IsLetter(rune(text[position])) {
+				position++
+			}
+			if unit := text[start+len(number) : position]; unit != "" {
+				if _, ok := queryDurations[unit]; !ok {
+					return nil, fmt.Errorf("%s: unknown duration unit %q at offset %d", ErrInvalidQuery, unit, start)
+				}
+				tokens = append(tokens, queryToken{queryDuration, text[start:position], start})
+			} else {
+				tokens = append(tokens, queryToken{queryNumber, number, start})
+			}
+		case isQueryIdentifier(char):
+			for position < len(text) && (isQueryIdentifier(text[position]) || isQueryDigit(text[position])) {
+				position++
+			}
+			tokens = append(tokens, queryToken{queryIdentifier, text[start:position], start})
+		default:
+			return nil, fmt.Errorf("%s: unexpected %q at offset %d", ErrInvalidQuery, char, start)
+		}
+	}
+
+	return append(tokens, queryToken{queryEOF, "", len(text)}), nil
+}
+
+// unquoteQueryString returns the value of a double or single quoted
+// string literal, whose backslash escapes follow the Go syntax, where
+// both \' and \" stand for a quote whichever the literal quotes.
+func unquoteQueryString(literal string) (string, error) {
+	quote := literal[0]
+
+	var value strings.Builder
+	for body := literal[1 : len(literal)-1]; len(body) > 0; {
+		if strings.HasPrefix(body, `\"`) || strings.HasPrefix(body, `\'`) {
+			value.WriteByte(body[1])
+			body = body[2:]
+			continue
+		}
+
+		char, multibyte, tail, err := strconv.UnquoteChar(body, quote)
+		if err != nil {
+			return "", err
+		}
+		if multibyte {
+			value.WriteRune(char)
+		} else {
+			value.WriteByte(byte(char))
+		}
+		body = tail
+	}
+
+	return value.String(), nil
+}
+
+// queryExponentLength returns the length of the exponent, such as
+// e5 or E-3, text starts with, if any.
+func queryExponentLength(text string) int {
+	if len(text) < 2 || text[0] != 'e' && text[0] != 'E' {
+		return 0
+	}
+
+	length := 1
+	if text[1] == '+' || text[1] == '-' {
+		length++
+	}
+
+	digits := length
+	for digits < len(text) && isQueryDigit(text[digits]) {
+		digits++
+	}
+	if digits == length {
+		return 0
+	}
+
+	return digits
+}
+
+func isQueryDigit(char byte) bool {
+	return char >= '0' && char <= '9'
+}
+
+func isQueryIdentifier(char byte) bool {
+	return char >= 'a' && char <= 'z' || char >= 'A' && char <= 'Z' || char == '_' || char == '.'
+}
+
+// queryParser is a recursive descent parser of the query grammar:
+//
+//	or         := and { "or" and }
+//	and        := unary { "and" unary }
+//	unary      := "not" unary | "(" or ")" | comparison
+//	comparison := field operator ( string | time )
+//	time       := ( number | "now" ) { ( "+" | "-" ) ( number | duration ) }
+type queryParser struct {
+	tokens   []queryToken
+	position int
+	now      int64
+}
+
+func (p *queryParser) peek() queryToken {
+	return p.tokens[p.position]
+}
+
+func (p *queryParser) next() queryToken {
+	token := p.tokens[p.position]
+	if token.kind != queryEOF {
+		p.position++
+	}
+	return token
+}
+
+// keyword consumes the next token if it is the given keyword.
+func (p *queryParser) keyword(keyword string) bool {
+	token := p.peek()
+	if token.kind == queryIdentifier && strings.EqualFold(token.text, keyword) {
+		p.position++
+		return true
+	}
+	return false
+}
+
+func (p *queryParser) errorf(token queryToken, format string, args ...interface{}) error {
+	if token.kind == queryEOF {
+		return fmt.Errorf("%s: unexpected end of query", ErrInvalidQuery)
+	}
+	return fmt.Errorf("%s: %s at offset %d", ErrInvalidQuery, fmt.Sprintf(format, args...), token.position)
+}
+
+func (p *queryParser) parseOr() (queryNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.keyword("or") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &queryOr{left, right}
+	}
+
+	return left, nil
+}
+
+func (p *queryParser) parseAnd() (queryNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.keyword("and") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &queryAnd{left, right}
+	}
+
+	return left, nil
+}
+
+func (p *queryParser) parseUnary() (queryNode, error) {
+	if p.keyword("not") {
+		node, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &queryNot{node}, nil
+	}
+
+	if p.peek().kind == queryOpenParen {
+		p.next()
+
+		node, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+
+		if token := p.next(); token.kind != queryCloseParen {
+			return nil, p.errorf(token, "expected %q, got %q", ")", token.text)
+		}
+		return node, nil
+	}
+
+	return p.parseComparison()
+}
+
+func (p *queryParser) parseComparison() (queryNode, error) {
+	comparison := &queryComparison{}
+
+	field := p.next()
+	if field.kind != queryIdentifier {
+		return nil, p.errorf(field, "expected a field, got %q", field.text)
+	}
+	comparison.field = strings.ToLower(field.text)
+
+	switch comparison.field {
+	case QUERY_FIELD_FROM, QUERY_FIELD_TYPE, QUERY_FIELD_SENT_ON, QUERY_FIELD_RECEIVED_ON, QUERY_FIELD_VALUE:
+	default:
+		if !strings.HasPrefix(comparison.field, QUERY_ATTRIBUTE_PREFIX) || len(field.text) == len(QUERY_ATTRIBUTE_PREFIX) {
+			return nil, p.errorf(field, "unknown field %q", field.text)
+		}
+		comparison.attribute = field.text[len(QUERY_ATTRIBUTE_PREFIX):]
+	}
+
+	operator := p.next()
+	if operator.kind != queryOperator {
+		return nil, p.errorf(operator, "expected an operator, got %q", operator.text)
+	}
+	comparison.operator = operator.text
+
+	literal := p.peek()
+	if literal.kind == queryString {
+		p.next()
+		comparison.text = literal.text
+	} else {
+		number, err := p.parseTime()
+		if err != nil {
+			return nil, err
+		}
+		comparison.numeric = true
+		comparison.number = number
+	}
+
+	switch {
+	case comparison.numeric && comparison.operator == "~":
+		return nil, p.errorf(literal, "%s expects a string pattern", comparison.operator)
+	case comparison.numeric && (comparison.field == QUERY_FIELD_FROM || comparison.field == QUERY_FIELD_TYPE):
+		return nil, p.errorf(literal, "%s expects a string", field.text)
+	case !comparison.numeric && (comparison.field == QUERY_FIELD_SENT_ON || comparison.field == QUERY_FIELD_RECEIVED_ON):
+		return nil, p.errorf(literal, "%s expects a time", field.text)
+	}
+
+	if comparison.operator == "~" {
+		if _, err := path.Match(comparison.text, ""); err != nil {
+			return nil, p.errorf(literal, "malformed pattern %q", comparison.text)
+		}
+	}
+
+	return comparison, nil
+}
+
+// parseTime parses a numeric literal, possibly relative to
+// the query time, and offset by durations.
+func (p *queryParser) parseTime() (float64, error) {
+	var value float64
+
+	token := p.next()
+	switch {
+	case token.kind == queryIdentifier && strings.EqualFold(token.text, QUERY_NOW):
+		value = float64(p.now)
+	case token.kind == queryMinus || token.kind == queryNumber:
+		number, err := p.parseNumber(token)
+		if err != nil {
+			return 0, err
+		}
+		value = number
+	default:
+		return 0, p.errorf(token, "expected a string, number or time, got %q", token.text)
+	}
+
+	for p.peek().kind == queryPlus || p.peek().kind == queryMinus {
+		sign := 1.0
+		if p.next().kind == queryMinus {
+			sign = -1.0
+		}
+
+		offset, err := p.parseOffset(p.next())
+		if err != nil {
+			return 0, err
+		}
+		value += sign * offset
+	}
+
+	return value, nil
+}
+
+// parseNumber parses a number literal, possibly negative.
+func (p *queryParser) parseNumber(token queryToken) (float64, error) {
+	sign := 1.0
+	if token.kind == queryMinus {
+		sign = -1.0
+		token = p.next()
+	}
+
+	if token.kind != queryNumber {
+		return 0, p.errorf(token, "expected a number, got %q", token.text)
+	}
+
+	number, err := strconv.ParseFloat(token.text, 64)
+	if err != nil {
+		return 0, p.errorf(token, "malformed number %q", token.text)
+	}
+
+	return sign * number, nil
+}
+
+// parseOffset parses a number, or a duration in seconds.
+func (p *queryParser) parseOffset(token queryToken) (float64, error) {
+	if token.kind != queryDuration {
+		return p.parseNumber(token)
+	}
+
+	// The unit follows the number, which may hold an exponent
+	unitStart := strings.LastIndexFunc(token.text, func(char rune) bool { return !unicode.IsLetter(char) }) + 1
+	number, err := strconv.ParseFloat(token.text[:unitStart], 64)
+	if err != nil {
+		return 0, p.errorf(token, "malformed duration %q", token.text)
+	}
+
+	return number * float64(queryDurations[token.text[unitStart:]]), nil
+}
+
+// QueryStoredEvents writes the events of the storage backend selected
+// by config matching a query expression to w, as json lines.
+func QueryStoredEvents(config *Config, text string, w io.Writer) error {
+	query, err := ParseQuery(text, time.Now().Unix())
+	if err != nil {
+		return err
+	}
+
+	filter := NewEventFilter()
+	filter.Query = query
+	query.Narrow(filter)
+
+	backend, err := NewStorageBackend(config)
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+
+	var count int
+	var writeErr error
+
+	encoder := json.NewEncoder(w)
+	err = NewEventStore(backend).scan(context.Background(), filter, nil, func(position []byte, key []byte, event *Event) bool {
+		if writeErr = encoder.Encode(newEventResponse(event)); writeErr != nil {
+			return false
+		}
+		count++
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+
+	l4g.Info(fmt.Sprintf("[QueryStoredEvents] %d events matched", count))
+
+	return nil
+}
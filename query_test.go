@@ -0,0 +1,253 @@
+package happening
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+// testQueryNow is the query time the tests queries are parsed at
+const testQueryNow = 1392821124
+
+// testQueryEvent returns a kitchen temperature event
+// sent at testQueryNow and received a second later.
+func testQueryEvent() *Event {
+	event := NewEvent("kitchen", testQueryNow, testQueryNow+1, "temperature")
+	event.Value = NewNumericValue(21.5)
+	event.Attributes = map[string]string{"unit": "celsius", "floor": "2"}
+
+	return event
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	tests := []string{
+		"",
+		"type",
+		"type =",
+		"type = 'temperature' and",
+		"type = 'temperature' or or type = 'humidity'",
+		"(type = 'temperature'",
+		"type = 'temperature')",
+		"type 'temperature'",
+		"type ! 'temperature'",
+		"type = 'temperature",
+		`type = "temp\qerature"`,
+		"type = 21.5",
+		"from ~ 1",
+		"type ~ '['",
+		"sent_on > 'yesterday'",
+		"sent_on > now - 1y",
+		"sent_on > now - 1e",
+		"sent_on > now +",
+		"color = 'blue'",
+		"attr. = 'blue'",
+		"value = 1.2.3",
+		"type = 'temperature' @",
+		"type = 'temperature' type = 'humidity'",
+		"type = '" + strings.Repeat("a", QUERY_MAX_LENGTH) + "'",
+	}
+
+	for _, text := range tests {
+		query, err := ParseQuery(text, testQueryNow)
+		if err == nil || !strings.HasPrefix(err.Error(), ErrInvalidQuery.Error()) {
+			t.Errorf("ParseQuery(%.40q) = %v, %v, want a %s error", text, query, err, ErrInvalidQuery)
+		}
+	}
+}
+
+func TestParseQueryLiterals(t *testing.T) {
+	tests := []struct {
+		literal string
+		text    string
+		number  float64
+	}{
+		{`"kitchen"`, "kitchen", 0},
+		{`'kitchen'`, "kitchen", 0},
+		{`'it\'s'`, "it's", 0},
+		{`'say \"hi\"'`, `say "hi"`, 0},
+		{`"say \"hi\""`, `say "hi"`, 0},
+		{`"it\'s"`, "it's", 0},
+		{`'a\\b'`, `a\b`, 0},
+		{`'tab\tcr\r'`, "tab\tcr\r", 0},
+		{`'ét\xc3\xa9'`, "été", 0},
+		{`'été'`, "été", 0},
+		{`""`, "", 0},
+		{"21.5", "", 21.5},
+		{"-3", "", -3},
+		{".5", "", 0.5},
+		{"1e5", "", 1e5},
+		{"1.5E-3", "", 1.5e-3},
+		{"2e+2", "", 200},
+		{"now", "", testQueryNow},
+		{"now - 1h", "", testQueryNow - 3600},
+		{"now-1.5d+2m", "", testQueryNow - 129600 + 120},
+		{"now - 1e1s", "", testQueryNow - 10},
+		{"100 + 1w - 4", "", 100 + 604800 - 4},
+	}
+
+	for _, test := range tests {
+		query, err := ParseQuery("attr.key = "+test.literal, testQueryNow)
+		if err != nil {
+			t.Errorf("ParseQuery(%s): %s", test.literal, err)
+			continue
+		}
+
+		comparison := query.root.(*queryComparison)
+		if comparison.text != test.text || comparison.number != test.number {
+			t.Errorf("%s parsed as %q, %v, want %q, %v", test.literal, comparison.text, comparison.number, test.text, test.number)
+		}
+	}
+}
+
+func TestQueryPrecedence(t *testing.T) {
+	tests := []struct {
+		text string
+		want bool
+	}{
+		// and binds tighter than or
+		{"type = 'temperature' or type = 'humidity' and from = 'cellar'", true},
+		{"(type = 'temperature' or type = 'humidity') and from = 'cellar'", false},
+		{"from = 'cellar' and type = 'humidity' or type = 'temperature'", true},
+		{"from = 'cellar' and (type = 'humidity' or type = 'temperature')", false},
+		// not binds tighter than and
+		{"not from = 'cellar' and type = 'humidity'", false},
+		{"not (from = 'cellar' and type = 'humidity')", true},
+		{"not not from = 'kitchen'", true},
+		// keywords are case insensitive
+		{"NOT from = 'cellar' AND type = 'temperature' Or type = 'humidity'", true},
+		// operators are left associative
+		{"from = 'kitchen' or type = 'humidity' and from = 'cellar' or value < 0", true},
+	}
+
+	for _, test := range tests {
+		query, err := ParseQuery(test.text, testQueryNow)
+		if err != nil {
+			t.Errorf("ParseQuery(%s): %s", test.text, err)
+			continue
+		}
+
+		if got := query.Match(testQueryEvent()); got != test.want {
+			t.Errorf("%s matched = %t, want %t", test.text, got, test.want)
+		}
+	}
+}
+
+func TestQueryMatch(t *testing.T) {
+	textual := testQueryEvent()
+	textual.Value = NewTextValue("open")
+
+	bare := testQueryEvent()
+	bare.Value = nil
+	bare.Attributes = nil
+
+	tests := []struct {
+		text  string
+		event *Event
+		want  bool
+	}{
+		{"from = 'kitchen'", testQueryEvent(), true},
+		{"from != 'kitchen'", testQueryEvent(), false},
+		{"from ~ 'kit*'", testQueryEvent(), true},
+		{"from ~ 'k?tchen'", testQueryEvent(), true},
+		{"from ~ 'cellar*'", testQueryEvent(), false},
+		{"type > 'humidity'", testQueryEvent(), true},
+		{"type <= 'humidity'", testQueryEvent(), false},
+		{"sent_on = now", testQueryEvent(), true},
+		{"sent_on > now - 1m", testQueryEvent(), true},
+		{"sent_on < now", testQueryEvent(), false},
+		{"sent_on <= now", testQueryEvent(), true},
+		{"received_on > now", testQueryEvent(), true},
+		{"received_on >= now + 2s", testQueryEvent(), false},
+		{"value = 21.5", testQueryEvent(), true},
+		{"value > 2.15e1", testQueryEvent(), false},
+		{"value >= -5", testQueryEvent(), true},
+		{"value = '21.5'", testQueryEvent(), true},
+		{"value = 'open'", textual, true},
+		{"value ~ 'op*'", textual, true},
+		{"value > 0", textual, false},
+		{"value != 0", textual, false},
+		{"value != 0", bare, false},
+		{"value = ''", bare, false},
+		{"attr.unit = 'celsius'", testQueryEvent(), true},
+		{"attr.unit ~ 'c*'", testQueryEvent(), true},
+		{"attr.floor = 2", testQueryEvent(), true},
+		{"attr.floor >= 3", testQueryEvent(), false},
+		{"attr.unit > 0", testQueryEvent(), false},
+		{"attr.unit != 'fahrenheit'", testQueryEvent(), true},
+		{"attr.unit != 'fahrenheit'", bare, false},
+		{"not attr.unit = 'celsius'", bare, true},
+		{"attr.Unit = 'celsius'", testQueryEvent(), false},
+	}
+
+	for _, test := range tests {
+		query, err := ParseQuery(test.text, testQueryNow)
+		if err != nil {
+			t.Errorf("ParseQuery(%s): %s", test.text, err)
+			continue
+		}
+
+		if got := query.Match(test.event); got != test.want {
+			t.Errorf("%s matched %s = %t, want %t", test.text, test.event, got, test.want)
+		}
+	}
+}
+
+func TestQueryNarrow(t *testing.T) {
+	tests := []struct {
+		text  string
+		from  string
+		kind  string
+		since int64
+		until int64
+	}{
+		{"from = 'kitchen' and type = 'temperature'", "kitchen", "temperature", math.MinInt64, math.MaxInt64},
+		{"from ~ 'kitchen' and type != 'temperature'", "", "", math.MinInt64, math.MaxInt64},
+		{"from = 'kitchen' or type = 'temperature'", "", "", math.MinInt64, math.MaxInt64},
+		{"not from = 'kitchen'", "", "", math.MinInt64, math.MaxInt64},
+		{"(from = 'kitchen' and type = 'temperature')", "kitchen", "temperature", math.MinInt64, math.MaxInt64},
+		{"sent_on >= now - 1h", "", "", testQueryNow - 3600, math.MaxInt64},
+		{"sent_on > now - 1h", "", "", testQueryNow - 3599, math.MaxInt64},
+		{"sent_on < now", "", "", math.MinInt64, testQueryNow},
+		{"sent_on <= now", "", "", math.MinInt64, testQueryNow + 1},
+		{"sent_on = now", "", "", testQueryNow, testQueryNow + 1},
+		{"sent_on > 10.5 and sent_on < 20.5", "", "", 11, 21},
+		{"sent_on >= 10.5 and sent_on <= 20.5", "", "", 11, 21},
+		{"sent_on = 10.5", "", "", 11, 11},
+		{"sent_on > 10 and sent_on > 20 and sent_on < 40 and sent_on < 30", "", "", 21, 30},
+		{"sent_on != 10 and received_on > 10", "", "", math.MinInt64, math.MaxInt64},
+		{"sent_on > 10 or sent_on < 5", "", "", math.MinInt64, math.MaxInt64},
+		{"sent_on > 1e300", "", "", math.MinInt64, math.MaxInt64},
+	}
+
+	for _, test := range tests {
+		query, err := ParseQuery(test.text, testQueryNow)
+		if err != nil {
+			t.Errorf("ParseQuery(%s): %s", test.text, err)
+			continue
+		}
+
+		filter := NewEventFilter()
+		query.Narrow(filter)
+		if filter.From != test.from || filter.Type != test.kind || filter.Since != test.since || filter.Until != test.until {
+			t.Errorf("%s narrowed to from %q, type %q, [%d, %d), want from %q, type %q, [%d, %d)",
+				test.text, filter.From, filter.Type, filter.Since, filter.Until,
+				test.from, test.kind, test.since, test.until)
+		}
+	}
+}
+
+func TestQueryNarrowKeepsFilter(t *testing.T) {
+	query, err := ParseQuery("from = 'kitchen' and sent_on > 10 and sent_on < 100", testQueryNow)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	filter := NewEventFilter()
+	filter.From = "cellar"
+	filter.Since, filter.Until = 50, 200
+	query.Narrow(filter)
+
+	if filter.From != "cellar" || filter.Since != 50 || filter.Until != 100 {
+		t.Errorf("narrowed filter = from %q, [%d, %d), want from %q, [50, 100)", filter.From, filter.Since, filter.Until, "cellar")
+	}
+}
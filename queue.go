@@ -1,26 +1,219 @@
 package happening
 
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Queue errors
+var (
+	ErrQueueFull          = errors.New("queue is full")
+	ErrQueueDropped       = errors.New("queue is full, node dropped")
+	ErrInvalidQueuePolicy = errors.New("invalid queue overflow policy")
+	ErrInvalidQueueSize   = errors.New("invalid queue size")
+)
+
 // Queue is a basic FIFO queue based on a circular list that resizes as needed.
+// It is safe for concurrent use.
+//
+// A queue may be bounded to a maximum size, in which case pushing
+// to a full queue follows it's overflow policy: QUEUE_POLICY_BLOCK
+// waits for room to be made, up to QUEUE_BLOCK_TIMEOUT,
+// QUEUE_POLICY_DROP_OLDEST evicts the oldest node,
+// QUEUE_POLICY_DROP_NEWEST discards the pushed node, reporting it with
+// ErrQueueDropped, and
+// QUEUE_POLICY_REJECT refuses it.
 type Queue struct {
-	nodes []interface{}
-	size  int
-	head  int
-	tail  int
-	count int
+	nodes    []interface{}
+	size     int
+	head     int
+	tail     int
+	count    int
+	maxSize  int
+	policy   string
+	dropped  uint64
+	rejected uint64
+	mu       sync.Mutex
+	notFull  *sync.Cond
 }
 
-// NewQueue returns a new queue with the given initial size.
+// NewQueue returns a new unbounded queue with the given initial size,
+// which is also the number of nodes it grows by. A size lower than one
+// is raised to one.
 func NewQueue(size int) *Queue {
-	return &Queue{
+	if size < 1 {
+		size = 1
+	}
+
+	q := &Queue{
 		nodes: make([]interface{}, size),
 		size:  size,
 	}
+	q.notFull = sync.NewCond(&q.mu)
+
+	return q
 }
 
-// Push adds a node to the queue.
-func (q *Queue) Push(n interface{}) {
+// NewBoundedQueue returns a new queue with the given initial size,
+// holding at most maxSize nodes, and handling overflows according
+// to policy. A zero maxSize leaves the queue unbounded.
+func NewBoundedQueue(size int, maxSize int, policy string) (*Queue, error) {
+	switch policy {
+	case QUEUE_POLICY_BLOCK, QUEUE_POLICY_DROP_OLDEST, QUEUE_POLICY_DROP_NEWEST, QUEUE_POLICY_REJECT:
+	default:
+		return nil, fmt.Errorf("%s: %q", ErrInvalidQueuePolicy, policy)
+	}
+
+	if size < 1 {
+		return nil, fmt.Errorf("%s: %d", ErrInvalidQueueSize, size)
+	}
+
+	if maxSize < 0 {
+		return nil, fmt.Errorf("%s: %d", ErrInvalidQueueSize, maxSize)
+	}
+
+	if maxSize > 0 && size > maxSize {
+		size = maxSize
+	}
+
+	q := NewQueue(size)
+	q.maxSize = maxSize
+	q.policy = policy
+
+	return q, nil
+}
+
+// Push adds a node to the queue. Whenever the queue overflows, it
+// returns the queued node which was dropped in the process, if any,
+// ErrQueueDropped if n was dropped instead, or ErrQueueFull if n
+// was refused.
+func (q *Queue) Push(n interface{}) (interface{}, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var dropped interface{}
+
+	if q.full() {
+		switch q.policy {
+		case QUEUE_POLICY_BLOCK:
+			if !q.waitNotFull(time.Duration(QUEUE_BLOCK_TIMEOUT) * time.Second) {
+				q.rejected++
+				return nil, ErrQueueFull
+			}
+		case QUEUE_POLICY_DROP_OLDEST:
+			dropped = q.pop()
+			q.dropped++
+		case QUEUE_POLICY_DROP_NEWEST:
+			q.dropped++
+			return nil, ErrQueueDropped
+		default:
+			q.rejected++
+			return nil, ErrQueueFull
+		}
+	}
+
+	q.push(n)
+
+	return dropped, nil
+}
+
+// Restore adds a node to the queue regardless of it's maximum
+// size, for nodes which must not be lost, recovered ones for
+// example.
+func (q *Queue) Restore(n interface{}) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.push(n)
+}
+
+// Pop removes and returns a node from the queue in first to last order.
+func (q *Queue) Pop() interface{} {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.pop()
+}
+
+// PopN removes and returns up to n nodes from the queue
+// in first to last order.
+func (q *Queue) PopN(n int) []interface{} {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if n > q.count {
+		n = q.count
+	}
+
+	nodes := make([]interface{}, n)
+	for i := 0; i < n; i++ {
+		nodes[i] = q.pop()
+	}
+
+	return nodes
+}
+
+// Len returns the number of nodes currently in the queue.
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.count
+}
+
+// Dropped returns the number of nodes the queue dropped
+// on overflow since it was created.
+func (q *Queue) Dropped() uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.dropped
+}
+
+// Rejected returns the number of nodes the queue refused
+// on overflow since it was created.
+func (q *Queue) Rejected() uint64 {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.rejected
+}
+
+func (q *Queue) full() bool {
+	return q.maxSize > 0 && q.count >= q.maxSize
+}
+
+// waitNotFull waits, for at most timeout, for the queue to have
+// room for a node. It reports whether room was made.
+func (q *Queue) waitNotFull(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	timer := time.AfterFunc(timeout, func() {
+		q.mu.Lock()
+		defer q.mu.Unlock()
+		q.notFull.Broadcast()
+	})
+	defer timer.Stop()
+
+	for q.full() {
+		if !time.Now().Before(deadline) {
+			return false
+		}
+		q.notFull.Wait()
+	}
+
+	return true
+}
+
+func (q *Queue) push(n interface{}) {
 	if q.head == q.tail && q.count > 0 {
-		nodes := make([]interface{}, len(q.nodes)+q.size)
+		length := len(q.nodes) + q.size
+		if q.maxSize > len(q.nodes) && length > q.maxSize {
+			length = q.maxSize
+		}
+
+		nodes := make([]interface{}, length)
 		copy(nodes, q.nodes[q.head:])
 		copy(nodes[len(q.nodes)-q.head:], q.nodes[:q.head])
 		q.head = 0
@@ -32,13 +225,14 @@ func (q *Queue) Push(n interface{}) {
 	q.count++
 }
 
-// Pop removes and returns a node from the queue in first to last order.
-func (q *Queue) Pop() interface{} {
+func (q *Queue) pop() interface{} {
 	if q.count == 0 {
 		return nil
 	}
 	node := q.nodes[q.head]
+	q.nodes[q.head] = nil
 	q.head = (q.head + 1) % len(q.nodes)
 	q.count--
+	q.notFull.Signal()
 	return node
 }
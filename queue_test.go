@@ -0,0 +1,88 @@
+package happening
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestQueueOverflowPolicies(t *testing.T) {
+	tests := []struct {
+		policy  string
+		node    interface{}
+		err     error
+		want    []interface{}
+		dropped uint64
+	}{
+		{QUEUE_POLICY_DROP_OLDEST, 1, nil, []interface{}{2, 3}, 1},
+		{QUEUE_POLICY_DROP_NEWEST, nil, ErrQueueDropped, []interface{}{1, 2}, 1},
+		{QUEUE_POLICY_REJECT, nil, ErrQueueFull, []interface{}{1, 2}, 0},
+	}
+
+	for _, test := range tests {
+		queue, err := NewBoundedQueue(1, 2, test.policy)
+		if err != nil {
+			t.Fatalf("%s: NewBoundedQueue: %s", test.policy, err)
+		}
+		queue.Push(1)
+		queue.Push(2)
+
+		node, err := queue.Push(3)
+		if node != test.node || !errors.Is(err, test.err) {
+			t.Errorf("%s: Push = %v, %v, want %v, %v", test.policy, node, err, test.node, test.err)
+		}
+
+		if got := queue.PopN(3); len(got) != len(test.want) || got[0] != test.want[0] || got[1] != test.want[1] {
+			t.Errorf("%s: queued nodes = %v, want %v", test.policy, got, test.want)
+		}
+		if queue.Dropped() != test.dropped {
+			t.Errorf("%s: Dropped = %d, want %d", test.policy, queue.Dropped(), test.dropped)
+		}
+	}
+}
+
+func TestQueueSizes(t *testing.T) {
+	queue := NewQueue(0)
+	for index := 0; index < 3; index++ {
+		queue.Push(index)
+	}
+	if queue.Len() != 3 {
+		t.Errorf("Len = %d, want 3", queue.Len())
+	}
+
+	if _, err := NewBoundedQueue(0, 10, QUEUE_POLICY_BLOCK); err == nil || !strings.HasPrefix(err.Error(), ErrInvalidQueueSize.Error()) {
+		t.Errorf("NewBoundedQueue(0) error = %v, want %s", err, ErrInvalidQueueSize)
+	}
+	if _, err := NewBoundedQueue(1, -1, QUEUE_POLICY_BLOCK); err == nil || !strings.HasPrefix(err.Error(), ErrInvalidQueueSize.Error()) {
+		t.Errorf("NewBoundedQueue(maxSize -1) error = %v, want %s", err, ErrInvalidQueueSize)
+	}
+}
+
+func TestPushEventsToQueueDroppedEvent(t *testing.T) {
+	handler := NewEventsHandler()
+	queue, err := NewBoundedQueue(1, 1, QUEUE_POLICY_DROP_NEWEST)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler.Queue = queue
+
+	frames, err := ExtractFrames(PipeCodec{}, []byte("kitchen|1392821124|temperature\r\ncellar|1392821124|temperature\r\n"))
+	if err != nil || len(frames) != 2 {
+		t.Fatalf("ExtractFrames = %d frames, %v", len(frames), err)
+	}
+
+	events, errs := handler.PushEventsToQueue(PipeCodec{}, frames, &EventsSource{})
+	if events[0] == nil || errs[0] != nil {
+		t.Errorf("first event = %v, %v, want it queued", events[0], errs[0])
+	}
+	if eventErr, ok := errs[1].(*EventError); events[1] != nil || !ok || eventErr.Code != NACK_QUEUE_FULL {
+		t.Errorf("dropped event = %v, %v, want a %d NACK", events[1], errs[1], NACK_QUEUE_FULL)
+	}
+
+	if published := len(handler.EventsChannel); published != 1 {
+		t.Errorf("%d events published, want 1", published)
+	}
+	if acks := acknowledgement(errs[1]); acks == ACK_MSG+MSG_DELIMITER {
+		t.Errorf("dropped event acknowledged")
+	}
+}
@@ -0,0 +1,162 @@
+package happening
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// Rate limiting errors
+var (
+	ErrRateLimited        = errors.New("rate limit exceeded")
+	ErrInvalidLimitAction = errors.New("invalid rate limit action")
+	ErrFrameTooLong       = errors.New("event frame too long")
+)
+
+// RateLimiter enforces a token bucket rate limit per key, a remote
+// address or a node name for example: each key is allowed Rate
+// events per second on average, and bursts of up to Burst events.
+//
+// Buckets which were refilled are forgotten every RATE_LIMIT_PRUNE_INTERVAL,
+// and at most RATE_LIMIT_MAX_KEYS keys are tracked at once: events
+// of any other key are refused until some buckets are forgotten.
+type RateLimiter struct {
+	Rate  float64
+	Burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	pruned  time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter builds a RateLimiter allowing rate events per
+// second and per key, in bursts of up to burst events. A burst
+// lower than rate is raised to rate.
+func NewRateLimiter(rate int, burst int) *RateLimiter {
+	if burst < rate {
+		burst = rate
+	}
+
+	return &RateLimiter{
+		Rate:    float64(rate),
+		Burst:   float64(burst),
+		buckets: make(map[string]*tokenBucket),
+		pruned:  time.Now(),
+	}
+}
+
+// Allow consumes a token of key bucket on now, and returns
+// whether the event it stands for is within the rate limit.
+func (l *RateLimiter) Allow(key string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.pruned) >= time.Duration(RATE_LIMIT_PRUNE_INTERVAL)*time.Second {
+		l.prune(now)
+	}
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		if len(l.buckets) >= RATE_LIMIT_MAX_KEYS {
+			l.prune(now)
+			if len(l.buckets) >= RATE_LIMIT_MAX_KEYS {
+				return false
+			}
+		}
+
+		bucket = &tokenBucket{tokens: l.Burst, last: now}
+		l.buckets[key] = bucket
+	}
+
+	l.refill(bucket, now)
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+
+	return true
+}
+
+// refill adds the tokens earned by a bucket since it was last refilled.
+func (l *RateLimiter) refill(bucket *tokenBucket, now time.Time) {
+	if elapsed := now.Sub(bucket.last).Seconds(); elapsed > 0 {
+		bucket.tokens += elapsed * l.Rate
+		if bucket.tokens > l.Burst {
+			bucket.tokens = l.Burst
+		}
+		bucket.last = now
+	}
+}
+
+// prune forgets the buckets which were refilled on now,
+// as they would be rebuilt in the exact same state.
+func (l *RateLimiter) prune(now time.Time) {
+	for key, bucket := range l.buckets {
+		l.refill(bucket, now)
+		if bucket.tokens >= l.Burst {
+			delete(l.buckets, key)
+		}
+	}
+	l.pruned = now
+}
+
+// ValidateLimitAction checks action is one of the
+// RATE_LIMIT_ACTION_* rate limits actions.
+func ValidateLimitAction(action string) error {
+	switch action {
+	case RATE_LIMIT_ACTION_DROP, RATE_LIMIT_ACTION_NACK, RATE_LIMIT_ACTION_DISCONNECT:
+		return nil
+	}
+
+	return fmt.Errorf("%s: %q", ErrInvalidLimitAction, action)
+}
+
+// addrHost returns the host part of a remote address,
+// so that every port of a host shares it's rate limit.
+func addrHost(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+
+	return host
+}
+
+// rateLimited returns whether any of errs is a rate limit error.
+func rateLimited(errs []error) bool {
+	for _, err := range errs {
+		if eventErr, ok := err.(*EventError); ok && eventErr.Code == NACK_RATE_LIMITED {
+			return true
+		}
+	}
+
+	return false
+}
+
+// frameTooLong returns the error a frame
+// of length bytes is refused with.
+func frameTooLong(length int) error {
+	return &EventError{Code: NACK_FRAME_TOO_LONG, Message: fmt.Sprintf("%s: %d bytes", ErrFrameTooLong, length)}
+}
+
+// limitedConn is a net.Conn releasing it's slot of
+// the connexions limit once closed.
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+
+	return err
+}
@@ -0,0 +1,171 @@
+package happening
+
+import (
+	"bufio"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// allowed returns how many of count events of key limiter allows on now.
+func allowed(limiter *RateLimiter, key string, now time.Time, count int) int {
+	var allowed int
+	for index := 0; index < count; index++ {
+		if limiter.Allow(key, now) {
+			allowed++
+		}
+	}
+
+	return allowed
+}
+
+func TestRateLimiterRefill(t *testing.T) {
+	limiter := NewRateLimiter(2, 4)
+	now := time.Now()
+
+	tests := []struct {
+		name    string
+		elapsed time.Duration
+		want    int
+	}{
+		{"burst", 0, 4},
+		{"half a token", 250 * time.Millisecond, 0},
+		{"a token", 500 * time.Millisecond, 1},
+		{"three tokens", 2 * time.Second, 3},
+		{"capped to the burst", 10 * time.Second, 4},
+	}
+
+	for _, test := range tests {
+		if got := allowed(limiter, "kitchen", now.Add(test.elapsed), 10); got != test.want {
+			t.Errorf("%s: %d events allowed, want %d", test.name, got, test.want)
+		}
+	}
+
+	// Each key has it's own bucket
+	if got := allowed(limiter, "cellar", now.Add(10*time.Second), 10); got != 4 {
+		t.Errorf("other key: %d events allowed, want 4", got)
+	}
+
+	if limiter := NewRateLimiter(5, 1); limiter.Burst != 5 {
+		t.Errorf("burst lower than the rate = %v, want 5", limiter.Burst)
+	}
+}
+
+func TestRateLimiterMaxKeys(t *testing.T) {
+	limiter := NewRateLimiter(1, 1)
+	now := time.Now()
+
+	for index := 0; index < RATE_LIMIT_MAX_KEYS; index++ {
+		limiter.Allow("node"+strconv.Itoa(index), now)
+	}
+
+	// Events of new keys are refused while every bucket is in use,
+	if limiter.Allow("kitchen", now) {
+		t.Errorf("event of a key beyond RATE_LIMIT_MAX_KEYS allowed")
+	}
+
+	// and allowed once refilled buckets can be forgotten.
+	if !limiter.Allow("kitchen", now.Add(time.Second)) {
+		t.Errorf("event of a new key refused once buckets were refilled")
+	}
+	if keys := len(limiter.buckets); keys != 1 {
+		t.Errorf("%d buckets tracked, want 1", keys)
+	}
+
+	// Refilled buckets are forgotten every RATE_LIMIT_PRUNE_INTERVAL
+	limiter.Allow("cellar", now.Add(time.Second))
+	limiter.Allow("cellar", now.Add(time.Second+time.Duration(RATE_LIMIT_PRUNE_INTERVAL)*time.Second))
+	if keys := len(limiter.buckets); keys != 1 {
+		t.Errorf("%d buckets tracked after pruning, want 1", keys)
+	}
+}
+
+func TestNetworkServiceMaxConnexions(t *testing.T) {
+	ns := NewNetworkService("NetworkService")
+	ns.MaxConnexions = 2
+
+	admit := func() (net.Conn, bool) {
+		client, server := net.Pipe()
+		t.Cleanup(func() {
+			client.Close()
+			server.Close()
+		})
+		return ns.admit(server)
+	}
+
+	first, ok := admit()
+	if !ok {
+		t.Fatalf("first connexion refused")
+	}
+	if _, ok := admit(); !ok {
+		t.Fatalf("second connexion refused")
+	}
+	if _, ok := admit(); ok {
+		t.Errorf("connexion beyond MaxConnexions admitted")
+	}
+
+	// Closing a connexion releases it's slot, once
+	first.Close()
+	first.Close()
+	if _, ok := admit(); !ok {
+		t.Errorf("connexion refused once a slot was released")
+	}
+	if _, ok := admit(); ok {
+		t.Errorf("connexion admitted in the slot released twice")
+	}
+
+	ns.MaxConnexions = 0
+	if conn, ok := admit(); !ok {
+		t.Errorf("connexion refused without a limit")
+	} else if _, limited := conn.(*limitedConn); limited {
+		t.Errorf("connexion accounted for without a limit")
+	}
+}
+
+func TestEventsHandlerLimitActions(t *testing.T) {
+	frames := "kitchen|1392821124|temperature|21.5\r\n" +
+		"kitchen|1392821125|temperature|21.6\r\n" +
+		"kitchen|1392821126|temperature|21.7\r\n"
+
+	tests := []struct {
+		action       string
+		replies      []string
+		disconnected bool
+	}{
+		{RATE_LIMIT_ACTION_DROP, []string{"ACK", "ACK", "ACK"}, false},
+		{RATE_LIMIT_ACTION_NACK, []string{"ACK", "NACK|8|rate limited", "NACK|8|rate limited"}, false},
+		{RATE_LIMIT_ACTION_DISCONNECT, []string{"ACK", "NACK|8|rate limited", "NACK|8|rate limited"}, true},
+	}
+
+	for _, test := range tests {
+		handler := NewEventsHandler()
+		handler.AddrLimiter = NewRateLimiter(1, 1)
+		handler.LimitAction = test.action
+		client, done := connectTestEventsHandler(t, handler)
+
+		sendFrames(client, frames)
+		if replies := readReplies(t, bufio.NewReader(client), client, len(test.replies)); !equalReplies(replies, test.replies) {
+			t.Errorf("%s: acknowledgements = %q, want %q", test.action, replies, test.replies)
+		}
+
+		if queued := handler.Queue.Len(); queued != 1 {
+			t.Errorf("%s: %d events queued, want 1", test.action, queued)
+		}
+
+		timeout := 50 * time.Millisecond
+		if test.disconnected {
+			timeout = time.Second
+		}
+		select {
+		case <-done:
+			if !test.disconnected {
+				t.Errorf("%s: rate limited source disconnected", test.action)
+			}
+		case <-time.After(timeout):
+			if test.disconnected {
+				t.Errorf("%s: rate limited source still connected", test.action)
+			}
+		}
+	}
+}
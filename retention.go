@@ -0,0 +1,307 @@
+package happening
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	l4g "github.com/alecthomas/log4go"
+)
+
+// Retention errors
+var (
+	ErrInvalidRetentionRule = errors.New("invalid retention rule")
+)
+
+// RetentionPolicy describes how long the events of a stream, the
+// events of a given type sent by a source, are kept: at most MaxAge
+// seconds after they were sent, and no more than the MaxCount most
+// recent events, weighting at most MaxBytes. Zero limits are ignored.
+type RetentionPolicy struct {
+	MaxAge   int64
+	MaxCount int
+	MaxBytes int64
+}
+
+// IsEmpty returns whether the policy keeps events forever.
+func (p RetentionPolicy) IsEmpty() bool {
+	return p.MaxAge <= 0 && p.MaxCount <= 0 && p.MaxBytes <= 0
+}
+
+// expired returns whether an event sent on sentOn is expired, when
+// count events weighting size bytes are at least as recent as it.
+func (p RetentionPolicy) expired(count int, size int64, sentOn int64, now int64) bool {
+	return (p.MaxAge > 0 && sentOn < now-p.MaxAge) ||
+		(p.MaxCount > 0 && count > p.MaxCount) ||
+		(p.MaxBytes > 0 && size > p.MaxBytes)
+}
+
+// RetentionRules holds the default retention policy, and the ones
+// overriding it for given events types and sources.
+type RetentionRules struct {
+	Default RetentionPolicy
+	Types   map[string]RetentionPolicy
+	Sources map[string]RetentionPolicy
+}
+
+// ParseRetentionRules builds RetentionRules from the default policy
+// and a semicolon separated list of rules overriding it, such as:
+//
+//	type:temperature:max_age=86400,max_count=1000;source:kitchen:max_bytes=1048576
+//
+// Each rule applies to an events type or source, and overrides the
+// limits it sets only. Source rules take precedence over type ones.
+func ParseRetentionRules(defaults RetentionPolicy, rules string) (*RetentionRules, error) {
+	retention := &RetentionRules{
+		Default: defaults,
+		Types:   make(map[string]RetentionPolicy),
+		Sources: make(map[string]RetentionPolicy),
+	}
+
+	for _, rule := range strings.Split(rules, ";") {
+		rule = strings.TrimSpace(rule)
+		if rule == "" {
+			continue
+		}
+
+		parts := strings.SplitN(rule, ":", 3)
+		if len(parts) != 3 || parts[1] == "" {
+			return nil, fmt.Errorf("%s: %q", ErrInvalidRetentionRule, rule)
+		}
+
+		var scope map[string]RetentionPolicy
+		switch parts[0] {
+		case RETENTION_SCOPE_TYPE:
+			scope = retention.Types
+		case RETENTION_SCOPE_SOURCE:
+			scope = retention.Sources
+		default:
+			return nil, fmt.Errorf("%s: %q, unknown scope %q", ErrInvalidRetentionRule, rule, parts[0])
+		}
+
+		policy, err := parseRetentionLimits(parts[2])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %q, %s", ErrInvalidRetentionRule, rule, err)
+		}
+		scope[parts[1]] = policy
+	}
+
+	return retention, nil
+}
+
+// parseRetentionLimits parses a comma separated list of
+// limit=value retention limits.
+func parseRetentionLimits(limits string) (RetentionPolicy, error) {
+	var policy RetentionPolicy
+
+	for _, limit := range strings.Split(limits, ",") {
+		parts := strings.SplitN(strings.TrimSpace(limit), "=", 2)
+		if len(parts) != 2 {
+			return policy, fmt.Errorf("malformed limit %q", limit)
+		}
+
+		value, err := strconv.ParseInt(parts[1], 10, 64)
+		if err != nil || value <= 0 {
+			return policy, fmt.Errorf("invalid %s value %q", parts[0], parts[1])
+		}
+
+		switch parts[0] {
+		case RETENTION_MAX_AGE:
+			policy.MaxAge = value
+		case RETENTION_MAX_COUNT:
+			policy.MaxCount = int(value)
+		case RETENTION_MAX_BYTES:
+			policy.MaxBytes = value
+		default:
+			return policy, fmt.Errorf("unknown limit %q", parts[0])
+		}
+	}
+
+	return policy, nil
+}
+
+// PolicyFor returns the retention policy applying to
+// the events of eventType sent by from.
+func (r *RetentionRules) PolicyFor(from string, eventType string) RetentionPolicy {
+	policy := r.Default
+
+	if override, ok := r.Types[eventType]; ok {
+		policy = policy.override(override)
+	}
+
+	if override, ok := r.Sources[from]; ok {
+		policy = policy.override(override)
+	}
+
+	return policy
+}
+
+// IsEmpty returns whether the rules keep every event forever.
+func (r *RetentionRules) IsEmpty() bool {
+	return r.Default.IsEmpty() && len(r.Types) == 0 && len(r.Sources) == 0
+}
+
+func (p RetentionPolicy) override(other RetentionPolicy) RetentionPolicy {
+	if other.MaxAge > 0 {
+		p.MaxAge = other.MaxAge
+	}
+	if other.MaxCount > 0 {
+		p.MaxCount = other.MaxCount
+	}
+	if other.MaxBytes > 0 {
+		p.MaxBytes = other.MaxBytes
+	}
+
+	return p
+}
+
+// RetentionService is a Service periodically removing the expired
+// events from a StorageBackend, according to it's Rules.
+//
+// Each events stream is enforced in turn, and expired events are
+// deleted in batches of at most STORAGE_BATCH_SIZE events, over
+// short lived iterators, so ingestion is never held up for long.
+type RetentionService struct {
+	Service
+	Backend  StorageBackend
+	Rules    *RetentionRules
+	Interval time.Duration
+}
+
+// NewRetentionService builds a RetentionService enforcing
+// rules over backend every interval.
+func NewRetentionService(backend StorageBackend, rules *RetentionRules, interval time.Duration) *RetentionService {
+	return &RetentionService{
+		Service:  *NewService("RetentionService"),
+		Backend:  backend,
+		Rules:    rules,
+		Interval: interval,
+	}
+}
+
+// Start runs the RetentionService enforcing routine in background.
+func (r *RetentionService) Start() {
+	go r.Run()
+}
+
+// Run should be run as a long-running goroutine. It enforces the
+// retention rules every interval until the service is stopped.
+func (r *RetentionService) Run() {
+	defer r.waitGroup.Done()
+	l4g.Info(fmt.Sprintf("[%s.Run] Retention service ready to expire events", r.name))
+
+	// Interrupt an ongoing enforcement as soon as stopped
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-r.ch
+		cancel()
+	}()
+
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			deleted, err := r.Enforce(ctx)
+			if err != nil && ctx.Err() == nil {
+				l4g.Error(fmt.Sprintf("[%s.Run] Unable to enforce retention: %s", r.name, err))
+			}
+
+			if deleted > 0 {
+				l4g.Info(fmt.Sprintf("[%s.Run] %d expired events removed", r.name, deleted))
+			}
+		}
+	}
+}
+
+// Enforce removes the expired events of every stream, and
+// returns how many events were removed.
+func (r *RetentionService) Enforce(ctx context.Context) (int, error) {
+	var deleted int
+
+	now := time.Now().Unix()
+	err := forEachEventStream(ctx, r.Backend, func(from string, eventType string, prefix []byte) error {
+		count, err := r.enforceStream(ctx, prefix, r.Rules.PolicyFor(from, eventType), now)
+		deleted += count
+		return err
+	})
+
+	return deleted, err
+}
+
+// enforceStream removes the expired events of the stream whose
+// keys begin with prefix, and returns how many were removed.
+func (r *RetentionService) enforceStream(ctx context.Context, prefix []byte, policy RetentionPolicy, now int64) (int, error) {
+	if policy.IsEmpty() {
+		return 0, nil
+	}
+
+	newestExpired, err := r.newestExpired(ctx, prefix, policy, now)
+	if err != nil || newestExpired == nil {
+		return 0, err
+	}
+
+	// Events being ordered by time within a stream, every event
+	// up to the newest expired one is expired as well.
+	var deleted int
+	end := append(newestExpired, 0x00)
+
+	for {
+		keys, err := iteratorKeys(ctx, r.Backend, IteratorOptions{Start: prefix, End: end, Limit: STORAGE_BATCH_SIZE})
+		if err != nil || len(keys) == 0 {
+			return deleted, err
+		}
+
+		if err := r.Backend.MDelete(ctx, withIndexKeys(keys)); err != nil {
+			return deleted, err
+		}
+		deleted += len(keys)
+
+		if len(keys) < STORAGE_BATCH_SIZE {
+			return deleted, nil
+		}
+	}
+}
+
+// newestExpired returns the key of the most recent expired event
+// of the stream whose keys begin with prefix, if any.
+func (r *RetentionService) newestExpired(ctx context.Context, prefix []byte, policy RetentionPolicy, now int64) ([]byte, error) {
+	// The age limit alone only requires to look for
+	// the last event sent before the expiry date.
+	if policy.MaxCount <= 0 && policy.MaxBytes <= 0 {
+		end := appendTimestamp(append([]byte(nil), prefix...), now-policy.MaxAge)
+		return firstKey(ctx, r.Backend, IteratorOptions{Start: prefix, End: end, Reverse: true})
+	}
+
+	it, err := r.Backend.NewIterator(ctx, IteratorOptions{Prefix: prefix, Reverse: true})
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	var count int
+	var size int64
+	for it.Next() {
+		key := it.Key()
+		count++
+		size += int64(len(key) + len(it.Value()))
+
+		eventKey, err := DecodeEventKey(key)
+		if err != nil {
+			continue
+		}
+
+		if policy.expired(count, size, eventKey.SentOn, now) {
+			return key, nil
+		}
+	}
+
+	return nil, it.Err()
+}
@@ -0,0 +1,221 @@
+package happening
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// storeRetentionEvents stores, along with their index entries, a
+// temperature event of from sent at each of the ages, in seconds
+// before now, and returns the storage size of each event.
+func storeRetentionEvents(t *testing.T, backend StorageBackend, from string, now int64, ages ...int64) int64 {
+	t.Helper()
+
+	var size int64
+	for _, age := range ages {
+		pairs, err := eventKvPairs(NewEvent(from, now-age, now, "temperature"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := backend.MPut(context.Background(), pairs); err != nil {
+			t.Fatal(err)
+		}
+		size = int64(len(pairs[0].Key) + len(pairs[0].Value))
+	}
+
+	return size
+}
+
+// retainedAges returns the ages of the stored events of from, from
+// the oldest to the most recent, and checks that each is indexed.
+func retainedAges(t *testing.T, backend StorageBackend, from string, now int64) []int64 {
+	t.Helper()
+	ctx := context.Background()
+
+	prefix, err := EventStreamPrefix(from, "temperature")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := iteratorKeys(ctx, backend, IteratorOptions{Prefix: prefix})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ages []int64
+	for _, key := range keys {
+		eventKey, err := DecodeEventKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ages = append(ages, now-eventKey.SentOn)
+
+		pairs, err := eventIndexKvPairs(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, pair := range pairs {
+			if _, err := backend.Get(ctx, pair.Key); err != nil {
+				t.Errorf("index entry %q of a retained event: %s", pair.Key, err)
+			}
+		}
+	}
+
+	return ages
+}
+
+// indexEntries returns the number of entries of the index keyspaces.
+func indexEntries(t *testing.T, backend StorageBackend) int {
+	t.Helper()
+
+	var count int
+	for _, keyspace := range eventIndexesKeyspaces {
+		keys, err := iteratorKeys(context.Background(), backend, IteratorOptions{Prefix: []byte{keyspace}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		count += len(keys)
+	}
+
+	return count
+}
+
+func TestRetentionServiceEnforce(t *testing.T) {
+	ages := []int64{1000, 700, 500, 50, 10}
+
+	tests := []struct {
+		name    string
+		policy  func(size int64) RetentionPolicy
+		rules   string
+		kitchen []int64
+		bedroom []int64
+	}{
+		{
+			name:    "none",
+			policy:  func(size int64) RetentionPolicy { return RetentionPolicy{} },
+			kitchen: ages,
+			bedroom: ages,
+		},
+		{
+			name:    "max age",
+			policy:  func(size int64) RetentionPolicy { return RetentionPolicy{MaxAge: 600} },
+			kitchen: []int64{500, 50, 10},
+			bedroom: []int64{500, 50, 10},
+		},
+		{
+			name:    "max count",
+			policy:  func(size int64) RetentionPolicy { return RetentionPolicy{MaxCount: 2} },
+			kitchen: []int64{50, 10},
+			bedroom: []int64{50, 10},
+		},
+		{
+			name:    "max bytes",
+			policy:  func(size int64) RetentionPolicy { return RetentionPolicy{MaxBytes: 4*size - 1} },
+			kitchen: []int64{500, 50, 10},
+			bedroom: []int64{500, 50, 10},
+		},
+		{
+			name:    "max age within max count",
+			policy:  func(size int64) RetentionPolicy { return RetentionPolicy{MaxAge: 100, MaxCount: 4} },
+			kitchen: []int64{50, 10},
+			bedroom: []int64{50, 10},
+		},
+		{
+			name:    "max count within max age",
+			policy:  func(size int64) RetentionPolicy { return RetentionPolicy{MaxAge: 800, MaxCount: 1} },
+			kitchen: []int64{10},
+			bedroom: []int64{10},
+		},
+		{
+			name:    "max bytes within max age and count",
+			policy:  func(size int64) RetentionPolicy { return RetentionPolicy{MaxAge: 800, MaxCount: 3, MaxBytes: 2 * size} },
+			kitchen: []int64{50, 10},
+			bedroom: []int64{50, 10},
+		},
+		{
+			name:    "source rule",
+			policy:  func(size int64) RetentionPolicy { return RetentionPolicy{MaxAge: 600} },
+			rules:   "source:kitchen:max_count=1",
+			kitchen: []int64{10},
+			bedroom: []int64{500, 50, 10},
+		},
+		{
+			name:    "source rule over type rule",
+			policy:  func(size int64) RetentionPolicy { return RetentionPolicy{} },
+			rules:   "type:temperature:max_count=3;source:bedroom:max_count=1",
+			kitchen: []int64{500, 50, 10},
+			bedroom: []int64{10},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			backend, err := NewMemoryBackend(0, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer backend.Close()
+
+			now := time.Now().Unix()
+			size := storeRetentionEvents(t, backend, "kitchen", now, ages...)
+			storeRetentionEvents(t, backend, "bedroom", now, ages...)
+
+			rules, err := ParseRetentionRules(test.policy(size), test.rules)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			service := NewRetentionService(backend, rules, time.Minute)
+			deleted, err := service.Enforce(context.Background())
+			if err != nil {
+				t.Fatalf("Enforce: %s", err)
+			}
+
+			kitchen := retainedAges(t, backend, "kitchen", now)
+			bedroom := retainedAges(t, backend, "bedroom", now)
+			if !equalAges(kitchen, test.kitchen) || !equalAges(bedroom, test.bedroom) {
+				t.Errorf("retained ages = kitchen %v, bedroom %v, want %v, %v", kitchen, bedroom, test.kitchen, test.bedroom)
+			}
+
+			if want := 2*len(ages) - len(kitchen) - len(bedroom); deleted != want {
+				t.Errorf("Enforce deleted %d events, want %d", deleted, want)
+			}
+
+			// Index entries are deleted along with their events
+			if entries, want := indexEntries(t, backend), len(eventIndexesKeyspaces)*(len(kitchen)+len(bedroom)); entries != want {
+				t.Errorf("%d index entries left, want %d", entries, want)
+			}
+		})
+	}
+}
+
+func TestRetentionServiceEnforceBatches(t *testing.T) {
+	backend, err := NewMemoryBackend(0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	now := time.Now().Unix()
+	ages := make([]int64, 2*STORAGE_BATCH_SIZE+1)
+	for index := range ages {
+		ages[index] = int64(len(ages) - index)
+	}
+	storeRetentionEvents(t, backend, "kitchen", now, ages...)
+
+	service := NewRetentionService(backend, &RetentionRules{Default: RetentionPolicy{MaxCount: 1}}, time.Minute)
+	deleted, err := service.Enforce(context.Background())
+	if err != nil {
+		t.Fatalf("Enforce: %s", err)
+	}
+
+	if deleted != 2*STORAGE_BATCH_SIZE {
+		t.Errorf("Enforce deleted %d events, want %d", deleted, 2*STORAGE_BATCH_SIZE)
+	}
+	if retained := retainedAges(t, backend, "kitchen", now); !equalAges(retained, []int64{1}) {
+		t.Errorf("retained ages = %v, want [1]", retained)
+	}
+	if entries := indexEntries(t, backend); entries != len(eventIndexesKeyspaces) {
+		t.Errorf("%d index entries left, want %d", entries, len(eventIndexesKeyspaces))
+	}
+}
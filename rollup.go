@@ -0,0 +1,691 @@
+package happening
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	l4g "github.com/alecthomas/log4go"
+)
+
+// Rollups are stored in their own keyspace, using the
+// following binary key layout:
+//
+//	'r' | Resolution | 0x00 | From | 0x00 | Type | 0x00 | Bucket
+//
+// where Bucket is the timestamp the rollup time bucket starts on,
+// encoded as events timestamps are. The rollups of a stream at a
+// given resolution are thus ordered by time.
+//
+// The progress of each rollup job, the end of the last bucket
+// rolled up for a stream at a given resolution, is stored under:
+//
+//	'm' | "rollup" | 0x00 | Resolution | 0x00 | From | 0x00 | Type
+//
+// Events stored once the rollup of their bucket may have been computed
+// already are marked late, along with their value, under:
+//
+//	'm' | "late" | 0x00 | Event key
+//
+// until they are added to the rollups of their buckets, which empties
+// the mark in the same write.
+
+// Rollups errors
+var (
+	ErrUnknownResolution = errors.New("unknown rollup resolution")
+	ErrInvalidRollupKey  = errors.New("invalid rollup key")
+	ErrInvalidRollup     = errors.New("invalid rollup value")
+)
+
+const rollupValueVersion = 1
+
+// rollupResolutions holds the rollup buckets durations
+// in seconds, by resolution name.
+var rollupResolutions = map[string]int64{
+	ROLLUP_MINUTE: 60,
+	ROLLUP_HOUR:   3600,
+	ROLLUP_DAY:    86400,
+}
+
+// Rollup aggregates the events of a stream, the events of a given
+// type sent by a source, sent during a time bucket. Numeric values
+// statistics only account for the ValueCount events carrying one.
+type Rollup struct {
+	From       string
+	Type       string
+	Resolution string
+	Bucket     int64
+
+	Count       uint64
+	FirstSentOn int64
+	LastSentOn  int64
+	DelaySum    int64
+
+	ValueCount uint64
+	ValueMin   float64
+	ValueMax   float64
+	ValueSum   float64
+}
+
+// NewRollup returns an empty rollup of the bucket of
+// a stream starting on bucket.
+func NewRollup(from string, eventType string, resolution string, bucket int64) *Rollup {
+	return &Rollup{
+		From:       from,
+		Type:       eventType,
+		Resolution: resolution,
+		Bucket:     bucket,
+		ValueMin:   math.Inf(1),
+		ValueMax:   math.Inf(-1),
+	}
+}
+
+// Add accounts for an event in the rollup.
+func (r *Rollup) Add(event *Event) {
+	if r.Count == 0 || event.SentOn < r.FirstSentOn {
+		r.FirstSentOn = event.SentOn
+	}
+	if r.Count == 0 || event.SentOn > r.LastSentOn {
+		r.LastSentOn = event.SentOn
+	}
+	r.Count++
+	r.DelaySum += event.ReceivedOn - event.SentOn
+
+	if event.Value != nil && event.Value.Numeric {
+		r.ValueCount++
+		r.ValueMin = math.Min(r.ValueMin, event.Value.Number)
+		r.ValueMax = math.Max(r.ValueMax, event.Value.Number)
+		r.ValueSum += event.Value.Number
+	}
+}
+
+// Merge accounts for a finer rollup of the same stream.
+func (r *Rollup) Merge(other *Rollup) {
+	if other.Count == 0 {
+		return
+	}
+
+	if r.Count == 0 || other.FirstSentOn < r.FirstSentOn {
+		r.FirstSentOn = other.FirstSentOn
+	}
+	if r.Count == 0 || other.LastSentOn > r.LastSentOn {
+		r.LastSentOn = other.LastSentOn
+	}
+	r.Count += other.Count
+	r.DelaySum += other.DelaySum
+
+	if other.ValueCount > 0 {
+		r.ValueCount += other.ValueCount
+		r.ValueMin = math.Min(r.ValueMin, other.ValueMin)
+		r.ValueMax = math.Max(r.ValueMax, other.ValueMax)
+		r.ValueSum += other.ValueSum
+	}
+}
+
+// MeanDelay returns the mean ingestion delay, ReceivedOn - SentOn,
+// of the rollup events, in seconds.
+func (r *Rollup) MeanDelay() float64 {
+	if r.Count == 0 {
+		return 0
+	}
+	return float64(r.DelaySum) / float64(r.Count)
+}
+
+// ValueMean returns the mean numeric value of the rollup events,
+// or NaN if none carries one.
+func (r *Rollup) ValueMean() float64 {
+	if r.ValueCount == 0 {
+		return math.NaN()
+	}
+	return r.ValueSum / float64(r.ValueCount)
+}
+
+// Key returns the rollup storage key.
+func (r *Rollup) Key() ([]byte, error) {
+	prefix, err := RollupStreamPrefix(r.Resolution, r.From, r.Type)
+	if err != nil {
+		return nil, err
+	}
+
+	return appendTimestamp(prefix, r.Bucket), nil
+}
+
+// Encode returns the binary representation of the rollup
+// statistics, used as the value it's key points to.
+func (r *Rollup) Encode() []byte {
+	buf := make([]byte, 1, 64)
+	buf[0] = rollupValueVersion
+
+	buf = binary.AppendUvarint(buf, r.Count)
+	buf = binary.AppendVarint(buf, r.FirstSentOn)
+	buf = binary.AppendVarint(buf, r.LastSentOn)
+	buf = binary.AppendVarint(buf, r.DelaySum)
+	buf = binary.AppendUvarint(buf, r.ValueCount)
+	buf = appendUint64(buf, math.Float64bits(r.ValueMin))
+	buf = appendUint64(buf, math.Float64bits(r.ValueMax))
+	buf = appendUint64(buf, math.Float64bits(r.ValueSum))
+
+	return buf
+}
+
+// DecodeRollupKvPair rebuilds a Rollup from it's storage key and value.
+func DecodeRollupKvPair(key []byte, value []byte) (*Rollup, error) {
+	if len(key) < 1+3+eventTimestampLength || key[0] != ROLLUPS_KEYSPACE {
+		return nil, ErrInvalidRollupKey
+	}
+
+	tail := len(key) - eventTimestampLength
+	names := strings.Split(string(key[1:tail]), string(rune(eventKeySeparator)))
+	if len(names) != 4 || names[3] != "" {
+		return nil, ErrInvalidRollupKey
+	}
+
+	if len(value) == 0 || value[0] != rollupValueVersion {
+		return nil, ErrInvalidRollup
+	}
+
+	decoder := &valueDecoder{data: value[1:]}
+	rollup := &Rollup{
+		Resolution:  names[0],
+		From:        names[1],
+		Type:        names[2],
+		Bucket:      decodeTimestamp(key[tail:]),
+		Count:       decoder.uvarint(),
+		FirstSentOn: decoder.varint(),
+		LastSentOn:  decoder.varint(),
+		DelaySum:    decoder.varint(),
+		ValueCount:  decoder.uvarint(),
+		ValueMin:    math.Float64frombits(decoder.uint64()),
+		ValueMax:    math.Float64frombits(decoder.uint64()),
+		ValueSum:    math.Float64frombits(decoder.uint64()),
+	}
+
+	if decoder.err != nil {
+		return nil, ErrInvalidRollup
+	}
+
+	return rollup, nil
+}
+
+// RollupStreamPrefix returns the key prefix shared by every rollup
+// of a given resolution of the events of a given type sent by a source.
+func RollupStreamPrefix(resolution string, from string, eventType string) ([]byte, error) {
+	if _, ok := rollupResolutions[resolution]; !ok {
+		return nil, fmt.Errorf("%s: %q", ErrUnknownResolution, resolution)
+	}
+
+	if err := validateKeyComponent("source", from); err != nil {
+		return nil, err
+	}
+
+	if err := validateKeyComponent("type", eventType); err != nil {
+		return nil, err
+	}
+
+	prefix := make([]byte, 0, len(resolution)+len(from)+len(eventType)+4+eventTimestampLength)
+	prefix = append(prefix, ROLLUPS_KEYSPACE)
+	prefix = append(prefix, resolution...)
+	prefix = append(prefix, eventKeySeparator)
+	prefix = append(prefix, from...)
+	prefix = append(prefix, eventKeySeparator)
+	prefix = append(prefix, eventType...)
+	prefix = append(prefix, eventKeySeparator)
+
+	return prefix, nil
+}
+
+// rollupWatermarkKey returns the key the progress of the
+// rollup job of a stream at a given resolution is stored under.
+func rollupWatermarkKey(resolution string, from string, eventType string) []byte {
+	key := []byte{META_KEYSPACE}
+	key = append(key, "rollup"...)
+	for _, component := range []string{resolution, from, eventType} {
+		key = append(key, eventKeySeparator)
+		key = append(key, component...)
+	}
+
+	return key
+}
+
+var lateEventsPrefix = append([]byte{META_KEYSPACE}, "late\x00"...)
+
+// lateEventKvPair returns the pair marking an event late, and
+// holding it until it is added to the rollups of it's buckets.
+func lateEventKvPair(event *Event) (KvPair, error) {
+	eventKey, err := NewEventKey(event).Encode()
+	if err != nil {
+		return KvPair{}, err
+	}
+
+	key := make([]byte, 0, len(lateEventsPrefix)+len(eventKey))
+	key = append(append(key, lateEventsPrefix...), eventKey...)
+
+	return KvPair{Key: key, Value: EncodeEvent(event)}, nil
+}
+
+// ParseRollupResolutions parses a comma separated list of
+// resolutions names, and returns it ordered by duration.
+func ParseRollupResolutions(resolutions string) ([]string, error) {
+	var parsed []string
+
+	for _, resolution := range strings.Split(resolutions, ",") {
+		resolution = strings.TrimSpace(resolution)
+		if resolution == "" {
+			continue
+		}
+
+		if _, ok := rollupResolutions[resolution]; !ok {
+			return nil, fmt.Errorf("%s: %q", ErrUnknownResolution, resolution)
+		}
+		parsed = append(parsed, resolution)
+	}
+
+	sort.Slice(parsed, func(i, j int) bool {
+		return rollupResolutions[parsed[i]] < rollupResolutions[parsed[j]]
+	})
+
+	return parsed, nil
+}
+
+// bucketStart returns the start of the bucket of the
+// given duration timestamp belongs to.
+func bucketStart(timestamp int64, duration int64) int64 {
+	bucket := timestamp - timestamp%duration
+	if timestamp%duration < 0 {
+		bucket -= duration
+	}
+	return bucket
+}
+
+// RollupService is a Service periodically aggregating raw events
+// into rollups, for each of it's Resolutions.
+//
+// A bucket is rolled up once it has been over for Grace seconds, so
+// that most late events are accounted for. The finest resolution is
+// computed from raw events, and every other one from the rollups of
+// the previous resolution, so that raw events may expire once rolled
+// up. Events stored later than that, such as the ones a node sends
+// again after an outage, are marked late by the StorageWriter, and
+// added to the rollups of their buckets which were computed already,
+// exactly once.
+type RollupService struct {
+	Service
+	Backend     StorageBackend
+	Resolutions []string
+	Interval    time.Duration
+	Grace       int64
+}
+
+// NewRollupService builds a RollupService rolling up the events
+// of backend every interval, for each of resolutions.
+func NewRollupService(backend StorageBackend, resolutions []string, interval time.Duration) *RollupService {
+	return &RollupService{
+		Service:     *NewService("RollupService"),
+		Backend:     backend,
+		Resolutions: resolutions,
+		Interval:    interval,
+		Grace:       ROLLUP_GRACE_PERIOD,
+	}
+}
+
+// Start runs the RollupService routine in background.
+func (r *RollupService) Start() {
+	go r.Run()
+}
+
+// Run should be run as a long-running goroutine. It rolls
+// up events every interval until the service is stopped.
+func (r *RollupService) Run() {
+	defer r.waitGroup.Done()
+	l4g.Info(fmt.Sprintf("[%s.Run] Rollup service ready to aggregate events", r.name))
+
+	// Interrupt an ongoing rollup as soon as stopped
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-r.ch
+		cancel()
+	}()
+
+	ticker := time.NewTicker(r.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			count, err := r.Rollup(ctx, time.Now().Unix())
+			if err != nil && ctx.Err() == nil {
+				l4g.Error(fmt.Sprintf("[%s.Run] Unable to rollup events: %s", r.name, err))
+			}
+
+			if count > 0 {
+				l4g.Debug(fmt.Sprintf("[%s.Run] %d rollups written", r.name, count))
+			}
+		}
+	}
+}
+
+// Rollup aggregates the buckets of every stream which are over as
+// of now, and returns how many rollups were written.
+func (r *RollupService) Rollup(ctx context.Context, now int64) (int, error) {
+	var written int
+
+	err := forEachEventStream(ctx, r.Backend, func(from string, eventType string, prefix []byte) error {
+		// Coarser resolutions can't get past finer ones
+		limit := now - r.Grace
+
+		for index, resolution := range r.Resolutions {
+			var source string
+			if index > 0 {
+				source = r.Resolutions[index-1]
+			}
+
+			count, watermark, err := r.rollupStream(ctx, resolution, source, from, eventType, limit)
+			written += count
+			if err != nil {
+				return err
+			}
+
+			limit = watermark
+		}
+
+		return nil
+	})
+	if err != nil {
+		return written, err
+	}
+
+	count, err := r.rollupLateEvents(ctx)
+	written += count
+
+	return written, err
+}
+
+// rollupLateEvents adds the events marked late to the rollups of
+// their buckets which were computed already, and deletes their marks.
+// The others are left to be rolled up along with the on time events.
+// It returns how many rollups were written.
+func (r *RollupService) rollupLateEvents(ctx context.Context) (int, error) {
+	var written int
+	var done [][]byte
+
+	it, err := r.Backend.NewIterator(ctx, IteratorOptions{Prefix: lateEventsPrefix})
+	if err != nil {
+		return 0, err
+	}
+	defer it.Close()
+
+	for it.Next() {
+		key := it.Key()
+
+		// Already rolled up marks were only left to be deleted
+		if value := it.Value(); len(value) > 0 {
+			event, err := DecodeEventKvPair(key[len(lateEventsPrefix):], value)
+			if err != nil {
+				l4g.Warn(fmt.Sprintf("[%s.rollupLateEvents] Skipping late event: %s", r.name, err))
+			} else {
+				count, err := r.rollupLateEvent(ctx, key, event)
+				written += count
+				if err != nil {
+					return written, err
+				}
+			}
+		}
+
+		done = append(done, key)
+	}
+	if err := it.Err(); err != nil {
+		return written, err
+	}
+
+	for len(done) > 0 {
+		batchSize := STORAGE_BATCH_SIZE
+		if len(done) < batchSize {
+			batchSize = len(done)
+		}
+
+		if err := r.Backend.MDelete(ctx, done[:batchSize]); err != nil {
+			return written, err
+		}
+		done = done[batchSize:]
+	}
+
+	return written, nil
+}
+
+// rollupLateEvent adds a late event to the rollups of it's buckets
+// which were computed already, emptying it's mark in the same write
+// so that it is only accounted for once. It returns how many rollups
+// were written.
+func (r *RollupService) rollupLateEvent(ctx context.Context, markKey []byte, event *Event) (int, error) {
+	pairs := []KvPair{{Key: markKey, Value: []byte{}}}
+
+	for _, resolution := range r.Resolutions {
+		watermark, err := r.watermark(ctx, resolution, event.From, event.Type)
+		if err != nil {
+			return 0, err
+		}
+
+		// Coarser resolutions can't get past finer ones
+		bucket := bucketStart(event.SentOn, rollupResolutions[resolution])
+		if bucket >= watermark {
+			break
+		}
+
+		rollup := NewRollup(event.From, event.Type, resolution, bucket)
+		key, err := rollup.Key()
+		if err != nil {
+			return 0, err
+		}
+
+		value, err := r.Backend.Get(ctx, key)
+		if err == nil {
+			if rollup, err = DecodeRollupKvPair(key, value); err != nil {
+				return 0, err
+			}
+		} else if err != ErrKeyNotFound {
+			return 0, err
+		}
+
+		rollup.Add(event)
+		pairs = append(pairs, KvPair{Key: key, Value: rollup.Encode()})
+	}
+
+	if err := r.Backend.MPut(ctx, pairs); err != nil {
+		return 0, err
+	}
+
+	return len(pairs) - 1, nil
+}
+
+// watermark returns the end of the last bucket of a stream
+// rolled up at resolution, math.MinInt64 if none was.
+func (r *RollupService) watermark(ctx context.Context, resolution string, from string, eventType string) (int64, error) {
+	value, err := r.Backend.Get(ctx, rollupWatermarkKey(resolution, from, eventType))
+	if err == ErrKeyNotFound {
+		return math.MinInt64, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	return decodeWatermark(value)
+}
+
+// rollupStream aggregates the buckets of a stream at resolution
+// ending before limit, from the rollups at the source resolution,
+// or from raw events if source is empty. It returns how many rollups
+// were written, and the stream watermark at resolution.
+func (r *RollupService) rollupStream(ctx context.Context, resolution string, source string, from string, eventType string, limit int64) (int, int64, error) {
+	duration := rollupResolutions[resolution]
+	watermarkKey := rollupWatermarkKey(resolution, from, eventType)
+
+	watermark, err := r.watermark(ctx, resolution, from, eventType)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// Only roll up buckets which are over
+	end := bucketStart(limit, duration)
+	if end <= watermark {
+		return 0, watermark, nil
+	}
+
+	var opts IteratorOptions
+	var decode func(key []byte, value []byte) (*Rollup, error)
+	var exclude func(ctx context.Context, opts IteratorOptions) (map[string]bool, error)
+
+	if source == "" {
+		if opts.Start, err = EventStreamTimeKey(from, eventType, watermark); err != nil {
+			return 0, 0, err
+		}
+		if opts.End, err = EventStreamTimeKey(from, eventType, end); err != nil {
+			return 0, 0, err
+		}
+
+		decode = func(key []byte, value []byte) (*Rollup, error) {
+			event, err := DecodeEventKvPair(key, value)
+			if err != nil {
+				return nil, err
+			}
+
+			rollup := NewRollup(from, eventType, resolution, bucketStart(event.SentOn, duration))
+			rollup.Add(event)
+
+			return rollup, nil
+		}
+		exclude = r.pendingLateEvents
+	} else {
+		prefix, err := RollupStreamPrefix(source, from, eventType)
+		if err != nil {
+			return 0, 0, err
+		}
+		opts.Start = appendTimestamp(append([]byte(nil), prefix...), watermark)
+		opts.End = appendTimestamp(append([]byte(nil), prefix...), end)
+
+		decode = func(key []byte, value []byte) (*Rollup, error) {
+			finer, err := DecodeRollupKvPair(key, value)
+			if err != nil {
+				return nil, err
+			}
+
+			rollup := NewRollup(from, eventType, resolution, bucketStart(finer.Bucket, duration))
+			rollup.Merge(finer)
+
+			return rollup, nil
+		}
+	}
+
+	rollups, err := r.aggregate(ctx, opts, decode, exclude)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	pairs := make([]KvPair, 0, len(rollups)+1)
+	for _, rollup := range rollups {
+		key, err := rollup.Key()
+		if err != nil {
+			return 0, 0, err
+		}
+		pairs = append(pairs, KvPair{Key: key, Value: rollup.Encode()})
+	}
+
+	// Write the rollups in batches, the watermark last. Rollups being
+	// overwritten if computed again, an interrupted job is harmless.
+	pairs = append(pairs, KvPair{Key: watermarkKey, Value: binary.AppendVarint(nil, end)})
+	for len(pairs) > 0 {
+		batchSize := STORAGE_BATCH_SIZE
+		if len(pairs) < batchSize {
+			batchSize = len(pairs)
+		}
+
+		if err := r.Backend.MPut(ctx, pairs[:batchSize]); err != nil {
+			return 0, 0, err
+		}
+		pairs = pairs[batchSize:]
+	}
+
+	return len(rollups), end, nil
+}
+
+// aggregate merges the single entry rollups decode builds from
+// the entries iterating with opts yields, by bucket. The entries
+// exclude returns, if any, once the iteration snapshot is taken,
+// are skipped.
+func (r *RollupService) aggregate(ctx context.Context, opts IteratorOptions, decode func(key []byte, value []byte) (*Rollup, error), exclude func(ctx context.Context, opts IteratorOptions) (map[string]bool, error)) ([]*Rollup, error) {
+	var rollups []*Rollup
+
+	it, err := r.Backend.NewIterator(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	var excluded map[string]bool
+	if exclude != nil {
+		if excluded, err = exclude(ctx, opts); err != nil {
+			return nil, err
+		}
+	}
+
+	// Entries are ordered by time, and so are buckets
+	for it.Next() {
+		if excluded[string(it.Key())] {
+			continue
+		}
+
+		entry, err := decode(it.Key(), it.Value())
+		if err != nil {
+			l4g.Warn(fmt.Sprintf("[%s.aggregate] Skipping entry: %s", r.name, err))
+			continue
+		}
+
+		if last := len(rollups) - 1; last >= 0 && rollups[last].Bucket == entry.Bucket {
+			rollups[last].Merge(entry)
+		} else {
+			rollups = append(rollups, entry)
+		}
+	}
+
+	return rollups, it.Err()
+}
+
+// pendingLateEvents returns the keys of the events within the opts
+// range which are marked late, and not rolled up yet. As they are
+// stored along with their mark, and marks are only rolled up by the
+// service itself, each event of an iteration snapshot taken before is
+// either rolled up with the on time events, or as a late one.
+func (r *RollupService) pendingLateEvents(ctx context.Context, opts IteratorOptions) (map[string]bool, error) {
+	start := append(append([]byte(nil), lateEventsPrefix...), opts.Start...)
+	end := append(append([]byte(nil), lateEventsPrefix...), opts.End...)
+
+	it, err := r.Backend.NewIterator(ctx, IteratorOptions{Start: start, End: end})
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	pending := make(map[string]bool)
+	for it.Next() {
+		if len(it.Value()) > 0 {
+			pending[string(it.Key()[len(lateEventsPrefix):])] = true
+		}
+	}
+
+	return pending, it.Err()
+}
+
+func decodeWatermark(value []byte) (int64, error) {
+	watermark, n := binary.Varint(value)
+	if n <= 0 {
+		return 0, ErrInvalidRollup
+	}
+
+	return watermark, nil
+}
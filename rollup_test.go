@@ -0,0 +1,96 @@
+package happening
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// rollupCount returns the events count of the rollup of a
+// stream bucket at resolution, zero if there's none.
+func rollupCount(t *testing.T, backend StorageBackend, resolution string, from string, eventType string, sentOn int64) uint64 {
+	t.Helper()
+
+	rollup := NewRollup(from, eventType, resolution, bucketStart(sentOn, rollupResolutions[resolution]))
+	key, err := rollup.Key()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	value, err := backend.Get(context.Background(), key)
+	if err == ErrKeyNotFound {
+		return 0
+	} else if err != nil {
+		t.Fatal(err)
+	}
+
+	if rollup, err = DecodeRollupKvPair(key, value); err != nil {
+		t.Fatal(err)
+	}
+
+	return rollup.Count
+}
+
+func TestRollupLateEvents(t *testing.T) {
+	ctx := context.Background()
+	backend, err := NewMemoryBackend(0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	queue := NewQueue(EVENTS_QUEUE_SIZE)
+	writer := NewStorageWriter(backend, queue)
+	writer.TrackLateEvents = true
+	service := NewRollupService(backend, []string{ROLLUP_MINUTE, ROLLUP_HOUR}, time.Minute)
+
+	now := time.Now().Unix()
+	store := func(sentOn int64) {
+		queue.Push(NewEvent("kitchen", sentOn, now, "temperature"))
+		writer.Flush()
+	}
+	rollup := func() {
+		if _, err := service.Rollup(ctx, time.Now().Unix()); err != nil {
+			t.Fatalf("Rollup: %s", err)
+		}
+	}
+
+	// Buckets of a recent event are rolled up once over
+	recent := now - 3*ROLLUP_GRACE_PERIOD
+	store(recent)
+	rollup()
+	if count := rollupCount(t, backend, ROLLUP_MINUTE, "kitchen", "temperature", recent); count != 1 {
+		t.Fatalf("recent event minute rollup count = %d, want 1", count)
+	}
+
+	// Events sent two hours ago are stored after their buckets were rolled up
+	late := bucketStart(now, 3600) - 7200
+	store(late)
+	rollup()
+	store(late + 1)
+	rollup()
+	rollup()
+
+	tests := []struct {
+		resolution string
+		sentOn     int64
+		want       uint64
+	}{
+		{ROLLUP_MINUTE, late, 2},
+		{ROLLUP_HOUR, late, 2},
+		{ROLLUP_MINUTE, recent, 1},
+	}
+	for _, test := range tests {
+		if count := rollupCount(t, backend, test.resolution, "kitchen", "temperature", test.sentOn); count != test.want {
+			t.Errorf("%s rollup of %d count = %d, want %d", test.resolution, test.sentOn, count, test.want)
+		}
+	}
+
+	marks, err := iteratorKeys(ctx, backend, IteratorOptions{Prefix: lateEventsPrefix})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(marks) != 0 {
+		t.Errorf("%d late events marks left once rolled up", len(marks))
+	}
+}
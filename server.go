@@ -1,48 +1,345 @@
 package happening
 
 import (
+	"context"
+	"crypto/tls"
+	"fmt"
 	l4g "github.com/alecthomas/log4go"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
+	"time"
 )
 
 // Server implements the Service interface and exposes the Facteur
 // different services.
 type Server struct {
 	Service
-	EventsHandler *EventsHandler
+	EventsHandler    *EventsHandler
+	UdpEventsHandler *UdpEventsHandler
+	StorageWriter    *StorageWriter
+	RetentionService *RetentionService
+	RollupService    *RollupService
+	AlertService     *AlertService
+	NodeRegistry     *NodeRegistry
+	ApiService       *ApiService
+	Hub              *SubscriptionHub
 }
 
 // Server initializes a new Server instance
-func NewServer(handler *EventsHandler) *Server {
+func NewServer(handler *EventsHandler, writer *StorageWriter) *Server {
 	return &Server{
 		Service:       *NewService("Server"),
 		EventsHandler: handler,
+		StorageWriter: writer,
 	}
 }
 
 // Run launches the server's services and listens for SIGINT
-// and SIGTERM signals to gracefully them on receive
+// and SIGTERM signals to gracefully them on receive. It returns
+// once every service has been stopped.
 func (s *Server) Run() error {
 	defer s.waitGroup.Done()
 
 	// Handle SIGINT and SIGTERM signals for gracefull shutdown sake.
-	ch := make(chan os.Signal)
+	ch := make(chan os.Signal, 1)
 	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(ch)
+
+	stopped := make(chan bool)
 	go func() {
-		for sig := range ch {
+		defer close(stopped)
+
+		select {
+		case sig := <-ch:
 			l4g.Logf(l4g.INFO, "[%s.Run] %s received, stopping the happening", s.name, sig)
-			s.EventsHandler.NetworkService.Stop()
-			os.Exit(1)
+		case <-s.ch:
+			l4g.Logf(l4g.INFO, "[%s.Run] Stopping the happening", s.name)
 		}
+
+		s.shutdown()
 	}()
 
-	s.waitGroup.Add(2)
 	s.EventsHandler.Serve()
+	<-stopped
+
 	return nil
 }
 
-func ListenAndAcknowledge() error {
-	return nil
+// shutdown stops the server's services, the events sources first
+// so that every received event is eventually persisted.
+func (s *Server) shutdown() {
+	s.EventsHandler.NetworkService.Stop()
+	if s.UdpEventsHandler != nil {
+		s.UdpEventsHandler.Stop()
+	}
+	if s.AlertService != nil {
+		s.AlertService.Stop()
+	}
+	if s.NodeRegistry != nil {
+		s.NodeRegistry.Stop()
+	}
+	if s.Hub != nil {
+		s.Hub.Stop()
+	}
+	if s.ApiService != nil {
+		s.ApiService.Stop()
+	}
+	if s.RetentionService != nil {
+		s.RetentionService.Stop()
+	}
+	if s.RollupService != nil {
+		s.RollupService.Stop()
+	}
+	s.shutdownStorage()
+}
+
+// shutdownStorage stops the storage writer, which persists
+// the events remaining in queue, and closes the write-ahead
+// log and storage backend.
+func (s *Server) shutdownStorage() {
+	if s.StorageWriter == nil {
+		return
+	}
+
+	s.StorageWriter.Stop()
+	if s.StorageWriter.Wal != nil {
+		if err := s.StorageWriter.Wal.Close(); err != nil {
+			l4g.Logf(l4g.ERROR, "[%s.Run] Unable to close write-ahead log: %s", s.name, err)
+		}
+	}
+	if err := s.StorageWriter.Backend.Close(); err != nil {
+		l4g.Logf(l4g.ERROR, "[%s.Run] Unable to close storage backend: %s", s.name, err)
+	}
+}
+
+// ListenAndAcknowledge sets up the happening services according to
+// config, and runs them until SIGINT or SIGTERM is received: events
+// sources connexions are listened to, their events acknowledged and
+// persisted, and exposed through the http API.
+func ListenAndAcknowledge(config *Config) error {
+	switch config.AckMode {
+	case ACK_MODE_NONE, ACK_MODE_RECEIVED, ACK_MODE_STORED:
+	default:
+		return fmt.Errorf("invalid ack_mode %q, expected one of %s, %s or %s",
+			config.AckMode, ACK_MODE_NONE, ACK_MODE_RECEIVED, ACK_MODE_STORED)
+	}
+
+	eventsCodec, err := EventCodecByName(config.EventsCodec)
+	if err != nil {
+		return err
+	}
+
+	udpEventsCodec, err := EventCodecByName(config.UdpEventsCodec)
+	if err != nil {
+		return err
+	}
+
+	queue, err := NewBoundedQueue(EVENTS_QUEUE_SIZE, config.QueueMaxSize, config.QueueOverflow)
+	if err != nil {
+		return err
+	}
+
+	retentionRules, err := ParseRetentionRules(RetentionPolicy{
+		MaxAge:   int64(config.RetentionAge),
+		MaxCount: config.RetentionCount,
+		MaxBytes: int64(config.RetentionBytes),
+	}, config.RetentionRules)
+	if err != nil {
+		return err
+	}
+
+	resolutions, err := ParseRollupResolutions(config.Rollups)
+	if err != nil {
+		return err
+	}
+
+	alertRules, err := ParseAlertRules(config.AlertRules)
+	if err != nil {
+		return err
+	}
+
+	var auth *Authenticator
+	if config.AuthMode != AUTH_MODE_NONE {
+		if config.AuthKeyring == "" {
+			return fmt.Errorf("auth_mode %q requires an auth_keyring", config.AuthMode)
+		}
+
+		keyring, err := LoadKeyring(config.AuthKeyring)
+		if err != nil {
+			return err
+		}
+
+		if auth, err = NewAuthenticator(config.AuthMode, keyring, int64(config.AuthMaxSkew)); err != nil {
+			return err
+		}
+	}
+
+	if err = ValidateLimitAction(config.LimitAction); err != nil {
+		return err
+	}
+
+	var tlsConfig *tls.Config
+	if config.TlsCert != "" || config.TlsKey != "" || config.TlsClientCA != "" {
+		if tlsConfig, err = BuildTlsConfig(config.TlsCert, config.TlsKey, config.TlsClientCA); err != nil {
+			return err
+		}
+	}
+
+	// Udp events can't be authenticated, so they would bypass
+	// the nodes authentication and the clients certificates.
+	udpEnabled := config.UdpEventsPort != "" && config.UdpEventsPort != UDP_EVENTS_DISABLED
+	if udpEnabled && (auth != nil || (tlsConfig != nil && tlsConfig.ClientAuth == tls.RequireAndVerifyClientCert)) {
+		return fmt.Errorf("udp events can't be authenticated, udp_events_port must be disabled along with auth_mode or tls_client_ca")
+	}
+
+	// open storage backend
+	backend, err := NewStorageBackend(config)
+	if err != nil {
+		return err
+	}
+
+	// resume events sequences after the stored ones
+	if err = ResumeEventSequence(context.Background(), backend); err != nil {
+		backend.Close()
+		return err
+	}
+
+	// build server and it's services
+	handler := NewEventsHandler()
+	handler.AckMode = config.AckMode
+	handler.Codec = eventsCodec
+	handler.Queue = queue
+	handler.TLSConfig = tlsConfig
+	handler.Auth = auth
+	handler.MaxConnexions = config.MaxConnexions
+	handler.MaxLineLength = config.MaxLineLength
+	handler.LimitAction = config.LimitAction
+	if config.AddrRateLimit > 0 {
+		handler.AddrLimiter = NewRateLimiter(config.AddrRateLimit, config.AddrRateBurst)
+	}
+	if config.FromRateLimit > 0 {
+		handler.FromLimiter = NewRateLimiter(config.FromRateLimit, config.FromRateBurst)
+	}
+	server := NewServer(handler, NewStorageWriter(backend, handler.Queue))
+	server.StorageWriter.TrackLateEvents = len(resolutions) > 0
+	server.Hub = NewSubscriptionHub(handler.EventsChannel)
+	server.NodeRegistry = NewNodeRegistry(backend, handler, time.Duration(config.NodeTimeout)*time.Second)
+	if err = server.NodeRegistry.Load(context.Background()); err != nil {
+		backend.Close()
+		return err
+	}
+	handler.Nodes = server.NodeRegistry
+	if len(alertRules) > 0 {
+		server.AlertService = NewAlertService(handler, alertRules)
+		handler.Alerts = server.AlertService
+	}
+	server.ApiService = NewApiService(NewEventStore(backend), server.Hub)
+	server.ApiService.Nodes = server.NodeRegistry
+
+	// recover the events which were not persisted yet
+	if config.WalEnabled {
+		wal, err := openWriteAheadLog(config, handler.Queue)
+		if err != nil {
+			backend.Close()
+			return err
+		}
+		handler.Wal = wal
+		server.StorageWriter.Wal = wal
+	}
+
+	closeStorage := func() {
+		if handler.Wal != nil {
+			handler.Wal.Close()
+		}
+		backend.Close()
+	}
+
+	// bind services sockets
+	if err = server.ApiService.Start(config.Host, config.ApiPort); err != nil {
+		closeStorage()
+		return err
+	}
+
+	if udpEnabled {
+		if tlsConfig != nil {
+			l4g.Warn("Udp events are not encrypted, consider disabling the udp events port")
+		}
+		server.UdpEventsHandler = NewUdpEventsHandler(handler)
+		server.UdpEventsHandler.Codec = udpEventsCodec
+		if err = server.UdpEventsHandler.Start(config.Host, config.UdpEventsPort); err != nil {
+			server.ApiService.Stop()
+			closeStorage()
+			return err
+		}
+	}
+
+	if err = handler.Start(config.Host, config.EventsPort); err != nil {
+		if server.UdpEventsHandler != nil {
+			server.UdpEventsHandler.Stop()
+		}
+		server.ApiService.Stop()
+		closeStorage()
+		return err
+	}
+
+	server.StorageWriter.Start()
+	server.NodeRegistry.Start()
+	if !retentionRules.IsEmpty() {
+		server.RetentionService = NewRetentionService(backend, retentionRules,
+			time.Duration(config.RetentionEvery)*time.Second)
+		server.RetentionService.Start()
+	}
+	if len(resolutions) > 0 {
+		server.RollupService = NewRollupService(backend, resolutions,
+			time.Duration(config.RollupEvery)*time.Second)
+		server.RollupService.Start()
+	}
+	if server.AlertService != nil {
+		server.AlertService.Start()
+	}
+	server.Hub.Start()
+	l4g.Info("Happening events listener routine started")
+
+	return server.Run()
+}
+
+// openWriteAheadLog opens the write-ahead log stored under the
+// config storage path, and pushes the events it holds which were
+// not persisted yet to queue.
+func openWriteAheadLog(config *Config, queue *Queue) (*WriteAheadLog, error) {
+	wal, err := OpenWriteAheadLog(
+		filepath.Join(config.StoragePath, WAL_DIRECTORY),
+		config.WalSync,
+		time.Duration(config.WalSyncPeriod)*time.Millisecond,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	replayed := 0
+	err = wal.Replay(func(lsn uint64, payload []byte) error {
+		event, err := DecodeWalEvent(payload)
+		if err != nil {
+			l4g.Logf(l4g.ERROR, "[openWriteAheadLog] Skipping write-ahead log record %d: %s", lsn, err)
+			return nil
+		}
+		event.lsn = lsn
+		raiseEventSequence(event.seq)
+		queue.Restore(event)
+		replayed++
+
+		return nil
+	})
+	if err != nil {
+		wal.Close()
+		return nil, err
+	}
+
+	if replayed > 0 {
+		l4g.Logf(l4g.INFO, "[openWriteAheadLog] %d events recovered from write-ahead log", replayed)
+	}
+
+	return wal, nil
 }
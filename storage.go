@@ -1,14 +1,203 @@
 package happening
 
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+)
+
+// Storage backends errors
+var (
+	ErrKeyNotFound    = errors.New("key not found")
+	ErrBackendClosed  = errors.New("storage backend closed")
+	ErrInvalidKvPair  = errors.New("invalid key/value pair: key must not be empty")
+	ErrIteratorClosed = errors.New("iterator closed")
+
+	ErrUnknownStorageBackend = errors.New("unknown storage backend")
+)
+
+// KvPair represents a single key/value entry of a StorageBackend.
 type KvPair struct {
 	Key   []byte
 	Value []byte
 }
 
+// StorageBackend is the contract every happening storage engine
+// has to fulfill. Keys are ordered bytewise, every operation honors
+// the provided context cancellation, and a backend must not be used
+// anymore once it has been closed.
+//
+// Get returns ErrKeyNotFound when the key is missing. MGet returns
+// values in the same order as the requested keys, using a nil value
+// for missing keys. MPut and MDelete are applied atomically.
 type StorageBackend interface {
-	Get(key []byte)
-	Put(pair KvPair)
-	Delete(key []byte)
-	MGet(keys [][]byte)
-	MPut([]KvPair)
+	Get(ctx context.Context, key []byte) ([]byte, error)
+	Put(ctx context.Context, pair KvPair) error
+	Delete(ctx context.Context, key []byte) error
+	MGet(ctx context.Context, keys [][]byte) ([][]byte, error)
+	MPut(ctx context.Context, pairs []KvPair) error
+	MDelete(ctx context.Context, keys [][]byte) error
+	NewIterator(ctx context.Context, opts IteratorOptions) (Iterator, error)
+	Close() error
+}
+
+// Iterator walks over a consistent snapshot of a StorageBackend
+// keyspace, in ascending key order unless created with the Reverse
+// option. An Iterator is positioned before the first entry until Next
+// is called, and has to be closed once done with in order to release
+// the underlying snapshot.
+type Iterator interface {
+	Next() bool
+	Key() []byte
+	Value() []byte
+	Err() error
+	Close() error
+}
+
+// IteratorOptions restricts the entries an Iterator walks over to
+// the keys within [Start, End) which begin with Prefix. Nil bounds
+// and prefix leave the keyspace unrestricted. Reverse walks over
+// entries in descending key order, and a positive Limit stops the
+// iteration after Limit entries.
+type IteratorOptions struct {
+	Start   []byte
+	End     []byte
+	Prefix  []byte
+	Reverse bool
+	Limit   int
+}
+
+// bounds returns the [start, end) key range the options
+// restrict the keyspace to, with Prefix applied.
+func (opts IteratorOptions) bounds() (start []byte, end []byte) {
+	start, end = opts.Start, opts.End
+
+	if len(opts.Prefix) > 0 {
+		if bytes.Compare(opts.Prefix, start) > 0 {
+			start = opts.Prefix
+		}
+
+		if prefixEnd := prefixSuccessor(opts.Prefix); prefixEnd != nil &&
+			(end == nil || bytes.Compare(prefixEnd, end) < 0) {
+			end = prefixEnd
+		}
+	}
+
+	return start, end
+}
+
+// prefixSuccessor returns the smallest key greater than every key
+// beginning with prefix, or nil if there is no such key.
+func prefixSuccessor(prefix []byte) []byte {
+	for index := len(prefix) - 1; index >= 0; index-- {
+		if prefix[index] != 0xff {
+			successor := make([]byte, index+1)
+			copy(successor, prefix)
+			successor[index]++
+			return successor
+		}
+	}
+
+	return nil
+}
+
+// iteratorRange keeps track of an iteration progress through the
+// key range and limit of it's IteratorOptions.
+type iteratorRange struct {
+	start   []byte
+	end     []byte
+	reverse bool
+	limit   int
+	count   int
+	done    bool
+}
+
+func newIteratorRange(opts IteratorOptions) *iteratorRange {
+	start, end := opts.bounds()
+
+	return &iteratorRange{
+		start:   start,
+		end:     end,
+		reverse: opts.Reverse,
+		limit:   opts.Limit,
+		// No key can be within an empty range
+		done: end != nil && bytes.Compare(start, end) >= 0,
+	}
+}
+
+// next returns whether the iteration may go on with key,
+// the next key in iteration order, and counts it if so. Once
+// the range is exhausted, the iteration is marked done.
+func (r *iteratorRange) next(key []byte) bool {
+	switch {
+	case r.limit > 0 && r.count >= r.limit:
+		r.done = true
+	case r.reverse && bytes.Compare(key, r.start) < 0:
+		r.done = true
+	case !r.reverse && r.end != nil && bytes.Compare(key, r.end) >= 0:
+		r.done = true
+	default:
+		r.count++
+	}
+
+	return !r.done
+}
+
+// iteratorKeys returns the keys of backend iterating with opts yields.
+func iteratorKeys(ctx context.Context, backend StorageBackend, opts IteratorOptions) ([][]byte, error) {
+	it, err := backend.NewIterator(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+
+	var keys [][]byte
+	for it.Next() {
+		keys = append(keys, it.Key())
+	}
+
+	return keys, it.Err()
+}
+
+// firstKey returns the first key of backend iterating
+// with opts yields, if any.
+func firstKey(ctx context.Context, backend StorageBackend, opts IteratorOptions) ([]byte, error) {
+	opts.Limit = 1
+
+	keys, err := iteratorKeys(ctx, backend, opts)
+	if err != nil || len(keys) == 0 {
+		return nil, err
+	}
+
+	return keys[0], nil
+}
+
+// storageBackends holds the available StorageBackend constructors,
+// by configuration name. Backends register themselves from their
+// file init function, so that backends depending on build constraints
+// are only available when built.
+var storageBackends = map[string]func(config *Config) (StorageBackend, error){}
+
+// NewStorageBackend opens the StorageBackend selected by
+// the config storage_backend key.
+func NewStorageBackend(config *Config) (StorageBackend, error) {
+	newBackend, ok := storageBackends[config.StorageBackend]
+	if !ok {
+		return nil, fmt.Errorf("%s: %q", ErrUnknownStorageBackend, config.StorageBackend)
+	}
+
+	return newBackend(config)
+}
+
+// validateKvPairs ensures a set of pairs is fit to be written
+// to a StorageBackend.
+func validateKvPairs(pairs []KvPair) error {
+	for _, pair := range pairs {
+		if len(pair.Key) == 0 {
+			return ErrInvalidKvPair
+		}
+	}
+
+	return nil
 }
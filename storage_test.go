@@ -0,0 +1,338 @@
+package happening
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openTestBackends opens one instance of every registered
+// StorageBackend, by name, within a test temporary directory.
+func openTestBackends(t *testing.T) map[string]StorageBackend {
+	t.Helper()
+
+	if len(storageBackends) == 0 {
+		t.Fatal("no storage backend registered")
+	}
+
+	backends := make(map[string]StorageBackend)
+	for name := range storageBackends {
+		config := NewConfig()
+		config.StorageBackend = name
+		config.StoragePath = t.TempDir()
+		config.MemorySnapshot = filepath.Join(config.StoragePath, "snapshot")
+
+		backend, err := NewStorageBackend(config)
+		if err != nil {
+			t.Fatalf("%s: unable to open backend: %s", name, err)
+		}
+		backends[name] = backend
+	}
+
+	return backends
+}
+
+// forEachBackend runs test against a fresh instance of
+// every registered StorageBackend.
+func forEachBackend(t *testing.T, test func(t *testing.T, backend StorageBackend)) {
+	names := make([]string, 0, len(storageBackends))
+	for name := range storageBackends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		t.Run(name, func(t *testing.T) {
+			config := NewConfig()
+			config.StorageBackend = name
+			config.StoragePath = t.TempDir()
+			config.MemorySnapshot = ""
+
+			backend, err := NewStorageBackend(config)
+			if err != nil {
+				t.Fatalf("unable to open backend: %s", err)
+			}
+			defer backend.Close()
+
+			test(t, backend)
+		})
+	}
+}
+
+func putStrings(t *testing.T, backend StorageBackend, keys ...string) {
+	t.Helper()
+
+	pairs := make([]KvPair, len(keys))
+	for index, key := range keys {
+		pairs[index] = KvPair{Key: []byte(key), Value: []byte("v" + key)}
+	}
+
+	if err := backend.MPut(context.Background(), pairs); err != nil {
+		t.Fatalf("MPut: %s", err)
+	}
+}
+
+func TestStorageBackendsRegistered(t *testing.T) {
+	for name, backend := range openTestBackends(t) {
+		if err := backend.Close(); err != nil {
+			t.Errorf("%s: Close: %s", name, err)
+		}
+	}
+
+	if _, ok := storageBackends[STORAGE_GOLEVELDB]; !ok {
+		t.Errorf("%s backend is not registered", STORAGE_GOLEVELDB)
+	}
+	if _, ok := storageBackends[STORAGE_MEMORY]; !ok {
+		t.Errorf("%s backend is not registered", STORAGE_MEMORY)
+	}
+}
+
+func TestStorageBackendGetPut(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, backend StorageBackend) {
+		ctx := context.Background()
+
+		if _, err := backend.Get(ctx, []byte("missing")); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Get(missing) error = %v, want %s", err, ErrKeyNotFound)
+		}
+
+		if err := backend.Put(ctx, KvPair{Key: []byte("a"), Value: []byte("1")}); err != nil {
+			t.Fatalf("Put: %s", err)
+		}
+		if err := backend.Put(ctx, KvPair{Key: []byte("a"), Value: []byte("2")}); err != nil {
+			t.Fatalf("Put overwrite: %s", err)
+		}
+
+		value, err := backend.Get(ctx, []byte("a"))
+		if err != nil || string(value) != "2" {
+			t.Errorf("Get(a) = %q, %v, want \"2\"", value, err)
+		}
+
+		if err := backend.Put(ctx, KvPair{Key: nil, Value: []byte("1")}); !errors.Is(err, ErrInvalidKvPair) {
+			t.Errorf("Put(empty key) error = %v, want %s", err, ErrInvalidKvPair)
+		}
+
+		if err := backend.Delete(ctx, []byte("a")); err != nil {
+			t.Fatalf("Delete: %s", err)
+		}
+		if _, err := backend.Get(ctx, []byte("a")); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("Get(deleted) error = %v, want %s", err, ErrKeyNotFound)
+		}
+		if err := backend.Delete(ctx, []byte("a")); err != nil {
+			t.Errorf("Delete(missing) error = %v, want nil", err)
+		}
+	})
+}
+
+func TestStorageBackendMultiOperations(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, backend StorageBackend) {
+		ctx := context.Background()
+		putStrings(t, backend, "a", "b", "c")
+
+		values, err := backend.MGet(ctx, [][]byte{[]byte("c"), []byte("missing"), []byte("a")})
+		if err != nil {
+			t.Fatalf("MGet: %s", err)
+		}
+		if len(values) != 3 || string(values[0]) != "vc" || values[1] != nil || string(values[2]) != "va" {
+			t.Errorf("MGet = %q, want [vc <nil> va]", values)
+		}
+
+		if err := backend.MPut(ctx, []KvPair{{Key: []byte("d"), Value: []byte("vd")}, {Key: nil}}); !errors.Is(err, ErrInvalidKvPair) {
+			t.Errorf("MPut(empty key) error = %v, want %s", err, ErrInvalidKvPair)
+		}
+		if _, err := backend.Get(ctx, []byte("d")); !errors.Is(err, ErrKeyNotFound) {
+			t.Errorf("MPut with an invalid pair was partially applied")
+		}
+
+		if err := backend.MDelete(ctx, [][]byte{[]byte("a"), []byte("c"), []byte("missing")}); err != nil {
+			t.Fatalf("MDelete: %s", err)
+		}
+
+		keys, err := iteratorKeys(ctx, backend, IteratorOptions{})
+		if err != nil {
+			t.Fatalf("iterate: %s", err)
+		}
+		if got := joinKeys(keys); got != "b" {
+			t.Errorf("keys after MDelete = %q, want \"b\"", got)
+		}
+	})
+}
+
+func TestStorageBackendIterator(t *testing.T) {
+	tests := []struct {
+		name string
+		opts IteratorOptions
+		want string
+	}{
+		{"all", IteratorOptions{}, "a,ab,abc,b,ba,c"},
+		{"prefix", IteratorOptions{Prefix: []byte("a")}, "a,ab,abc"},
+		{"prefix without match", IteratorOptions{Prefix: []byte("z")}, ""},
+		{"start", IteratorOptions{Start: []byte("ab")}, "ab,abc,b,ba,c"},
+		{"end", IteratorOptions{End: []byte("b")}, "a,ab,abc"},
+		{"start and end", IteratorOptions{Start: []byte("ab"), End: []byte("ba")}, "ab,abc,b"},
+		{"empty range", IteratorOptions{Start: []byte("b"), End: []byte("b")}, ""},
+		{"prefix and start", IteratorOptions{Prefix: []byte("a"), Start: []byte("abb")}, "abc"},
+		{"prefix and end", IteratorOptions{Prefix: []byte("b"), End: []byte("c")}, "b,ba"},
+		{"limit", IteratorOptions{Limit: 2}, "a,ab"},
+		{"reverse", IteratorOptions{Reverse: true}, "c,ba,b,abc,ab,a"},
+		{"reverse prefix", IteratorOptions{Prefix: []byte("a"), Reverse: true}, "abc,ab,a"},
+		{"reverse range", IteratorOptions{Start: []byte("ab"), End: []byte("ba"), Reverse: true}, "b,abc,ab"},
+		{"reverse limit", IteratorOptions{Reverse: true, Limit: 2}, "c,ba"},
+		{"reverse prefix limit", IteratorOptions{Prefix: []byte("a"), Reverse: true, Limit: 1}, "abc"},
+	}
+
+	forEachBackend(t, func(t *testing.T, backend StorageBackend) {
+		putStrings(t, backend, "c", "a", "ba", "abc", "b", "ab")
+
+		for _, test := range tests {
+			keys, err := iteratorKeys(context.Background(), backend, test.opts)
+			if err != nil {
+				t.Errorf("%s: %s", test.name, err)
+				continue
+			}
+			if got := joinKeys(keys); got != test.want {
+				t.Errorf("%s: keys = %q, want %q", test.name, got, test.want)
+			}
+		}
+	})
+}
+
+func TestStorageBackendIteratorSnapshot(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, backend StorageBackend) {
+		ctx := context.Background()
+		putStrings(t, backend, "a", "b")
+
+		it, err := backend.NewIterator(ctx, IteratorOptions{})
+		if err != nil {
+			t.Fatalf("NewIterator: %s", err)
+		}
+
+		putStrings(t, backend, "c")
+		if err := backend.Delete(ctx, []byte("a")); err != nil {
+			t.Fatalf("Delete: %s", err)
+		}
+
+		var keys [][]byte
+		for it.Next() {
+			keys = append(keys, it.Key())
+			if want := "v" + string(it.Key()); string(it.Value()) != want {
+				t.Errorf("Value(%s) = %q, want %q", it.Key(), it.Value(), want)
+			}
+		}
+		if err := it.Err(); err != nil {
+			t.Errorf("Err: %s", err)
+		}
+		if err := it.Close(); err != nil {
+			t.Errorf("Close: %s", err)
+		}
+
+		if got := joinKeys(keys); got != "a,b" {
+			t.Errorf("snapshot keys = %q, want \"a,b\"", got)
+		}
+	})
+}
+
+func TestStorageBackendContext(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, backend StorageBackend) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		if err := backend.Put(ctx, KvPair{Key: []byte("a"), Value: []byte("1")}); !errors.Is(err, context.Canceled) {
+			t.Errorf("Put with a canceled context error = %v, want %s", err, context.Canceled)
+		}
+		if _, err := backend.NewIterator(ctx, IteratorOptions{}); !errors.Is(err, context.Canceled) {
+			t.Errorf("NewIterator with a canceled context error = %v, want %s", err, context.Canceled)
+		}
+	})
+}
+
+func TestStorageBackendClose(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, backend StorageBackend) {
+		ctx := context.Background()
+		putStrings(t, backend, "a")
+
+		if err := backend.Close(); err != nil {
+			t.Fatalf("Close: %s", err)
+		}
+
+		operations := map[string]func() error{
+			"Get":     func() error { _, err := backend.Get(ctx, []byte("a")); return err },
+			"Put":     func() error { return backend.Put(ctx, KvPair{Key: []byte("a"), Value: []byte("1")}) },
+			"Delete":  func() error { return backend.Delete(ctx, []byte("a")) },
+			"MGet":    func() error { _, err := backend.MGet(ctx, [][]byte{[]byte("a")}); return err },
+			"MPut":    func() error { return backend.MPut(ctx, []KvPair{{Key: []byte("a"), Value: []byte("1")}}) },
+			"MDelete": func() error { return backend.MDelete(ctx, [][]byte{[]byte("a")}) },
+			"NewIterator": func() error {
+				_, err := backend.NewIterator(ctx, IteratorOptions{})
+				return err
+			},
+		}
+
+		for name, operation := range operations {
+			if err := operation(); !errors.Is(err, ErrBackendClosed) {
+				t.Errorf("%s after Close error = %v, want %s", name, err, ErrBackendClosed)
+			}
+		}
+	})
+}
+
+func TestStorageBackendCloseWithOpenIterator(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, backend StorageBackend) {
+		ctx := context.Background()
+		putStrings(t, backend, "a", "b", "c")
+
+		it, err := backend.NewIterator(ctx, IteratorOptions{})
+		if err != nil {
+			t.Fatalf("NewIterator: %s", err)
+		}
+		if !it.Next() {
+			t.Fatalf("Next: %v", it.Err())
+		}
+
+		// Reading while iterating, as index scans do
+		if _, err := backend.MGet(ctx, [][]byte{it.Key()}); err != nil {
+			t.Fatalf("MGet during iteration: %s", err)
+		}
+
+		closed := make(chan error, 1)
+		go func() { closed <- backend.Close() }()
+
+		select {
+		case err := <-closed:
+			if err != nil {
+				t.Fatalf("Close: %s", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Close blocked by an open iterator")
+		}
+
+		if it.Next() {
+			t.Errorf("Next after the backend was closed succeeded")
+		}
+		if err := it.Err(); !errors.Is(err, ErrBackendClosed) {
+			t.Errorf("Err after the backend was closed = %v, want %s", err, ErrBackendClosed)
+		}
+		if err := it.Close(); err != nil {
+			t.Errorf("Close iterator after the backend: %s", err)
+		}
+	})
+}
+
+func joinKeys(keys [][]byte) string {
+	parts := make([]string, len(keys))
+	for index, key := range keys {
+		parts[index] = string(key)
+	}
+
+	return strings.Join(parts, ",")
+}
+
+func TestDefaultStorageBackendRegistered(t *testing.T) {
+	// The default backend has to be available without cgo
+	if _, ok := storageBackends[DEFAULT_STORAGE_BACKEND]; !ok {
+		t.Errorf("default %s backend is not registered", DEFAULT_STORAGE_BACKEND)
+	}
+}
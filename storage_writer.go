@@ -0,0 +1,170 @@
+package happening
+
+import (
+	"context"
+	"fmt"
+	l4g "github.com/alecthomas/log4go"
+	"time"
+)
+
+// StorageWriter is a Service draining the events queue
+// and persisting events in batches into a StorageBackend.
+// Once persisted, events are committed to the Wal, if any.
+// Each batch also stores the greatest sequence written so far,
+// for sequences to resume from it on restart. When TrackLateEvents
+// is set, events stored once the rollups of their buckets may have
+// been computed are marked late, for the RollupService to add them.
+type StorageWriter struct {
+	Service
+	Backend         StorageBackend
+	Queue           *Queue
+	Wal             *WriteAheadLog
+	TrackLateEvents bool
+
+	pending       []KvPair
+	pendingEvents []*Event
+	sequence      uint64
+}
+
+// NewStorageWriter builds a new StorageWriter persisting
+// the events pushed into queue through the backend.
+func NewStorageWriter(backend StorageBackend, queue *Queue) *StorageWriter {
+	return &StorageWriter{
+		Service: *NewService("StorageWriter"),
+		Backend: backend,
+		Queue:   queue,
+	}
+}
+
+// Start runs the StorageWriter flushing routine in background.
+func (w *StorageWriter) Start() {
+	go w.Run()
+}
+
+// Run should be run as a long-running goroutine. It periodically
+// flushes the queue to the storage backend until the service
+// is stopped, and then flushes whatever remains in the queue.
+func (w *StorageWriter) Run() {
+	defer w.waitGroup.Done()
+	l4g.Info(fmt.Sprintf("[%s.Run] Storage writer ready to persist events", w.name))
+
+	ticker := time.NewTicker(time.Duration(STORAGE_FLUSH_INTERVAL) * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.ch:
+			w.Flush()
+			return
+		case <-ticker.C:
+			w.Flush()
+		}
+	}
+}
+
+// Flush drains the queue and writes it's events, along with their
+// indexes entries, to the storage backend in batches of at most
+// STORAGE_BATCH_SIZE events. A batch failing to be written is kept,
+// and retried on next flush until it succeeds: as it's events may
+// still be stored, they are not refused, and events awaiting storage
+// are only notified once their batch has been written.
+func (w *StorageWriter) Flush() {
+	for {
+		if len(w.pending) == 0 {
+			for _, node := range w.Queue.PopN(STORAGE_BATCH_SIZE) {
+				event, ok := node.(*Event)
+				if !ok {
+					continue
+				}
+				pairs, err := eventKvPairs(event)
+				if err != nil {
+					l4g.Error(fmt.Sprintf("[%s.Flush] Discarding event %s: %s", w.name, event, err))
+					event.markStored(&EventError{Code: NACK_MALFORMED_EVENT, Message: err.Error()})
+					continue
+				}
+				w.pending = append(w.pending, pairs...)
+				w.pendingEvents = append(w.pendingEvents, event)
+				if event.seq > w.sequence {
+					w.sequence = event.seq
+				}
+			}
+
+			if len(w.pending) > 0 {
+				w.pending = append(w.pending, eventSequenceKvPair(w.sequence))
+			}
+		}
+
+		if len(w.pending) == 0 {
+			return
+		}
+
+		err := w.Backend.MPut(context.Background(), w.batch())
+		if err != nil {
+			l4g.Error(fmt.Sprintf("[%s.Flush] Unable to persist %d events, retrying on next flush: %s", w.name, len(w.pendingEvents), err))
+			return
+		}
+
+		l4g.Debug(fmt.Sprintf("[%s.Flush] %d events persisted", w.name, len(w.pendingEvents)))
+		w.commit()
+		for _, event := range w.pendingEvents {
+			event.markStored(nil)
+		}
+		w.pending = nil
+		w.pendingEvents = nil
+	}
+}
+
+// batch returns the pairs of the pending events, along with the late
+// marks of the ones stored too late to be rolled up on time. Events
+// are marked as of the write, as a failed batch may be retried late.
+func (w *StorageWriter) batch() []KvPair {
+	if !w.TrackLateEvents {
+		return w.pending
+	}
+
+	pairs := w.pending[:len(w.pending):len(w.pending)]
+	late := time.Now().Unix() - ROLLUP_LATE_DELAY
+	for _, event := range w.pendingEvents {
+		if event.SentOn >= late {
+			continue
+		}
+
+		pair, err := lateEventKvPair(event)
+		if err != nil {
+			continue
+		}
+		pairs = append(pairs, pair)
+	}
+
+	return pairs
+}
+
+// commit marks the pending events as persisted in the write-ahead
+// log. As the queue follows the log order, the last pending event
+// holds the greatest lsn.
+func (w *StorageWriter) commit() {
+	if w.Wal == nil || len(w.pendingEvents) == 0 {
+		return
+	}
+
+	lsn := w.pendingEvents[len(w.pendingEvents)-1].lsn
+	if err := w.Wal.Commit(lsn); err != nil {
+		l4g.Error(fmt.Sprintf("[%s.commit] Unable to commit write-ahead log: %s", w.name, err))
+	}
+}
+
+// eventKvPairs builds the storage key/value pair of an event,
+// followed by the indexes entries pointing to it.
+func eventKvPairs(event *Event) ([]KvPair, error) {
+	key, err := NewEventKey(event).Encode()
+	if err != nil {
+		return nil, err
+	}
+
+	indexPairs, err := eventIndexKvPairs(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]KvPair{{Key: key, Value: EncodeEvent(event)}}, indexPairs...), nil
+}
@@ -0,0 +1,59 @@
+package happening
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// failingBackend is a StorageBackend whose MPut
+// fails for as long as it's fail flag is set.
+type failingBackend struct {
+	StorageBackend
+	fail bool
+}
+
+func (b *failingBackend) MPut(ctx context.Context, pairs []KvPair) error {
+	if b.fail {
+		return errors.New("disk full")
+	}
+	return b.StorageBackend.MPut(ctx, pairs)
+}
+
+func TestStorageWriterRetriesFailedBatches(t *testing.T) {
+	memory, err := NewMemoryBackend(0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &failingBackend{StorageBackend: memory, fail: true}
+
+	queue := NewQueue(EVENTS_QUEUE_SIZE)
+	writer := NewStorageWriter(backend, queue)
+
+	event := NewEvent("kitchen", 1392821124, 1392821124, "temperature")
+	event.awaitStorage()
+	queue.Push(event)
+
+	writer.Flush()
+	if err := event.WaitStored(10 * time.Millisecond); err == nil || err.(*EventError).Code != NACK_STORAGE_TIMEOUT {
+		t.Fatalf("event of a failed batch notified with %v, want it to await storage", err)
+	}
+	if len(writer.pendingEvents) != 1 {
+		t.Fatalf("failed batch holds %d events, want 1", len(writer.pendingEvents))
+	}
+
+	backend.fail = false
+	writer.Flush()
+	if err := event.WaitStored(time.Second); err != nil {
+		t.Fatalf("retried event stored with %v, want nil", err)
+	}
+
+	keys, err := iteratorKeys(context.Background(), memory, IteratorOptions{Prefix: []byte{EVENTS_KEYSPACE}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 {
+		t.Errorf("%d events stored, want 1", len(keys))
+	}
+}
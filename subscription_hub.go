@@ -0,0 +1,136 @@
+package happening
+
+import (
+	"fmt"
+	l4g "github.com/alecthomas/log4go"
+	"sync"
+	"sync/atomic"
+)
+
+// Subscription represents a live events listener registered
+// on a SubscriptionHub. Matching events are delivered through the
+// Events channel, which is closed once the subscription ends.
+type Subscription struct {
+	Events chan *Event
+	Filter *EventFilter
+
+	dropped          uint64
+	consecutiveDrops int
+	closed           bool
+}
+
+// Dropped returns how many events were dropped because the
+// subscriber was not consuming them fast enough.
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// SubscriptionHub is a Service fanning out the events sent over
+// it's source channel to every matching subscription.
+//
+// Each subscription has a bounded buffer. When a subscriber buffer
+// is full the event is dropped for that subscriber only, and a
+// subscriber dropping more than SUBSCRIBER_MAX_CONSECUTIVE_DROPS
+// events in a row is considered stuck and is unsubscribed.
+type SubscriptionHub struct {
+	Service
+	Source chan *Event
+
+	mu            sync.Mutex
+	subscriptions map[*Subscription]bool
+}
+
+// NewSubscriptionHub builds a SubscriptionHub listening to source.
+func NewSubscriptionHub(source chan *Event) *SubscriptionHub {
+	return &SubscriptionHub{
+		Service:       *NewService("SubscriptionHub"),
+		Source:        source,
+		subscriptions: make(map[*Subscription]bool),
+	}
+}
+
+// Start runs the SubscriptionHub dispatching routine in background.
+func (h *SubscriptionHub) Start() {
+	go h.Run()
+}
+
+// Run should be run as a long-running goroutine. It dispatches
+// events from the hub source to subscriptions until the service
+// is stopped, and then ends every remaining subscription.
+func (h *SubscriptionHub) Run() {
+	defer h.waitGroup.Done()
+
+	for {
+		select {
+		case <-h.ch:
+			h.mu.Lock()
+			for subscription := range h.subscriptions {
+				h.unsubscribe(subscription)
+			}
+			h.mu.Unlock()
+			return
+		case event := <-h.Source:
+			h.Dispatch(event)
+		}
+	}
+}
+
+// Subscribe registers a new subscription receiving the events matching
+// filter, buffering at most bufferSize of them.
+func (h *SubscriptionHub) Subscribe(filter *EventFilter, bufferSize int) *Subscription {
+	subscription := &Subscription{
+		Events: make(chan *Event, bufferSize),
+		Filter: filter,
+	}
+
+	h.mu.Lock()
+	h.subscriptions[subscription] = true
+	h.mu.Unlock()
+
+	return subscription
+}
+
+// Unsubscribe ends a subscription and closes it's events channel.
+func (h *SubscriptionHub) Unsubscribe(subscription *Subscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.unsubscribe(subscription)
+}
+
+func (h *SubscriptionHub) unsubscribe(subscription *Subscription) {
+	if subscription.closed {
+		return
+	}
+
+	subscription.closed = true
+	delete(h.subscriptions, subscription)
+	close(subscription.Events)
+}
+
+// Dispatch delivers an event to the subscriptions it matches
+// without ever blocking on a slow subscriber.
+func (h *SubscriptionHub) Dispatch(event *Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for subscription := range h.subscriptions {
+		if !subscription.Filter.Match(event) {
+			continue
+		}
+
+		select {
+		case subscription.Events <- event:
+			subscription.consecutiveDrops = 0
+		default:
+			atomic.AddUint64(&subscription.dropped, 1)
+			subscription.consecutiveDrops++
+
+			if subscription.consecutiveDrops > SUBSCRIBER_MAX_CONSECUTIVE_DROPS {
+				l4g.Warn(fmt.Sprintf("[%s.Dispatch] Dropping slow subscriber after %d lost events",
+					h.name, subscription.Dropped()))
+				h.unsubscribe(subscription)
+			}
+		}
+	}
+}
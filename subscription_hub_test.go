@@ -0,0 +1,129 @@
+package happening
+
+import (
+	"testing"
+	"time"
+)
+
+// receiveEvents returns the events buffered by a subscription,
+// and whether it's events channel is still open.
+func receiveEvents(subscription *Subscription) ([]*Event, bool) {
+	var events []*Event
+
+	for {
+		select {
+		case event, ok := <-subscription.Events:
+			if !ok {
+				return events, false
+			}
+			events = append(events, event)
+		default:
+			return events, true
+		}
+	}
+}
+
+func TestSubscriptionHubDispatchFilters(t *testing.T) {
+	hub := NewSubscriptionHub(make(chan *Event))
+
+	kitchen := NewEventFilter()
+	kitchen.From = "kitchen"
+	humidity := NewEventFilter()
+	humidity.Type = "humidity"
+	recent := NewEventFilter()
+	recent.Since = 1392821124
+
+	subscriptions := map[string]*Subscription{
+		"all":      hub.Subscribe(NewEventFilter(), 10),
+		"kitchen":  hub.Subscribe(kitchen, 10),
+		"humidity": hub.Subscribe(humidity, 10),
+		"recent":   hub.Subscribe(recent, 10),
+	}
+
+	hub.Dispatch(NewEvent("kitchen", 1392821124, 1392821124, "temperature"))
+	hub.Dispatch(NewEvent("cellar", 1392821123, 1392821124, "humidity"))
+	hub.Dispatch(NewEvent("kitchen", 1392821125, 1392821125, "humidity"))
+
+	want := map[string]int{"all": 3, "kitchen": 2, "humidity": 2, "recent": 2}
+	for name, subscription := range subscriptions {
+		events, open := receiveEvents(subscription)
+		if len(events) != want[name] || !open {
+			t.Errorf("%s subscription received %d events, open %t, want %d, true", name, len(events), open, want[name])
+		}
+	}
+}
+
+func TestSubscriptionHubSlowSubscriber(t *testing.T) {
+	hub := NewSubscriptionHub(make(chan *Event))
+	slow := hub.Subscribe(NewEventFilter(), 1)
+	fast := hub.Subscribe(NewEventFilter(), 1)
+
+	dispatch := func(count int) {
+		for index := 0; index < count; index++ {
+			hub.Dispatch(NewEvent("kitchen", 1392821124, 1392821124, "temperature"))
+			receiveEvents(fast)
+		}
+	}
+
+	// The first event is buffered, and the following
+	// ones dropped until the subscriber is deemed stuck.
+	dispatch(1 + SUBSCRIBER_MAX_CONSECUTIVE_DROPS)
+	if slow.Dropped() != SUBSCRIBER_MAX_CONSECUTIVE_DROPS {
+		t.Errorf("slow subscriber dropped %d events, want %d", slow.Dropped(), SUBSCRIBER_MAX_CONSECUTIVE_DROPS)
+	}
+
+	// Consuming an event resets the consecutive drops
+	<-slow.Events
+	dispatch(1 + SUBSCRIBER_MAX_CONSECUTIVE_DROPS)
+	if events, open := receiveEvents(slow); len(events) != 1 || !open {
+		t.Fatalf("slow subscriber received %d events, open %t, want 1, true", len(events), open)
+	}
+
+	// One more drop than the allowed ones unsubscribes
+	dispatch(2 + SUBSCRIBER_MAX_CONSECUTIVE_DROPS)
+	if events, open := receiveEvents(slow); len(events) != 1 || open {
+		t.Errorf("stuck subscriber received %d events, open %t, want 1, false", len(events), open)
+	}
+	if slow.Dropped() != 3*SUBSCRIBER_MAX_CONSECUTIVE_DROPS+1 {
+		t.Errorf("stuck subscriber dropped %d events, want %d", slow.Dropped(), 3*SUBSCRIBER_MAX_CONSECUTIVE_DROPS+1)
+	}
+
+	if fast.Dropped() != 0 {
+		t.Errorf("fast subscriber dropped %d events, want 0", fast.Dropped())
+	}
+	if _, open := receiveEvents(fast); !open {
+		t.Errorf("fast subscriber unsubscribed along with the slow one")
+	}
+
+	// Unsubscribing again is harmless
+	hub.Unsubscribe(slow)
+}
+
+func TestSubscriptionHubStop(t *testing.T) {
+	source := make(chan *Event)
+	hub := NewSubscriptionHub(source)
+	subscription := hub.Subscribe(NewEventFilter(), 10)
+	unsubscribed := hub.Subscribe(NewEventFilter(), 10)
+	hub.Start()
+
+	hub.Unsubscribe(unsubscribed)
+	if _, open := receiveEvents(unsubscribed); open {
+		t.Errorf("unsubscribed subscription events channel left open")
+	}
+
+	source <- NewEvent("kitchen", 1392821124, 1392821124, "temperature")
+	hub.Stop()
+
+	select {
+	case event := <-subscription.Events:
+		if event == nil || event.From != "kitchen" {
+			t.Errorf("received %v, want the kitchen event", event)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("event sent over the hub source not dispatched")
+	}
+
+	if events, open := receiveEvents(subscription); len(events) != 0 || open {
+		t.Errorf("subscription after Stop holds %d events, open %t, want 0, false", len(events), open)
+	}
+}
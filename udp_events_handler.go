@@ -0,0 +1,88 @@
+package happening
+
+import (
+	"fmt"
+	l4g "github.com/alecthomas/log4go"
+	"net"
+	"time"
+)
+
+// UdpEventsHandler is built on the Service structure and receives
+// events sent as UDP datagrams by fire-and-forget events sources.
+// Each datagram holds one or more events frames, decoded using the
+// UdpEventsHandler Codec, which are pushed to the EventsHandler
+// queue. As UDP is connexionless, events are never acknowledged.
+type UdpEventsHandler struct {
+	Service
+	Socket        *net.UDPConn
+	EventsHandler *EventsHandler
+	Codec         EventCodec
+}
+
+// NewUdpEventsHandler builds a new UdpEventsHandler pushing the
+// events it receives through handler. Please use the Start method
+// to bind it's socket and receive events.
+func NewUdpEventsHandler(handler *EventsHandler) *UdpEventsHandler {
+	return &UdpEventsHandler{
+		Service:       *NewService("UdpEventsHandler"),
+		EventsHandler: handler,
+		Codec:         PipeCodec{},
+	}
+}
+
+// Start binds the UdpEventsHandler socket on host and port,
+// and handles incoming datagrams in background.
+func (u *UdpEventsHandler) Start(host string, port string) error {
+	socket, err := BuildUdpListener("udp", host, port)
+	if err != nil {
+		return err
+	}
+	u.Socket = socket
+
+	go u.HandleDatagrams()
+
+	return nil
+}
+
+// Stop the UdpEventsHandler by closing the service's channel and socket.
+// Blocks until the service is really stopped.
+func (u *UdpEventsHandler) Stop() {
+	close(u.ch)
+	u.waitGroup.Wait()
+	u.Socket.Close()
+}
+
+// HandleDatagrams should be run as a long-running goroutine to
+// read datagrams from the UdpEventsHandler socket, extract their
+// events and push them to the EventsHandler queue.
+func (u *UdpEventsHandler) HandleDatagrams() {
+	defer u.waitGroup.Done()
+	l4g.Info(fmt.Sprintf("[%s.HandleDatagrams] Listening for events datagrams on %s", u.name, u.Socket.LocalAddr()))
+
+	datagram := make([]byte, EVENTS_DATAGRAM_BUF_SIZE)
+
+	for {
+		select {
+		case <-u.ch:
+			return
+		default:
+			u.Socket.SetReadDeadline(time.Now().Add(time.Duration(EVENT_REG_CONN_TIMEOUT) * time.Second))
+			readLen, source, err := u.Socket.ReadFromUDP(datagram)
+			if err != nil {
+				if opErr, ok := err.(*net.OpError); ok && opErr.Timeout() {
+					continue
+				}
+				l4g.Error(fmt.Sprintf("[%s.HandleDatagrams] %s", u.name, err))
+				return
+			}
+
+			frames, err := ExtractFrames(u.Codec, datagram[:readLen])
+			if err != nil {
+				l4g.Error(fmt.Sprintf("[%s.HandleDatagrams] Invalid datagram from %s: %s", u.name, source, err))
+			}
+
+			l4g.Debug(fmt.Sprintf("[%s.HandleDatagrams] %d events received from %s", u.name, len(frames), source))
+			u.EventsHandler.PushEventsToQueue(u.Codec, frames, &EventsSource{Addr: source.String()})
+		}
+	}
+}
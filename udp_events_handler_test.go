@@ -0,0 +1,49 @@
+package happening
+
+import (
+	"net"
+	"testing"
+)
+
+func TestUdpEventsHandler(t *testing.T) {
+	handler := NewEventsHandler()
+	udpHandler := NewUdpEventsHandler(handler)
+	if err := udpHandler.Start("127.0.0.1", ":0"); err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := net.DialUDP("udp", nil, udpHandler.Socket.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	// Datagrams may hold several events, the last one being
+	// unterminated, and malformed ones are left out.
+	datagrams := []string{
+		"kitchen|1392821124|temperature|21.5\r\nbroken\r\ncellar|1392821124|door|open",
+		"kitchen|1392821125|humidity|40\r\n",
+	}
+	for _, datagram := range datagrams {
+		if _, err := client.Write([]byte(datagram)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	events := awaitQueued(t, handler, 3)
+	var received []string
+	for _, event := range events {
+		received = append(received, event.From+"|"+event.Type)
+	}
+	if want := []string{"kitchen|temperature", "cellar|door", "kitchen|humidity"}; !equalReplies(received, want) {
+		t.Errorf("queued events %q, want %q", received, want)
+	}
+	if value := events[1].Value; value == nil || value.Text != "open" {
+		t.Errorf("cellar event value = %v, want open", value)
+	}
+
+	// Events received over UDP are never acknowledged
+	assertSilent(t, client)
+
+	udpHandler.Stop()
+}
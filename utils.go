@@ -1,6 +1,10 @@
 package happening
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
 	"net"
 )
 
@@ -22,3 +26,57 @@ func BuildTcpListener(transport string, host string, port string) (*net.TCPListe
 
 	return listener, nil
 }
+
+func BuildUdpListener(transport string, host string, port string) (*net.UDPConn, error) {
+	endpoint := host + port
+
+	// Resolve udp endpoint addr
+	addr, err := net.ResolveUDPAddr(transport, endpoint)
+	if nil != err {
+		return nil, err
+	}
+
+	listener, err := net.ListenUDP(transport, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return listener, nil
+}
+
+// BuildTlsConfig builds a server tls.Config from PEM encoded
+// certificate and key files. When clientCAFile is not empty,
+// clients are required to present a certificate signed by one
+// of the certificate authorities it holds.
+func BuildTlsConfig(certFile string, keyFile string, clientCAFile string) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("both a tls certificate and key are required")
+	}
+
+	certificate, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if clientCAFile != "" {
+		pem, err := ioutil.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", clientCAFile)
+		}
+
+		tlsConfig.ClientCAs = clientCAs
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tlsConfig, nil
+}
@@ -0,0 +1,490 @@
+package happening
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	l4g "github.com/alecthomas/log4go"
+)
+
+// Write-ahead log errors
+var (
+	ErrWalClosed        = errors.New("write-ahead log closed")
+	ErrWalCorrupted     = errors.New("corrupted write-ahead log record")
+	ErrWalRecordTooLong = errors.New("write-ahead log record too long")
+	ErrInvalidWalPolicy = errors.New("invalid write-ahead log sync policy")
+)
+
+var walCrcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// WriteAheadLog is a segmented, append-only, on-disk log of payloads.
+// Each appended payload is assigned an increasing log sequence number
+// (lsn), and is kept on disk until an lsn greater or equal to it's
+// own has been committed.
+//
+// Segments are files of the log directory named after the lsn of
+// their first record. Records are laid out as:
+//
+//	length | crc | lsn | payload
+//
+// where length is the payload length as a big endian uint32, of at
+// most WAL_SEGMENT_SIZE bytes, crc the big endian uint32 castagnoli
+// checksum of length, lsn and payload, and lsn a big endian uint64.
+// The last committed lsn is kept in the log directory checkpoint file.
+//
+// A record may be cancelled before it's committed, when the payload
+// it holds is eventually dropped, by appending a tombstone record:
+// it's length has the WAL_RECORD_TOMBSTONE flag set, and it's payload
+// is the big endian uint64 lsn of the cancelled record. Cancelled
+// records are not replayed.
+//
+// Depending on it's sync policy, the log fsyncs the current segment
+// after each append (WAL_SYNC_ALWAYS), every sync interval
+// (WAL_SYNC_INTERVAL), or leaves it to the operating system
+// (WAL_SYNC_NEVER).
+type WriteAheadLog struct {
+	Dir          string
+	SyncPolicy   string
+	SyncInterval time.Duration
+
+	mu          sync.Mutex
+	segments    []uint64 // first lsn of each segment, in order
+	current     *os.File
+	currentSize int64
+	nextLsn     uint64
+	committed   uint64
+	dirty       bool
+	closed      bool
+	stop        chan bool
+	done        chan bool
+}
+
+// OpenWriteAheadLog opens, or creates, the write-ahead log stored in
+// dir, and starts a new segment to append records to.
+func OpenWriteAheadLog(dir string, syncPolicy string, syncInterval time.Duration) (*WriteAheadLog, error) {
+	switch syncPolicy {
+	case WAL_SYNC_ALWAYS, WAL_SYNC_INTERVAL, WAL_SYNC_NEVER:
+	default:
+		return nil, fmt.Errorf("%s: %q", ErrInvalidWalPolicy, syncPolicy)
+	}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	wal := &WriteAheadLog{
+		Dir:          dir,
+		SyncPolicy:   syncPolicy,
+		SyncInterval: syncInterval,
+		stop:         make(chan bool),
+		done:         make(chan bool),
+	}
+
+	if err := wal.load(); err != nil {
+		return nil, err
+	}
+
+	if err := wal.rotate(); err != nil {
+		return nil, err
+	}
+
+	go wal.syncLoop()
+
+	return wal, nil
+}
+
+// load reads the log checkpoint and segments list, and
+// finds out the next lsn to be assigned.
+func (wal *WriteAheadLog) load() error {
+	checkpoint, err := ioutil.ReadFile(wal.checkpointPath())
+	if err == nil && len(checkpoint) == 8 {
+		wal.committed = binary.BigEndian.Uint64(checkpoint)
+	} else if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	wal.nextLsn = wal.committed + 1
+
+	entries, err := ioutil.ReadDir(wal.Dir)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, WAL_SEGMENT_EXTENSION) {
+			continue
+		}
+
+		firstLsn, err := strconv.ParseUint(strings.TrimSuffix(name, WAL_SEGMENT_EXTENSION), 10, 64)
+		if err != nil {
+			continue
+		}
+		wal.segments = append(wal.segments, firstLsn)
+	}
+	sort.Slice(wal.segments, func(i, j int) bool { return wal.segments[i] < wal.segments[j] })
+
+	// The next lsn follows the last record of the last segment
+	for index := len(wal.segments) - 1; index >= 0; index-- {
+		var lastLsn uint64
+
+		err := wal.readSegment(wal.segments[index], func(lsn uint64, payload []byte, tombstone bool) error {
+			lastLsn = lsn
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		if lastLsn != 0 {
+			if lastLsn >= wal.nextLsn {
+				wal.nextLsn = lastLsn + 1
+			}
+			break
+		}
+	}
+
+	return nil
+}
+
+// Replay calls fn, in order, with every record which has been
+// neither committed nor cancelled yet. It should be called before
+// any record is appended.
+func (wal *WriteAheadLog) Replay(fn func(lsn uint64, payload []byte) error) error {
+	wal.mu.Lock()
+	segments := append([]uint64(nil), wal.segments...)
+	committed := wal.committed
+	wal.mu.Unlock()
+
+	// Tombstones follow the records they cancel, so
+	// let's collect them all before replaying any.
+	cancelled := make(map[uint64]bool)
+	for _, firstLsn := range segments {
+		err := wal.readSegment(firstLsn, func(lsn uint64, payload []byte, tombstone bool) error {
+			if tombstone && len(payload) == 8 {
+				cancelled[binary.BigEndian.Uint64(payload)] = true
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, firstLsn := range segments {
+		err := wal.readSegment(firstLsn, func(lsn uint64, payload []byte, tombstone bool) error {
+			if lsn <= committed || tombstone || cancelled[lsn] {
+				return nil
+			}
+			return fn(lsn, payload)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Append writes a payload to the log, and returns it's lsn.
+func (wal *WriteAheadLog) Append(payload []byte) (uint64, error) {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	if len(payload) > WAL_SEGMENT_SIZE {
+		return 0, fmt.Errorf("%s: %d bytes", ErrWalRecordTooLong, len(payload))
+	}
+
+	return wal.appendRecord(payload, 0)
+}
+
+// Cancel appends a tombstone record to the log, so that the record
+// at lsn, whose payload was dropped before being committed, is not
+// replayed.
+func (wal *WriteAheadLog) Cancel(lsn uint64) error {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	_, err := wal.appendRecord(appendUint64(make([]byte, 0, 8), lsn), WAL_RECORD_TOMBSTONE)
+
+	return err
+}
+
+// appendRecord writes a record holding payload, whose length
+// is flagged with flags, and returns it's lsn.
+func (wal *WriteAheadLog) appendRecord(payload []byte, flags uint32) (uint64, error) {
+	if wal.closed {
+		return 0, ErrWalClosed
+	}
+
+	if wal.currentSize >= WAL_SEGMENT_SIZE {
+		if err := wal.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	lsn := wal.nextLsn
+	record := make([]byte, WAL_RECORD_HEADER_SIZE+len(payload))
+	binary.BigEndian.PutUint32(record[0:4], uint32(len(payload))|flags)
+	binary.BigEndian.PutUint64(record[8:16], lsn)
+	copy(record[WAL_RECORD_HEADER_SIZE:], payload)
+	binary.BigEndian.PutUint32(record[4:8], walRecordCrc(record[:WAL_RECORD_HEADER_SIZE], payload))
+
+	if _, err := wal.current.Write(record); err != nil {
+		return 0, err
+	}
+	wal.currentSize += int64(len(record))
+	wal.nextLsn++
+
+	if wal.SyncPolicy == WAL_SYNC_ALWAYS {
+		if err := wal.current.Sync(); err != nil {
+			return 0, err
+		}
+	} else {
+		wal.dirty = true
+	}
+
+	return lsn, nil
+}
+
+// Commit marks every record up to lsn as committed, and removes
+// the segments holding committed records only.
+func (wal *WriteAheadLog) Commit(lsn uint64) error {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	if wal.closed {
+		return ErrWalClosed
+	}
+
+	if lsn <= wal.committed {
+		return nil
+	}
+	wal.committed = lsn
+
+	if err := wal.writeCheckpoint(); err != nil {
+		return err
+	}
+
+	// A segment only holds committed records once the
+	// following one starts after the committed lsn.
+	for len(wal.segments) > 1 && wal.segments[1]-1 <= wal.committed {
+		if err := os.Remove(wal.segmentPath(wal.segments[0])); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		wal.segments = wal.segments[1:]
+	}
+
+	return nil
+}
+
+// Close syncs and closes the log.
+func (wal *WriteAheadLog) Close() error {
+	wal.mu.Lock()
+	if wal.closed {
+		wal.mu.Unlock()
+		return ErrWalClosed
+	}
+	wal.closed = true
+	wal.mu.Unlock()
+
+	close(wal.stop)
+	<-wal.done
+
+	if err := wal.current.Sync(); err != nil {
+		wal.current.Close()
+		return err
+	}
+
+	return wal.current.Close()
+}
+
+// syncLoop should be run as a long-running goroutine, and
+// periodically syncs the current segment when the log sync
+// policy is WAL_SYNC_INTERVAL.
+func (wal *WriteAheadLog) syncLoop() {
+	defer close(wal.done)
+
+	if wal.SyncPolicy != WAL_SYNC_INTERVAL {
+		<-wal.stop
+		return
+	}
+
+	ticker := time.NewTicker(wal.SyncInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-wal.stop:
+			return
+		case <-ticker.C:
+			wal.mu.Lock()
+			if wal.dirty && !wal.closed {
+				if err := wal.current.Sync(); err != nil {
+					l4g.Error(fmt.Sprintf("[WriteAheadLog.syncLoop] %s", err))
+				}
+				wal.dirty = false
+			}
+			wal.mu.Unlock()
+		}
+	}
+}
+
+// rotate closes the current segment, if any, and
+// starts a new one at the next lsn.
+func (wal *WriteAheadLog) rotate() error {
+	if wal.current != nil {
+		if err := wal.current.Sync(); err != nil {
+			return err
+		}
+		wal.current.Close()
+	}
+
+	// An empty last segment starts at the next lsn already
+	if last := len(wal.segments) - 1; last >= 0 && wal.segments[last] == wal.nextLsn {
+		wal.segments = wal.segments[:last]
+	}
+
+	segment, err := os.OpenFile(wal.segmentPath(wal.nextLsn), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	wal.current = segment
+	wal.currentSize = 0
+	wal.dirty = false
+	wal.segments = append(wal.segments, wal.nextLsn)
+
+	return nil
+}
+
+// readSegment calls fn with every valid record of a segment, and
+// whether it's a tombstone. Reading stops at the first truncated or
+// corrupted record, which may happen on crash, and the segment is
+// truncated there. As the record length
+// isn't trusted before it's checksum is verified, a length larger than
+// WAL_SEGMENT_SIZE or than the rest of the segment is a corruption too.
+func (wal *WriteAheadLog) readSegment(firstLsn uint64, fn func(lsn uint64, payload []byte, tombstone bool) error) error {
+	segment, err := os.Open(wal.segmentPath(firstLsn))
+	if err != nil {
+		return err
+	}
+	defer segment.Close()
+
+	info, err := segment.Stat()
+	if err != nil {
+		return err
+	}
+
+	var offset int64
+	header := make([]byte, WAL_RECORD_HEADER_SIZE)
+	for {
+		if _, err := io.ReadFull(segment, header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return wal.truncateSegment(firstLsn, offset, "Truncated record")
+		}
+
+		tombstone := binary.BigEndian.Uint32(header[0:4])&WAL_RECORD_TOMBSTONE != 0
+		length := int64(binary.BigEndian.Uint32(header[0:4]) &^ WAL_RECORD_TOMBSTONE)
+		if length > WAL_SEGMENT_SIZE || length > info.Size()-offset-WAL_RECORD_HEADER_SIZE {
+			return wal.truncateSegment(firstLsn, offset, ErrWalCorrupted.Error())
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(segment, payload); err != nil {
+			return wal.truncateSegment(firstLsn, offset, "Truncated record")
+		}
+
+		if walRecordCrc(header, payload) != binary.BigEndian.Uint32(header[4:8]) {
+			return wal.truncateSegment(firstLsn, offset, ErrWalCorrupted.Error())
+		}
+
+		if err := fn(binary.BigEndian.Uint64(header[8:16]), payload, tombstone); err != nil {
+			return err
+		}
+		offset += WAL_RECORD_HEADER_SIZE + length
+	}
+}
+
+// truncateSegment drops the records of a segment following
+// offset, where an invalid record was found.
+func (wal *WriteAheadLog) truncateSegment(firstLsn uint64, offset int64, reason string) error {
+	l4g.Warn(fmt.Sprintf("[WriteAheadLog.readSegment] %s in segment %d at offset %d, truncating it", reason, firstLsn, offset))
+
+	return os.Truncate(wal.segmentPath(firstLsn), offset)
+}
+
+// walRecordCrc returns the checksum of a record length,
+// lsn and payload.
+func walRecordCrc(header []byte, payload []byte) uint32 {
+	crc := crc32.Checksum(header[0:4], walCrcTable)
+	crc = crc32.Update(crc, walCrcTable, header[8:16])
+
+	return crc32.Update(crc, walCrcTable, payload)
+}
+
+// writeCheckpoint atomically persists the committed lsn.
+func (wal *WriteAheadLog) writeCheckpoint() error {
+	var checkpoint [8]byte
+	binary.BigEndian.PutUint64(checkpoint[:], wal.committed)
+
+	tmpPath := wal.checkpointPath() + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	if _, err = file.Write(checkpoint[:]); err == nil && wal.SyncPolicy != WAL_SYNC_NEVER {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, wal.checkpointPath())
+}
+
+func (wal *WriteAheadLog) segmentPath(firstLsn uint64) string {
+	return filepath.Join(wal.Dir, fmt.Sprintf("%020d%s", firstLsn, WAL_SEGMENT_EXTENSION))
+}
+
+func (wal *WriteAheadLog) checkpointPath() string {
+	return filepath.Join(wal.Dir, WAL_CHECKPOINT_FILE)
+}
+
+// EncodeWalEvent returns the write-ahead log payload of an event:
+// it's sequence, so that replayed events keep their storage key,
+// followed by it's EncodeEvent representation.
+func EncodeWalEvent(event *Event) []byte {
+	return append(appendUint64(make([]byte, 0, 64), event.seq), EncodeEvent(event)...)
+}
+
+// DecodeWalEvent rebuilds an event from it's write-ahead log payload.
+func DecodeWalEvent(payload []byte) (*Event, error) {
+	if len(payload) < eventSequenceLength {
+		return nil, ErrWalCorrupted
+	}
+
+	event, err := DecodeEvent(payload[eventSequenceLength:])
+	if err != nil {
+		return nil, err
+	}
+	event.seq = binary.BigEndian.Uint64(payload)
+
+	return event, nil
+}
@@ -0,0 +1,190 @@
+package happening
+
+import (
+	"encoding/binary"
+	"os"
+	"strings"
+	"testing"
+)
+
+// openTestWal opens a write-ahead log in dir, and
+// returns the payloads it replays.
+func openTestWal(t *testing.T, dir string) (*WriteAheadLog, []string) {
+	t.Helper()
+
+	wal, err := OpenWriteAheadLog(dir, WAL_SYNC_ALWAYS, 0)
+	if err != nil {
+		t.Fatalf("OpenWriteAheadLog: %s", err)
+	}
+
+	var payloads []string
+	err = wal.Replay(func(lsn uint64, payload []byte) error {
+		payloads = append(payloads, string(payload))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Replay: %s", err)
+	}
+
+	return wal, payloads
+}
+
+func TestWriteAheadLogCorruptedTail(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(record []byte)
+	}{
+		{"huge length", func(record []byte) { binary.BigEndian.PutUint32(record[0:4], 0xffffffff) }},
+		{"length beyond segment", func(record []byte) { binary.BigEndian.PutUint32(record[0:4], WAL_SEGMENT_SIZE) }},
+		{"shorter length", func(record []byte) { binary.BigEndian.PutUint32(record[0:4], 1) }},
+		{"payload", func(record []byte) { record[WAL_RECORD_HEADER_SIZE] ^= 0xff }},
+		{"lsn", func(record []byte) { record[15] ^= 0xff }},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			wal, _ := openTestWal(t, dir)
+			firstLsn := wal.segments[len(wal.segments)-1]
+			for _, payload := range []string{"first", "second"} {
+				if _, err := wal.Append([]byte(payload)); err != nil {
+					t.Fatalf("Append: %s", err)
+				}
+			}
+			if err := wal.Close(); err != nil {
+				t.Fatalf("Close: %s", err)
+			}
+
+			path := wal.segmentPath(firstLsn)
+			segment, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatalf("ReadFile: %s", err)
+			}
+			secondOffset := WAL_RECORD_HEADER_SIZE + len("first")
+			test.corrupt(segment[secondOffset:])
+			if err := os.WriteFile(path, segment, 0644); err != nil {
+				t.Fatalf("WriteFile: %s", err)
+			}
+
+			wal, payloads := openTestWal(t, dir)
+			defer wal.Close()
+
+			if len(payloads) != 1 || payloads[0] != "first" {
+				t.Errorf("replayed payloads = %q, want [first]", payloads)
+			}
+
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatalf("Stat: %s", err)
+			}
+			if info.Size() != int64(secondOffset) {
+				t.Errorf("segment size = %d, want it truncated to %d", info.Size(), secondOffset)
+			}
+
+			// Records keep being appended after the truncated one
+			lsn, err := wal.Append([]byte("third"))
+			if err != nil {
+				t.Fatalf("Append: %s", err)
+			}
+			if lsn != 2 {
+				t.Errorf("lsn after truncation = %d, want 2", lsn)
+			}
+		})
+	}
+}
+
+func TestWriteAheadLogRecordTooLong(t *testing.T) {
+	wal, _ := openTestWal(t, t.TempDir())
+	defer wal.Close()
+
+	if _, err := wal.Append(make([]byte, WAL_SEGMENT_SIZE+1)); err == nil {
+		t.Errorf("Append of a record longer than a segment succeeded")
+	}
+}
+
+func TestWriteAheadLogCancel(t *testing.T) {
+	dir := t.TempDir()
+
+	wal, _ := openTestWal(t, dir)
+	var lsns []uint64
+	for _, payload := range []string{"first", "second", "third"} {
+		lsn, err := wal.Append([]byte(payload))
+		if err != nil {
+			t.Fatalf("Append: %s", err)
+		}
+		lsns = append(lsns, lsn)
+	}
+	if err := wal.Cancel(lsns[1]); err != nil {
+		t.Fatalf("Cancel: %s", err)
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatalf("Close: %s", err)
+	}
+
+	wal, payloads := openTestWal(t, dir)
+	defer wal.Close()
+
+	if len(payloads) != 2 || payloads[0] != "first" || payloads[1] != "third" {
+		t.Errorf("replayed payloads = %q, want [first third]", payloads)
+	}
+
+	// The tombstone took an lsn of it's own
+	lsn, err := wal.Append([]byte("fourth"))
+	if err != nil {
+		t.Fatalf("Append: %s", err)
+	}
+	if lsn != 5 {
+		t.Errorf("lsn after tombstone = %d, want 5", lsn)
+	}
+}
+
+func TestEventsHandlerCancelsLeftOutEvents(t *testing.T) {
+	tests := []struct {
+		policy string
+		want   []string
+	}{
+		{QUEUE_POLICY_REJECT, []string{"kitchen"}},
+		{QUEUE_POLICY_DROP_NEWEST, []string{"kitchen"}},
+		{QUEUE_POLICY_DROP_OLDEST, []string{"cellar"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.policy, func(t *testing.T) {
+			dir := t.TempDir()
+
+			wal, _ := openTestWal(t, dir)
+			handler := NewEventsHandler()
+			handler.Wal = wal
+			queue, err := NewBoundedQueue(1, 1, test.policy)
+			if err != nil {
+				t.Fatal(err)
+			}
+			handler.Queue = queue
+
+			frames, err := ExtractFrames(PipeCodec{}, []byte("kitchen|1392821124|temperature\r\ncellar|1392821124|temperature\r\n"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			handler.PushEventsToQueue(PipeCodec{}, frames, &EventsSource{})
+			if err := wal.Close(); err != nil {
+				t.Fatalf("Close: %s", err)
+			}
+
+			wal, payloads := openTestWal(t, dir)
+			defer wal.Close()
+
+			var recovered []string
+			for _, payload := range payloads {
+				event, err := DecodeWalEvent([]byte(payload))
+				if err != nil {
+					t.Fatalf("DecodeWalEvent: %s", err)
+				}
+				recovered = append(recovered, event.From)
+			}
+			if strings.Join(recovered, ",") != strings.Join(test.want, ",") {
+				t.Errorf("recovered events from %q, want %q", recovered, test.want)
+			}
+		})
+	}
+}